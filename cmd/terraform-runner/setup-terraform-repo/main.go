@@ -2,15 +2,39 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
 	"gopkg.in/src-d/go-git.v4/plumbing"
+	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
 	"k8s.io/klog"
+
+	repov1alpha1 "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
+	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/outputs"
+	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/policy"
+	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/prcomment"
+	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/runresult"
 )
 
-var ()
+// Changes are applied from a saved plan, so that what is applied is what was summarized
+const planFile = "tfplan"
+
+// result of the run, left in the termination message of the runner container
+var result runresult.Result
 
 func main() {
 	klog.Infof("Starting terraform-runner...")
@@ -23,47 +47,313 @@ func main() {
 	gitSHA := os.Getenv("GIT_SHA")
 	klog.Infof("GIT_SHA=%s", gitSHA)
 
-	GitCheckout(repoUrl, gitSHA)
+	gitRef := os.Getenv("GIT_REF")
+	klog.Infof("GIT_REF=%s", gitRef)
+
+	GitCheckout(repoUrl, gitRef, gitSHA)
 
 	klog.Infof("Listing repo contents...")
-	RunCommand("ls", "-al", "/workspace")
+	RunCommand("list", "ls", "-al", "/workspace")
+
+	klog.Infof("Checking Terraform version...")
+	out := RunCommand("version", "terraform", "version")
+	result.TerraformVersion = runresult.ParseTerraformVersion(out)
 
 	klog.Infof("Initializing Terraform...")
-	RunCommand("terraform", "init")
+	releasePluginCache := PreparePluginCache()
+	RunCommand("init", "terraform", "init", "-no-color")
+	releasePluginCache()
+
+	klog.Infof("Planning changes...")
+	RunCommand("plan", "terraform", "plan", "-input=false", "-no-color", "-out="+planFile)
+	SummarizePlan()
+	// the heads of pull requests are planned, never applied
+	if os.Getenv("PLAN_ONLY") == "true" {
+		StagePlan()
+		WriteResult()
+		return
+	}
+	EnforcePolicy()
 
 	klog.Infof("Applying changes...")
-	RunCommand("terraform", "apply", "-auto-approve")
+	out = RunCommand("apply", "terraform", "apply", "-input=false", "-no-color", planFile)
+	result.Resources = runresult.ParseResources(out)
+
+	StageOutputs()
+
+	WriteResult()
 }
 
-func GitCheckout(repoUrl string, gitSHA string) {
+// GitCheckout clones a repository and checks a revision out. The revisions
+// of references that are not branches, such as the heads of pull requests,
+// are fetched from their reference.
+func GitCheckout(repoUrl string, gitRef string, gitSHA string) {
+	start := time.Now()
 	repo, err := git.PlainClone("/workspace", false, &git.CloneOptions{
 		URL: repoUrl,
 	})
-	TerminateIfError(err, "Failed to clone repo: %v")
+	if err == nil && gitRef != "" {
+		err = repo.Fetch(&git.FetchOptions{
+			RefSpecs: []config.RefSpec{config.RefSpec(fmt.Sprintf("+%s:%s", gitRef, gitRef))},
+		})
+		if err == git.NoErrAlreadyUpToDate {
+			err = nil
+		}
+	}
+	EndStage("clone", start, err, "Failed to clone repo: %v")
 	klog.Infof("Completed cloning repo %s.", repoUrl)
 
+	start = time.Now()
 	worktree, err := repo.Worktree()
-	TerminateIfError(err, "Failed to fetch repo work tree: %v")
+	if err == nil {
+		err = worktree.Checkout(&git.CheckoutOptions{
+			Hash: plumbing.NewHash(gitSHA),
+		})
+	}
+	EndStage("checkout", start, err, "Failed to checkout revision: %v")
+	result.GitSHA = gitSHA
+	if head, err := repo.Head(); err == nil {
+		result.GitSHA = head.Hash().String()
+	}
+	klog.Infof("Completed repo checkout to %s.", result.GitSHA)
+}
 
-	err = worktree.Checkout(&git.CheckoutOptions{
-		Hash: plumbing.NewHash(gitSHA),
-	})
-	TerminateIfError(err, "Failed to checkout revision: %v")
-	klog.Infof("Completed repo checkout to %s.", gitSHA)
+// PreparePluginCache creates the plugin cache directory Terraform expects to
+// exist, if the controller mounted a cache, then locks it until the returned
+// function is called. Terraform does not guard its plugin cache against
+// concurrent writers, so the runs of a namespace take turns installing
+// providers. The lock is released if the runner exits. A cache that cannot
+// be used only slows the run down.
+func PreparePluginCache() func() {
+	pluginCacheDir := os.Getenv("TF_PLUGIN_CACHE_DIR")
+	if pluginCacheDir == "" {
+		return func() {}
+	}
+	if err := os.MkdirAll(pluginCacheDir, 0755); err != nil {
+		klog.Warningf("Failed to create plugin cache, plugins are not cached: %v", err)
+		os.Unsetenv("TF_PLUGIN_CACHE_DIR")
+		return func() {}
+	}
+	lock, err := os.OpenFile(filepath.Join(pluginCacheDir, ".lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err == nil {
+		klog.Infof("Waiting for the plugin cache...")
+		if err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+			lock.Close()
+		}
+	}
+	if err != nil {
+		klog.Warningf("Failed to lock plugin cache, plugins are not cached: %v", err)
+		os.Unsetenv("TF_PLUGIN_CACHE_DIR")
+		return func() {}
+	}
+	// closing the file releases the lock
+	return func() { lock.Close() }
 }
 
-func RunCommand(command string, args ...string) {
+// SummarizePlan reads the saved plan as JSON to record the changes it makes
+func SummarizePlan() {
+	start := time.Now()
+	planJSON := CommandOutput("show", "terraform", "show", "-json", planFile)
+	plan, err := runresult.SummarizePlan(planJSON)
+	EndStage("show", start, err, "Failed to summarize plan: %v")
+	result.Plan = plan
+	klog.Infof("%s.", plan)
+}
+
+// EnforcePolicy checks the plan against the plan policy of the Repo. Plans
+// the policy does not allow are left unapplied, and the run ends without
+// failing the Job: the controller reads the decision from the result.
+func EnforcePolicy() {
+	planPolicy := os.Getenv(policy.Env)
+	if planPolicy == "" {
+		return
+	}
+	start := time.Now()
+	var spec repov1alpha1.PlanPolicy
+	err := json.Unmarshal([]byte(planPolicy), &spec)
+	EndStage("policy", start, err, "Failed to read plan policy: %v")
+	var approved *repov1alpha1.PlanSummary
+	if approvedPlan := os.Getenv(policy.ApprovedEnv); approvedPlan != "" {
+		err = json.Unmarshal([]byte(approvedPlan), &approved)
+		EndStage("policy", start, err, "Failed to read approved plan: %v")
+	}
+
+	outcome := policy.Evaluate(&spec, result.Plan, approved)
+	result.Policy = &outcome
+	switch repov1alpha1.PolicyDecision(outcome.Decision) {
+	case repov1alpha1.PolicyDenied:
+		result.Failure = &runresult.Failure{
+			Step:   "policy",
+			Reason: "Plan denied by policy: " + strings.Join(outcome.Violations, "; "),
+		}
+		Stop("Plan denied by policy: %v", outcome.Violations)
+	case repov1alpha1.PolicyApprovalRequired:
+		Stop("Plan requires approval: %v", outcome.Violations)
+	}
+	klog.Infof("Plan allowed by policy.")
+}
+
+// StageOutputs leaves the outputs of the apply in a Secret, for the
+// controller to publish them
+func StageOutputs() {
+	secretName := os.Getenv("OUTPUTS_SECRET")
+	if secretName == "" {
+		return
+	}
+	start := time.Now()
+	outputsJSON := CommandOutput("output", "terraform", "output", "-json")
+	err := StageSecret(outputs.NewStagingSecret(secretName, os.Getenv("POD_NAMESPACE"), podOwner(), outputsJSON))
+	EndStage("output", start, err, "Failed to stage outputs: %v")
+	klog.Infof("Staged outputs in Secret %s.", secretName)
+}
+
+// StagePlan leaves the plan, as rendered by terraform show, in a Secret for
+// the controller to comment it on the pull request
+func StagePlan() {
+	secretName := os.Getenv("PLAN_SECRET")
+	if secretName == "" {
+		return
+	}
+	start := time.Now()
+	diff := CommandOutput("render", "terraform", "show", "-no-color", planFile)
+	err := StageNewSecret(prcomment.NewStagingSecret(secretName, os.Getenv("POD_NAMESPACE"), podOwner(), diff))
+	EndStage("render", start, err, "Failed to stage plan: %v")
+	klog.Infof("Staged plan in Secret %s.", secretName)
+}
+
+// StageSecret writes a Secret for the controller to read
+func StageSecret(secret *corev1.Secret) error {
+	secrets, err := secretsClient(secret.Namespace)
+	if err != nil {
+		return err
+	}
+	_, err = secrets.Create(secret)
+	// left by an earlier attempt of the Job
+	if kubeerrors.IsAlreadyExists(err) {
+		_, err = secrets.Update(secret)
+	}
+	return err
+}
+
+// StageNewSecret writes a Secret for the controller to read, keeping the one
+// left by an earlier attempt of the Job. Plans of pull requests may only
+// create Secrets, so that their code cannot overwrite the existing ones.
+func StageNewSecret(secret *corev1.Secret) error {
+	secrets, err := secretsClient(secret.Namespace)
+	if err != nil {
+		return err
+	}
+	_, err = secrets.Create(secret)
+	// an earlier attempt planned the same revision
+	if kubeerrors.IsAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
+
+func secretsClient(namespace string) (corev1client.SecretInterface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return client.CoreV1().Secrets(namespace), nil
+}
+
+// podOwner makes staged Secrets owned by the runner pod
+func podOwner() metav1.OwnerReference {
+	return metav1.OwnerReference{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Name:       os.Getenv("POD_NAME"),
+		UID:        types.UID(os.Getenv("POD_UID")),
+	}
+}
+
+// CommandOutput runs a command whose standard output is a document rather
+// than logs, such as terraform show -json, and returns it. The stage is left
+// for the caller to end, unless the command fails.
+func CommandOutput(stage string, command string, args ...string) []byte {
+	start := time.Now()
+	cmd := exec.Command(command, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		klog.Infof("\n%s", stderr.String())
+		recordStage(stage, start, exitCode(err))
+		Terminate(runresult.Failure{Step: stage, Reason: runresult.Reason(stderr.String(), err), Output: stderr.String()},
+			"Failed to run command: %v", err)
+	}
+	return out
+}
+
+// RunCommand runs a stage of the run and returns its output. The output,
+// errors included, is logged and kept to describe the failure of the stage.
+func RunCommand(stage string, command string, args ...string) string {
+	start := time.Now()
 	cmd := exec.Command(command, args...)
 	var out bytes.Buffer
 	cmd.Stdout = &out
+	cmd.Stderr = &out
 	err := cmd.Run()
-	TerminateIfError(err, "Failed to run command: %v")
 	klog.Infof("\n%s", out.String())
+	if err != nil {
+		recordStage(stage, start, exitCode(err))
+		Terminate(runresult.Failure{Step: stage, Reason: runresult.Reason(out.String(), err), Output: out.String()},
+			"Failed to run command: %v", err)
+	}
+	recordStage(stage, start, 0)
+	return out.String()
 }
 
-func TerminateIfError(err error, format string) {
+// EndStage records a stage run in process, terminating the run if it failed
+func EndStage(stage string, start time.Time, err error, format string) {
 	if err != nil {
-		klog.Errorf(format, err)
-		os.Exit(1)
+		recordStage(stage, start, 1)
+		Terminate(runresult.Failure{Step: stage, Reason: err.Error()}, format, err)
+	}
+	recordStage(stage, start, 0)
+}
+
+// Terminate exits after a stage failed, leaving the result of the run and
+// its failure in the termination message of the runner container
+func Terminate(failure runresult.Failure, format string, args ...interface{}) {
+	klog.Errorf(format, args...)
+	result.Failure = &failure
+	WriteResult()
+	klog.Flush()
+	os.Exit(1)
+}
+
+// Stop ends a run without applying its plan
+func Stop(format string, args ...interface{}) {
+	klog.Warningf(format, args...)
+	WriteResult()
+	klog.Flush()
+	os.Exit(0)
+}
+
+func WriteResult() {
+	if err := result.Write(); err != nil {
+		klog.Errorf("Failed to write termination message: %v", err)
+	}
+}
+
+func recordStage(stage string, start time.Time, exitCode int) {
+	result.Stages = append(result.Stages, runresult.Stage{
+		Name:           stage,
+		ExitCode:       exitCode,
+		DurationMillis: time.Since(start).Nanoseconds() / int64(time.Millisecond),
+	})
+}
+
+func exitCode(err error) int {
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() > 0 {
+		return exitErr.ExitCode()
 	}
+	return 1
 }
@@ -1,21 +1,27 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
-	batchinformers "k8s.io/client-go/informers/batch/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	batchclientset "k8s.io/client-go/kubernetes/typed/batch/v1"
 	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	batchlisters "k8s.io/client-go/listers/batch/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
@@ -23,14 +29,34 @@ import (
 
 	status "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/status"
 	repov1alpha1 "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
+	drain "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/drain"
 	samplescheme "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/generated/clientset/versioned/scheme"
-	informers "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/generated/informers/externalversions/repo/v1alpha1"
 	listers "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/generated/listers/repo/v1alpha1"
+	health "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/health"
+	metrics "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/metrics"
+	multinamespace "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/multinamespace"
+	outputs "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/outputs"
+	policy "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/policy"
 	poller "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/poller"
+	prcomment "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/prcomment"
+	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/runnercache"
+	runresult "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/runresult"
+	scheduler "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/scheduler"
+	sharding "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/sharding"
+	verification "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/verification"
 )
 
 const controllerAgentName = "repo-gitops-controller"
 
+// Value of the 'controller' label set on the Jobs created for Repos
+const jobControllerLabel = "repos.terraform.gitops.k8s.io"
+
+// Queued runs are retried this often in case a Job finishing was missed
+const queuedRunRetryPeriod = 30 * time.Second
+
+// A worker syncing a single Repo for longer than this is reported as stuck
+const maxSyncDuration = 5 * time.Minute
+
 const (
 	// SuccessSynced is used as part of the Event 'reason' when a Repo is synced
 	SuccessSynced = "Synced"
@@ -44,6 +70,54 @@ const (
 	// MessageResourceSynced is the message used for an Event fired when a Repo
 	// is synced successfully
 	MessageResourceSynced = "Repo synced successfully"
+
+	// RunQueued is used as part of the Event 'reason' when the Job of a new
+	// run is not created because too many runs are in progress
+	RunQueued = "Queued"
+	// RunFailed is used as part of the Event 'reason' when the Job of a run fails
+	RunFailed = "RunFailed"
+	// RunPlanned is used as part of the Event 'reason' when a finished run
+	// reports the changes it planned
+	RunPlanned = "Planned"
+	// RunAwaitingApproval is used as part of the Event 'reason' when the plan
+	// policy of a Repo holds the plan of a run until its revision is approved
+	RunAwaitingApproval = "AwaitingApproval"
+	// RunApproved is used as part of the Event 'reason' when a revision held
+	// for approval is approved
+	RunApproved = "Approved"
+	// OutputsPublished is used as part of the Event 'reason' when the
+	// Terraform outputs of a run are written to the objects of the Repo
+	OutputsPublished = "OutputsPublished"
+	// OutputsFailed is used as part of the Event 'reason' when the Terraform
+	// outputs of a run cannot be published
+	OutputsFailed = "OutputsFailed"
+	// PlanCommented is used as part of the Event 'reason' when the plan of
+	// the head of a pull request is commented on the pull request
+	PlanCommented = "PlanCommented"
+	// PlanCommentFailed is used as part of the Event 'reason' when the plan
+	// of the head of a pull request cannot be commented
+	PlanCommentFailed = "PlanCommentFailed"
+)
+
+// Name of the container running Terraform in the Job pods
+const runnerContainerName = "terraform-run"
+
+const (
+	// Annotations set on Jobs to describe the commit being applied
+	CommitSHAAnnotation       = "terraform.gitops.k8s.io/commit-sha"
+	CommitAuthorAnnotation    = "terraform.gitops.k8s.io/commit-author"
+	CommitCommitterAnnotation = "terraform.gitops.k8s.io/commit-committer"
+	CommitSubjectAnnotation   = "terraform.gitops.k8s.io/commit-subject"
+	CommitTimestampAnnotation = "terraform.gitops.k8s.io/commit-timestamp"
+
+	// Annotations set on finished Jobs to count the changes they planned
+	PlanAddAnnotation     = "terraform.gitops.k8s.io/plan-add"
+	PlanChangeAnnotation  = "terraform.gitops.k8s.io/plan-change"
+	PlanDestroyAnnotation = "terraform.gitops.k8s.io/plan-destroy"
+	PlanReplaceAnnotation = "terraform.gitops.k8s.io/plan-replace"
+
+	// Annotation set on the Jobs planning the head of a pull request
+	PullRequestAnnotation = "terraform.gitops.k8s.io/pull-request"
 )
 
 // Controller is the controller implementation for Repo resources
@@ -57,6 +131,9 @@ type Controller struct {
 	jobsSynced  cache.InformerSynced
 	reposLister listers.RepoLister
 	reposSynced cache.InformerSynced
+	// pods of the runners, read for the failure of a run
+	podsLister corelisters.PodLister
+	podsSynced cache.InformerSynced
 
 	// workqueue is a rate limited work queue. This is used to queue work to be
 	// processed instead of performing it as soon as a change happens. This
@@ -68,16 +145,40 @@ type Controller struct {
 	// Kubernetes API.
 	recorder record.EventRecorder
 
-	// keeps references to polling goroutines by repo key
-	repoPollers map[string]*poller.RepoPoller
+	// checks the sources of Repos for new revisions
+	pollScheduler *poller.PollScheduler
+	// lists the references of Repos sharing a source once per polling interval
+	sourceCache *poller.SourceCache
+	// checks commit signatures for Repos with a verification spec
+	commitVerifier poller.CommitVerifier
+	// reports readiness and stuck workers or pollers to the health probes
+	monitor *health.Monitor
+	// decides which Repos are handled by this replica
+	shards sharding.Filter
+	// holds new runs back while too many Jobs are running
+	throttler *scheduler.Throttler
+	// syncs in progress, waited for on shutdown
+	syncs *drain.Tracker
+	// writes the Terraform outputs of successful runs
+	outputsPublisher *outputs.Publisher
+	// comments the plans of the heads of pull requests
+	planPublisher *prcomment.Publisher
+	// shares downloaded provider plugins between runs
+	runnerCache runnercache.Cache
+	// service account the untrusted plans of pull requests run as
+	planServiceAccount string
 }
 
 func NewController(
 	batchclientset batchclientset.BatchV1Interface,
 	kubeclientset kubernetes.Interface,
 	repoStatusManager status.RepoStatusManager,
-	jobInformer batchinformers.JobInformer,
-	repoInformer informers.RepoInformer) *Controller {
+	namespaceInformers []multinamespace.Informers,
+	monitor *health.Monitor,
+	shards sharding.Filter,
+	limits scheduler.Limits,
+	runnerCache runnercache.Cache,
+	planServiceAccount string) *Controller {
 
 	// Create event broadcaster
 	// Add repo-controller types to the default Kubernetes Scheme so Events can be
@@ -89,27 +190,70 @@ func NewController(
 	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeclientset.CoreV1().Events("")})
 	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: controllerAgentName})
 
+	var namespaces []string
+	var jobListers []batchlisters.JobLister
+	var repoListers []listers.RepoLister
+	var podListers []corelisters.PodLister
+	var jobsSynced, reposSynced, podsSynced []cache.InformerSynced
+	for _, informers := range namespaceInformers {
+		namespaces = append(namespaces, informers.Namespace)
+		jobListers = append(jobListers, informers.Jobs.Lister())
+		repoListers = append(repoListers, informers.Repos.Lister())
+		podListers = append(podListers, informers.Pods.Lister())
+		jobsSynced = append(jobsSynced, informers.Jobs.Informer().HasSynced)
+		reposSynced = append(reposSynced, informers.Repos.Informer().HasSynced)
+		podsSynced = append(podsSynced, informers.Pods.Informer().HasSynced)
+	}
+
+	jobsLister := multinamespace.NewJobLister(namespaces, jobListers)
 	controller := &Controller{
 		batchclientset:    batchclientset,
 		repoStatusManager: repoStatusManager,
-		jobsLister:        jobInformer.Lister(),
-		jobsSynced:        jobInformer.Informer().HasSynced,
-		reposLister:       repoInformer.Lister(),
-		reposSynced:       repoInformer.Informer().HasSynced,
+		jobsLister:        jobsLister,
+		jobsSynced:        multinamespace.AllSynced(jobsSynced...),
+		reposLister:       multinamespace.NewRepoLister(namespaces, repoListers),
+		reposSynced:       multinamespace.AllSynced(reposSynced...),
+		podsLister:        multinamespace.NewPodLister(namespaces, podListers),
+		podsSynced:        multinamespace.AllSynced(podsSynced...),
 		workqueue:         workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Repos"),
 		recorder:          recorder,
-		repoPollers:       make(map[string]*poller.RepoPoller),
+		pollScheduler:     poller.NewPollScheduler(monitor),
+		sourceCache:       poller.NewSourceCache(poller.GitRemoteDelegator{}, poller.POLLING_FREQUENCY_SECONDS*time.Second),
+		commitVerifier:    verification.NewSignatureVerifier(kubeclientset),
+		monitor:           monitor,
+		shards:            shards,
+		throttler: scheduler.NewThrottler(limits, jobsLister,
+			labels.SelectorFromSet(labels.Set{"controller": jobControllerLabel})),
+		syncs:              drain.NewTracker(),
+		outputsPublisher:   outputs.NewPublisher(kubeclientset),
+		planPublisher:      prcomment.NewPublisher(kubeclientset),
+		runnerCache:        runnerCache,
+		planServiceAccount: planServiceAccount,
 	}
 
 	klog.Info("Setting up event handlers")
+	for _, informers := range namespaceInformers {
+		controller.addEventHandlers(informers)
+	}
+
+	return controller
+}
+
+// addEventHandlers watches the Repos and Jobs of a namespace
+func (c *Controller) addEventHandlers(informers multinamespace.Informers) {
 	// Set up an event handler for when Repo resources change
-	// TODO terminate poller on Repo deletion
-	repoInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: controller.enqueueRepo,
+	informers.Repos.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueueRepo,
 		UpdateFunc: func(old, new interface{}) {
-			controller.enqueueRepo(new)
+			c.enqueueRepo(new)
+			oldRepo := old.(*repov1alpha1.Repo)
+			newRepo := new.(*repov1alpha1.Repo)
+			// pollers read the Repo on every check, a new spec is checked right away
+			if !equality.Semantic.DeepEqual(oldRepo.Spec, newRepo.Spec) {
+				c.pollRepoNow(newRepo)
+			}
 		},
-		DeleteFunc: controller.descheduleRepoPoller,
+		DeleteFunc: c.descheduleRepoPoller,
 	})
 	// Set up an event handler for when Job resources change. This
 	// handler will lookup the owner of the given Job, and if it is
@@ -117,8 +261,8 @@ func NewController(
 	// processing. This way, we don't need to implement custom logic for
 	// handling Job resources. More info on this pattern:
 	// https://github.com/kubernetes/community/blob/8cafef897a22026d42f5e5bb3f104febe7e29830/contributors/devel/controllers.md
-	jobInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: controller.handleJob,
+	informers.Jobs.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.handleJob,
 		UpdateFunc: func(old, new interface{}) {
 			newDepl := new.(*batchv1.Job)
 			oldDepl := old.(*batchv1.Job)
@@ -127,19 +271,24 @@ func NewController(
 				// Two different versions of the same Deployment will always have different RVs.
 				return
 			}
-			controller.handleJob(new)
+			c.handleJob(new)
+			if !scheduler.IsFinished(oldDepl) && scheduler.IsFinished(newDepl) {
+				c.enqueueQueuedRepos()
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			c.handleJob(obj)
+			c.enqueueQueuedRepos()
 		},
-		DeleteFunc: controller.handleJob,
 	})
-
-	return controller
 }
 
 // Run will set up the event handlers for types we are interested in, as well
 // as syncing informer caches and starting workers. It will block until stopCh
 // is closed, at which point it will shutdown the workqueue and wait for
-// workers to finish processing their current work items.
-func (c *Controller) Run(threadiness int, stopCh <-chan struct{}) error {
+// workers to finish processing their current work items, for up to
+// shutdownTimeout. Repos are polled by pollWorkers workers.
+func (c *Controller) Run(threadiness int, pollWorkers int, shutdownTimeout time.Duration, stopCh <-chan struct{}) error {
 	defer utilruntime.HandleCrash()
 	defer c.workqueue.ShutDown()
 
@@ -148,20 +297,40 @@ func (c *Controller) Run(threadiness int, stopCh <-chan struct{}) error {
 
 	// Wait for the caches to be synced before starting workers
 	klog.Info("Waiting for informer caches to sync")
-	if ok := cache.WaitForCacheSync(stopCh, c.jobsSynced, c.reposSynced); !ok {
+	c.monitor.SetReady(false)
+	if ok := cache.WaitForCacheSync(stopCh, c.jobsSynced, c.reposSynced, c.podsSynced); !ok {
 		return fmt.Errorf("failed to wait for caches to sync")
 	}
 
+	// Repos deleted while the controller was down, or while the caches were
+	// syncing, are no longer polled
+	c.reconcilePollers()
+
 	klog.Info("Starting workers")
 	// Launch two workers to process Repo resources
 	for i := 0; i < threadiness; i++ {
 		go wait.Until(c.runWorker, time.Second, stopCh)
 	}
 
+	pollersStopped := make(chan struct{})
+	go func() {
+		defer close(pollersStopped)
+		c.pollScheduler.Run(pollWorkers, shutdownTimeout, stopCh)
+	}()
+
 	klog.Info("Started workers")
+	c.monitor.SetReady(true)
 	<-stopCh
+	c.monitor.SetReady(false)
 	klog.Info("Shutting down workers")
 
+	c.workqueue.ShutDown()
+	if abandoned := c.syncs.Wait(shutdownTimeout); len(abandoned) != 0 {
+		klog.Warningf("Abandoned syncs of %v after waiting %s", abandoned, shutdownTimeout)
+	}
+	<-pollersStopped
+	klog.Info("Shut down workers")
+
 	return nil
 }
 
@@ -182,6 +351,16 @@ func (c *Controller) processNextWorkItem() bool {
 		return false
 	}
 
+	key, _ := obj.(string)
+	c.syncs.Start(key)
+	defer c.syncs.Done(key)
+	// Repos still queued on shutdown are synced by the next controller
+	if c.workqueue.ShuttingDown() {
+		klog.Infof("Abandoning sync of '%s' on shutdown", key)
+		c.workqueue.Done(obj)
+		return false
+	}
+
 	// We wrap this block in a func so we can defer c.workqueue.Done.
 	err := func(obj interface{}) error {
 		// We call Done here so the workqueue knows we have finished
@@ -208,6 +387,8 @@ func (c *Controller) processNextWorkItem() bool {
 		}
 		// Run the syncHandler, passing it the namespace/name string of the
 		// Repo resource to be synced.
+		c.monitor.Heartbeat("sync/"+key, maxSyncDuration)
+		defer c.monitor.Forget("sync/" + key)
 		if err := c.syncHandler(key); err != nil {
 			// Put the item back on the workqueue to handle any transient errors.
 			c.workqueue.AddRateLimited(key)
@@ -239,6 +420,12 @@ func (c *Controller) syncHandler(key string) error {
 		return nil
 	}
 
+	// Repos moved to another replica are left to it
+	if !c.shards.Owns(key) {
+		klog.V(4).Infof("Repo '%s' is handled by another replica", key)
+		return nil
+	}
+
 	// Get the Repo resource with this namespace/name
 	repo, err := c.reposLister.Repos(namespace).Get(name)
 	if err != nil {
@@ -246,13 +433,45 @@ func (c *Controller) syncHandler(key string) error {
 		// processing.
 		if errors.IsNotFound(err) {
 			utilruntime.HandleError(fmt.Errorf("repo '%s' in work queue no longer exists", key))
+			c.throttler.Forget(key)
 			return nil
 		}
 
 		return err
 	}
 
+	if c.repoStatusManager.IsApproved(repo) {
+		approved := repo.DeepCopy()
+		if err := c.repoStatusManager.SetApprovedRun(approved); err != nil {
+			return err
+		}
+		klog.Infof("Revision %s of '%s' was approved", approved.Status.GitSHA, key)
+		c.recorder.Eventf(repo, corev1.EventTypeNormal, RunApproved, "Revision %s was approved, starting run %s",
+			approved.Status.GitSHA, approved.Status.RunJobName)
+		// the status update brings the Repo back to create the Job
+		return nil
+	}
+
+	if repo.Spec.PullRequests != nil {
+		updated, err := c.syncPullRequests(repo)
+		if updated {
+			// the status update brings the Repo back to sync its run
+			return err
+		}
+		if err != nil {
+			// pull requests are synced again later, without holding the run back
+			utilruntime.HandleError(fmt.Errorf("error syncing pull requests of '%s': %s", key, err.Error()))
+			c.workqueue.AddAfter(key, queuedRunRetryPeriod)
+		}
+	}
+
+	if c.repoStatusManager.HasPendingOutputs(repo) {
+		c.throttler.Forget(key)
+		return c.publishOutputs(repo)
+	}
+
 	if !c.repoStatusManager.IsNewRepoRun(repo) {
+		c.throttler.Forget(key)
 		klog.Infof("Repo has no Job to run [last known run status: %s].", repo.Status.RunStatus)
 		return nil
 	}
@@ -261,7 +480,36 @@ func (c *Controller) syncHandler(key string) error {
 	job, err := c.jobsLister.Jobs(repo.Namespace).Get(repo.Status.RunJobName)
 	// If the resource doesn't exist, we'll create it
 	if errors.IsNotFound(err) {
-		job, err = c.batchclientset.Jobs(repo.Namespace).Create(newJob(repo))
+		run := scheduler.Run{
+			RepoKey:   key,
+			Namespace: repo.Namespace,
+			JobName:   repo.Status.RunJobName,
+			Priority:  repo.Spec.Priority,
+		}
+		var admitted bool
+		var reason string
+		admitted, reason, err = c.throttler.Admit(run)
+		if err != nil {
+			return err
+		}
+		if !admitted {
+			return c.queueRun(key, repo, reason)
+		}
+
+		job = newJob(repo)
+		c.runnerCache.Mount(job, repo)
+		job, err = c.batchclientset.Jobs(repo.Namespace).Create(job)
+		if err != nil {
+			if !errors.IsAlreadyExists(err) {
+				c.throttler.Release(run)
+			}
+			return err
+		}
+		metrics.JobCreated(repo.Namespace, repo.Name)
+		// the next queued run may fit in the remaining slots
+		if c.repoStatusManager.IsQueued(repo) {
+			c.enqueueQueuedRepos()
+		}
 	}
 
 	// If an error occurs during Get/Create, we'll requeue the item so we can
@@ -290,8 +538,384 @@ func (c *Controller) syncHandler(key string) error {
 	return nil
 }
 
+// syncPullRequests creates the Jobs planning the heads of the pull requests
+// of a Repo, then comments the plans on the pull requests once the Jobs
+// finished. Plan Jobs count against the limits on the runs in progress, and
+// wait for a slot like the runs of the Repo do. It tells if it recorded the
+// progress of the plans.
+func (c *Controller) syncPullRequests(repo *repov1alpha1.Repo) (bool, error) {
+	key := repo.Namespace + "/" + repo.Name
+	previous := repo.Status.PullRequests
+	// Objects from the lister are shared with other workers and must not be modified
+	repo = repo.DeepCopy()
+	updated := false
+	queued := false
+	var errs []error
+	for i := range repo.Status.PullRequests {
+		run := &repo.Status.PullRequests[i]
+		if run.Commented {
+			continue
+		}
+		job, err := c.jobsLister.Jobs(repo.Namespace).Get(run.RunJobName)
+		if errors.IsNotFound(err) {
+			// each pull request waits for a slot of its own
+			planRun := scheduler.Run{
+				RepoKey:   fmt.Sprintf("%s#%d", key, run.Number),
+				Namespace: repo.Namespace,
+				JobName:   run.RunJobName,
+				Priority:  repo.Spec.Priority,
+			}
+			var admitted bool
+			var reason string
+			admitted, reason, err = c.throttler.Admit(planRun)
+			if err == nil && !admitted {
+				klog.Infof("Queuing plan %s of pull request #%d of '%s': %s", run.RunJobName, run.Number, key, reason)
+				if run.RunStatus != "Queued" {
+					run.RunStatus = "Queued"
+					updated = true
+					c.recorder.Eventf(repo, corev1.EventTypeNormal, RunQueued, "Plan %s of pull request #%d is queued: %s",
+						run.RunJobName, run.Number, reason)
+				}
+				queued = true
+				continue
+			}
+			if err == nil {
+				wasQueued := run.RunStatus == "Queued"
+				job, err = c.batchclientset.Jobs(repo.Namespace).Create(newPlanJob(repo, *run, c.planServiceAccount))
+				if err == nil {
+					metrics.JobCreated(repo.Namespace, repo.Name)
+					// the next queued run may fit in the remaining slots
+					if wasQueued {
+						c.enqueueQueuedRepos()
+					}
+				} else if !errors.IsAlreadyExists(err) {
+					c.throttler.Release(planRun)
+				}
+			}
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !metav1.IsControlledBy(job, repo) {
+			msg := fmt.Sprintf(MessageResourceExists, job.Name)
+			c.recorder.Event(repo, corev1.EventTypeWarning, ErrResourceExists, msg)
+			errs = append(errs, fmt.Errorf(msg))
+			continue
+		}
+
+		runStatus := status.DetermineRunStatus(job)
+		if runStatus != run.RunStatus {
+			run.RunStatus = runStatus
+			updated = true
+		}
+		if runStatus != "Completed" && runStatus != "Failed" {
+			continue
+		}
+		result, failure := c.runResult(job)
+		if result != nil {
+			run.Plan = result.Plan
+		}
+		if runStatus == "Failed" {
+			run.Failure = failure
+		}
+		if err := c.planPublisher.Publish(repo, *run, result, failure); err != nil {
+			c.recorder.Eventf(repo, corev1.EventTypeWarning, PlanCommentFailed,
+				"Failed to comment plan of revision %s on pull request #%d: %v", run.GitSHA, run.Number, err)
+			errs = append(errs, err)
+			continue
+		}
+		c.recorder.Eventf(repo, corev1.EventTypeNormal, PlanCommented,
+			"Commented plan of revision %s on pull request #%d", run.GitSHA, run.Number)
+		run.Commented = true
+		updated = true
+	}
+	if queued {
+		c.workqueue.AddAfter(key, queuedRunRetryPeriod)
+	}
+	if updated {
+		if err := c.repoStatusManager.SetPullRequestRuns(repo, previous); err != nil {
+			return false, err
+		}
+	}
+	return updated, utilerrors.NewAggregate(errs)
+}
+
+// queueRun holds a new run back until running Jobs finish. Queued Repos are
+// requeued when a Job finishes, and periodically in case that was missed.
+func (c *Controller) queueRun(key string, repo *repov1alpha1.Repo, reason string) error {
+	klog.Infof("Queuing run %s of '%s': %s", repo.Status.RunJobName, key, reason)
+	if !c.repoStatusManager.IsQueued(repo) {
+		if err := c.repoStatusManager.SetQueued(repo.DeepCopy()); err != nil {
+			return err
+		}
+		c.recorder.Eventf(repo, corev1.EventTypeNormal, RunQueued, "Run %s is queued: %s", repo.Status.RunJobName, reason)
+	}
+	c.workqueue.AddAfter(key, queuedRunRetryPeriod)
+	return nil
+}
+
+// enqueueQueuedRepos gives queued runs a chance to start once a Job finishes
+func (c *Controller) enqueueQueuedRepos() {
+	repos, err := c.reposLister.List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	for _, repo := range repos {
+		if !c.repoStatusManager.IsQueued(repo) && !c.repoStatusManager.HasQueuedPullRequests(repo) {
+			continue
+		}
+		key := repo.Namespace + "/" + repo.Name
+		if c.shards.Owns(key) {
+			c.workqueue.Add(key)
+		}
+	}
+}
+
 func (c *Controller) updateRepoStatus(repo *repov1alpha1.Repo, job *batchv1.Job) error {
-	return c.repoStatusManager.SetJobRunStatus(repo, job)
+	// Jobs of earlier runs, such as a run held for approval, no longer describe the Repo
+	if job.Name != repo.Status.RunJobName {
+		return nil
+	}
+	// Objects from the lister are shared with other workers and must not be modified
+	repo = repo.DeepCopy()
+	previousStatus := repo.Status.RunStatus
+	runStatus := status.DetermineRunStatus(job)
+	finished := runStatus == "Completed" || runStatus == "Failed"
+	var err error
+	// the result is read once, unless the runner pod had not been seen yet
+	if finished && (!c.repoStatusManager.IsRunFinished(repo) || repo.Status.Result == nil) {
+		result, failure := c.runResult(job)
+		if result != nil && result.Plan != nil {
+			if err := c.annotatePlan(job, result.Plan); err != nil {
+				return err
+			}
+		}
+		err = c.repoStatusManager.SetRunFinished(repo, job, result, failure)
+	} else {
+		err = c.repoStatusManager.SetJobRunStatus(repo, job)
+	}
+	if err != nil {
+		return err
+	}
+	if repo.Status.RunStatus != previousStatus {
+		observeRunFinished(repo, job)
+		if result := repo.Status.Result; finished && result != nil {
+			c.recordRunResult(repo, job, result)
+		}
+		if repo.Status.Failure != nil {
+			c.recordRunFailure(repo, job, repo.Status.Failure)
+		}
+	}
+	return nil
+}
+
+// publishOutputs writes the outputs of a successful run. Failures are
+// reported without failing the run, as its changes were applied, and the
+// outputs are published again until they are.
+func (c *Controller) publishOutputs(repo *repov1alpha1.Repo) error {
+	jobName := repo.Status.RunJobName
+	published, err := c.outputsPublisher.Publish(repo, jobName)
+	if err != nil {
+		c.recorder.Eventf(repo, corev1.EventTypeWarning, OutputsFailed, "Failed to publish outputs of run %s: %v", jobName, err)
+		return err
+	}
+	c.recorder.Eventf(repo, corev1.EventTypeNormal, OutputsPublished, "Published %d outputs and %d sensitive outputs of run %s",
+		published.Plain, published.Sensitive, jobName)
+	if err := c.repoStatusManager.SetOutputsPublished(repo.DeepCopy()); err != nil {
+		return err
+	}
+	// the staging Secret is deleted along with the runner pod otherwise
+	if err := c.outputsPublisher.DeleteStaged(repo, jobName); err != nil {
+		utilruntime.HandleError(err)
+	}
+	return nil
+}
+
+// recordRunResult reports the plan of a finished run, and whether it is
+// waiting for approval
+func (c *Controller) recordRunResult(repo *repov1alpha1.Repo, job *batchv1.Job, result *repov1alpha1.RunResult) {
+	if plan := result.Plan; plan != nil {
+		c.recorder.Eventf(repo, corev1.EventTypeNormal, RunPlanned, "Plan: %d to add, %d to change, %d to destroy",
+			plan.Add, plan.Change, plan.Destroy)
+	}
+	if policy := result.Policy; policy != nil && policy.Decision == repov1alpha1.PolicyApprovalRequired {
+		c.recorder.Eventf(repo, corev1.EventTypeNormal, RunAwaitingApproval,
+			"Run %s is awaiting approval, the plan %s. Set the %s annotation to %s to apply it",
+			job.Name, strings.Join(policy.Violations, " and "), repov1alpha1.ApprovedGitSHAAnnotation, repo.Status.GitSHA)
+	}
+}
+
+// runResult reads the result of a finished Job from the termination message
+// of its runner. The failure of a failed Job is read from its failure
+// condition when the runner left no message, or no runner pod is left.
+func (c *Controller) runResult(job *batchv1.Job) (*repov1alpha1.RunResult, *repov1alpha1.RunFailure) {
+	var result runresult.Result
+	if terminated := c.runnerTermination(job); terminated != nil && terminated.Message != "" {
+		result = runresult.Parse(terminated.Message)
+	}
+	var runResult *repov1alpha1.RunResult
+	if result.IsStructured() {
+		runResult = newRunResult(result)
+	}
+	// a Job of a Repo with a plan policy may only complete once its runner
+	// reported the decision, otherwise whatever it applied went unchecked
+	if status.DetermineRunStatus(job) == "Completed" && policy.Enforced(job) &&
+		(runResult == nil || runResult.Policy == nil) {
+		failure := &repov1alpha1.RunFailure{
+			Step:   "policy",
+			Reason: "the decision of the plan policy is missing from the runner termination message",
+		}
+		if result.Failure != nil {
+			failure.Output = result.Failure.Output
+		}
+		return runResult, failure
+	}
+	// runners report plans denied by policy as failures without failing the Job
+	if failure := result.Failure; failure != nil {
+		return runResult, &repov1alpha1.RunFailure{Step: failure.Step, Reason: failure.Reason, Output: failure.Output}
+	}
+	if status.DetermineRunStatus(job) != "Failed" {
+		return runResult, nil
+	}
+
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == batchv1.JobFailed && condition.Status == corev1.ConditionTrue {
+			return runResult, &repov1alpha1.RunFailure{Reason: fmt.Sprintf("%s: %s", condition.Reason, condition.Message)}
+		}
+	}
+	return runResult, &repov1alpha1.RunFailure{Reason: "runner failed without a termination message"}
+}
+
+// annotatePlan counts the changes planned by a finished Job on the Job itself
+func (c *Controller) annotatePlan(job *batchv1.Job, plan *repov1alpha1.PlanSummary) error {
+	annotations := map[string]string{
+		PlanAddAnnotation:     strconv.Itoa(int(plan.Add)),
+		PlanChangeAnnotation:  strconv.Itoa(int(plan.Change)),
+		PlanDestroyAnnotation: strconv.Itoa(int(plan.Destroy)),
+		PlanReplaceAnnotation: strconv.Itoa(int(plan.Replace)),
+	}
+	upToDate := true
+	for key, value := range annotations {
+		if job.Annotations[key] != value {
+			upToDate = false
+		}
+	}
+	if upToDate {
+		return nil
+	}
+
+	job = job.DeepCopy()
+	if job.Annotations == nil {
+		job.Annotations = make(map[string]string)
+	}
+	for key, value := range annotations {
+		job.Annotations[key] = value
+	}
+	_, err := c.batchclientset.Jobs(job.Namespace).Update(job)
+	return err
+}
+
+// runnerTermination returns the state of the runner container that
+// terminated last among the pods of a Job
+func (c *Controller) runnerTermination(job *batchv1.Job) *corev1.ContainerStateTerminated {
+	pods, err := c.podsLister.Pods(job.Namespace).List(labels.SelectorFromSet(labels.Set{"job-name": job.Name}))
+	if err != nil {
+		utilruntime.HandleError(err)
+	}
+
+	var terminated *corev1.ContainerStateTerminated
+	for _, pod := range pods {
+		for _, container := range pod.Status.ContainerStatuses {
+			state := container.State.Terminated
+			if container.Name != runnerContainerName || state == nil {
+				continue
+			}
+			if terminated == nil || terminated.FinishedAt.Before(&state.FinishedAt) {
+				terminated = state
+			}
+		}
+	}
+	return terminated
+}
+
+func newRunResult(result runresult.Result) *repov1alpha1.RunResult {
+	runResult := &repov1alpha1.RunResult{
+		GitSHA:           result.GitSHA,
+		TerraformVersion: result.TerraformVersion,
+	}
+	for _, stage := range result.Stages {
+		runResult.Stages = append(runResult.Stages, repov1alpha1.RunStage{
+			Name:     stage.Name,
+			ExitCode: int32(stage.ExitCode),
+			Duration: metav1.Duration{Duration: time.Duration(stage.DurationMillis) * time.Millisecond},
+		})
+	}
+	if plan := result.Plan; plan != nil {
+		runResult.Plan = &repov1alpha1.PlanSummary{
+			Add:     int32(plan.Add),
+			Change:  int32(plan.Change),
+			Destroy: int32(plan.Destroy),
+			Replace: int32(plan.Replace),
+		}
+		for _, change := range plan.Changes {
+			runResult.Plan.Changes = append(runResult.Plan.Changes, repov1alpha1.PlanChange{
+				Address: change.Address,
+				Action:  change.Action,
+			})
+		}
+	}
+	if policy := result.Policy; policy != nil {
+		runResult.Policy = &repov1alpha1.PolicyOutcome{
+			Decision:   repov1alpha1.PolicyDecision(policy.Decision),
+			Violations: policy.Violations,
+		}
+	}
+	if resources := result.Resources; resources != nil {
+		runResult.Resources = &repov1alpha1.ResourceChanges{
+			Add:     int32(resources.Add),
+			Change:  int32(resources.Change),
+			Destroy: int32(resources.Destroy),
+		}
+	}
+	return runResult
+}
+
+func (c *Controller) recordRunFailure(repo *repov1alpha1.Repo, job *batchv1.Job, failure *repov1alpha1.RunFailure) {
+	if failure.Step != "" {
+		c.recorder.Eventf(repo, corev1.EventTypeWarning, RunFailed, "Run %s failed at step %s: %s", job.Name, failure.Step, failure.Reason)
+		return
+	}
+	c.recorder.Eventf(repo, corev1.EventTypeWarning, RunFailed, "Run %s failed: %s", job.Name, failure.Reason)
+}
+
+// observeRunFinished records the outcome of a run once its Job has completed or failed
+func observeRunFinished(repo *repov1alpha1.Repo, job *batchv1.Job) {
+	var finishTime *metav1.Time
+	// runs stopped by the plan policy end with a completed Job
+	switch status.DetermineRunStatus(job) {
+	case "Completed":
+		finishTime = job.Status.CompletionTime
+	case "Failed":
+		for _, condition := range job.Status.Conditions {
+			if condition.Type == batchv1.JobFailed && condition.Status == corev1.ConditionTrue {
+				finishTime = &condition.LastTransitionTime
+			}
+		}
+	default:
+		return
+	}
+
+	var runDuration, sinceDetection time.Duration
+	if finishTime != nil && job.Status.StartTime != nil {
+		runDuration = finishTime.Sub(job.Status.StartTime.Time)
+	}
+	// nothing was applied yet for runs awaiting approval
+	if finishTime != nil && repo.Status.RevisionDetectedTime != nil && repo.Status.RunStatus != "AwaitingApproval" {
+		sinceDetection = finishTime.Sub(repo.Status.RevisionDetectedTime.Time)
+	}
+	metrics.RunFinished(repo.Namespace, repo.Name, repo.Status.RunStatus, runDuration, sinceDetection)
 }
 
 // enqueueRepo takes a Repo resource and converts it into a namespace/name
@@ -305,14 +929,11 @@ func (c *Controller) enqueueRepo(obj interface{}) {
 		return
 	}
 
-	if _, found := c.repoPollers[key]; !found {
-		klog.Infof("Starting repo poller for '%s'...", key)
-		repo := obj.(*repov1alpha1.Repo)
-		repoCopy := repo.DeepCopy()
-		repoPoller := poller.NewRepoPoller(key, repoCopy, c.repoStatusManager, poller.GitRemoteDelegator{})
-		repoPoller.Start()
-		c.repoPollers[key] = repoPoller
+	if !c.shards.Owns(key) {
+		c.stopRepoPoller(key)
+		return
 	}
+	c.startRepoPoller(key)
 
 	c.workqueue.Add(key)
 }
@@ -320,14 +941,67 @@ func (c *Controller) enqueueRepo(obj interface{}) {
 func (c *Controller) descheduleRepoPoller(obj interface{}) {
 	var key string
 	var err error
-	if key, err = cache.MetaNamespaceKeyFunc(obj); err != nil {
+	// deletions missed by the watch come as tombstones
+	if key, err = cache.DeletionHandlingMetaNamespaceKeyFunc(obj); err != nil {
 		utilruntime.HandleError(err)
 		return
 	}
-	if poller, found := c.repoPollers[key]; found {
-		klog.Infof("Descheduling repo poller for '%s'...", key)
-		poller.Stop()
-		delete(c.repoPollers, key)
+	c.stopRepoPoller(key)
+	c.throttler.Forget(key)
+}
+
+// Rebalance starts or stops pollers after the Repos handled by this replica change
+func (c *Controller) Rebalance() {
+	repos, err := c.reposLister.List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	for _, repo := range repos {
+		c.enqueueRepo(repo)
+	}
+	c.reconcilePollers()
+}
+
+// reconcilePollers stops the pollers of Repos that no longer exist or are
+// handled by another replica
+func (c *Controller) reconcilePollers() {
+	for _, key := range c.pollScheduler.Scheduled() {
+		namespace, name, err := cache.SplitMetaNamespaceKey(key)
+		if err != nil {
+			utilruntime.HandleError(err)
+			continue
+		}
+		_, err = c.reposLister.Repos(namespace).Get(name)
+		if errors.IsNotFound(err) || (err == nil && !c.shards.Owns(key)) {
+			c.stopRepoPoller(key)
+			c.throttler.Forget(key)
+		} else if err != nil {
+			utilruntime.HandleError(err)
+		}
+	}
+}
+
+func (c *Controller) startRepoPoller(key string) {
+	repoPoller := poller.NewRepoPoller(key, c.reposLister, c.repoStatusManager, c.sourceCache, c.commitVerifier, c.recorder)
+	if c.pollScheduler.Schedule(repoPoller) {
+		klog.Infof("Started repo poller for '%s'", key)
+	}
+}
+
+func (c *Controller) pollRepoNow(repo *repov1alpha1.Repo) {
+	key := repo.Namespace + "/" + repo.Name
+	if c.shards.Owns(key) {
+		c.pollScheduler.PollNow(key)
+	}
+}
+
+func (c *Controller) stopRepoPoller(key string) {
+	if c.pollScheduler.Unschedule(key) {
+		klog.Infof("Descheduled repo poller for '%s'", key)
+		if namespace, name, err := cache.SplitMetaNamespaceKey(key); err == nil {
+			metrics.ForgetRepo(namespace, name)
+		}
 	}
 }
 
@@ -366,6 +1040,9 @@ func (c *Controller) handleJob(obj interface{}) {
 			klog.V(4).Infof("ignoring orphaned object '%s' of repo '%s'", object.GetSelfLink(), ownerRef.Name)
 			return
 		}
+		if !c.shards.Owns(object.GetNamespace() + "/" + ownerRef.Name) {
+			return
+		}
 
 		// update repo status based on Job status
 		job := obj.(*batchv1.Job)
@@ -382,7 +1059,7 @@ func (c *Controller) handleJob(obj interface{}) {
 func newJob(repo *repov1alpha1.Repo) *batchv1.Job {
 	labels := map[string]string{
 		"app":        repo.Name,
-		"controller": "repos.terraform.gitops.k8s.io",
+		"controller": jobControllerLabel,
 	}
 	return &batchv1.Job{
 		ObjectMeta: metav1.ObjectMeta{
@@ -391,7 +1068,8 @@ func newJob(repo *repov1alpha1.Repo) *batchv1.Job {
 			OwnerReferences: []metav1.OwnerReference{
 				*metav1.NewControllerRef(repo, repov1alpha1.SchemeGroupVersion.WithKind("Repo")),
 			},
-			Labels: labels,
+			Labels:      labels,
+			Annotations: newJobAnnotations(repo),
 		},
 		Spec: batchv1.JobSpec{
 			Template: corev1.PodTemplateSpec{
@@ -401,10 +1079,12 @@ func newJob(repo *repov1alpha1.Repo) *batchv1.Job {
 				Spec: corev1.PodSpec{
 					Containers: []corev1.Container{
 						{
-							Name:            "terraform-run",
+							Name:            runnerContainerName,
 							Image:           "terraform-runner:latest",
 							ImagePullPolicy: corev1.PullNever,
-							Env: []corev1.EnvVar{
+							// runners that crash leave the tail of their logs instead
+							TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+							Env: append([]corev1.EnvVar{
 								corev1.EnvVar{
 									Name:  "REPO_NAME",
 									Value: repo.Name,
@@ -421,7 +1101,7 @@ func newJob(repo *repov1alpha1.Repo) *batchv1.Job {
 									Name:  "TF_IN_AUTOMATION",
 									Value: "true",
 								},
-							},
+							}, append(newPolicyEnv(repo), newOutputsEnv(repo)...)...),
 						},
 					},
 					RestartPolicy: corev1.RestartPolicyNever,
@@ -430,3 +1110,81 @@ func newJob(repo *repov1alpha1.Repo) *batchv1.Job {
 		},
 	}
 }
+
+// newPolicyEnv passes the plan policy of a Repo to its runner, along with
+// the plan approved for the revision. A revision is only approved once its
+// plan was held and the approver saw it.
+func newPolicyEnv(repo *repov1alpha1.Repo) []corev1.EnvVar {
+	if repo.Spec.Policy == nil {
+		return nil
+	}
+	// plain structs always marshal
+	planPolicy, _ := json.Marshal(repo.Spec.Policy)
+	var approvedPlan []byte
+	if repo.Annotations[repov1alpha1.ApprovedGitSHAAnnotation] == repo.Status.GitSHA && repo.Status.ApprovedPlan != nil {
+		approvedPlan, _ = json.Marshal(repo.Status.ApprovedPlan)
+	}
+	return []corev1.EnvVar{
+		{Name: policy.Env, Value: string(planPolicy)},
+		{Name: policy.ApprovedEnv, Value: string(approvedPlan)},
+	}
+}
+
+// newOutputsEnv tells the runner where to stage the outputs of the apply.
+// The staging Secret is owned by the runner pod.
+func newOutputsEnv(repo *repov1alpha1.Repo) []corev1.EnvVar {
+	if repo.Spec.Outputs == nil {
+		return nil
+	}
+	return append([]corev1.EnvVar{
+		{Name: "OUTPUTS_SECRET", Value: outputs.StagingSecretName(repo.Status.RunJobName)},
+	}, newPodEnv()...)
+}
+
+// newPodEnv tells the runner the pod it runs in, to own the Secrets it stages
+func newPodEnv() []corev1.EnvVar {
+	return []corev1.EnvVar{
+		{Name: "POD_NAME", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}}},
+		{Name: "POD_NAMESPACE", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"}}},
+		{Name: "POD_UID", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.uid"}}},
+	}
+}
+
+// newPlanJob creates the Job planning the head of a pull request. The code
+// of a pull request is not trusted until merged: it is neither given the
+// cache shared by the runs of the namespace nor the plan policy and the
+// outputs of the Repo, as its plan is never applied. It runs as its own
+// service account rather than the one of the runs applying the Repo, so that
+// it gets none of their credentials.
+func newPlanJob(repo *repov1alpha1.Repo, run repov1alpha1.PullRequestRun, serviceAccount string) *batchv1.Job {
+	head := repo.DeepCopy()
+	head.Spec.Policy = nil
+	head.Spec.Outputs = nil
+	head.Status.RunJobName = run.RunJobName
+	head.Status.GitSHA = run.GitSHA
+	head.Status.Commit = nil
+	job := newJob(head)
+	job.Annotations[PullRequestAnnotation] = strconv.Itoa(int(run.Number))
+	job.Spec.Template.Spec.ServiceAccountName = serviceAccount
+	container := &job.Spec.Template.Spec.Containers[0]
+	container.Env = append(append(container.Env,
+		corev1.EnvVar{Name: "GIT_REF", Value: run.Ref},
+		corev1.EnvVar{Name: "PLAN_ONLY", Value: "true"},
+		corev1.EnvVar{Name: "PLAN_SECRET", Value: prcomment.StagingSecretName(run.RunJobName)},
+	), newPodEnv()...)
+	return job
+}
+
+// newJobAnnotations describes the commit a Job applies
+func newJobAnnotations(repo *repov1alpha1.Repo) map[string]string {
+	annotations := map[string]string{
+		CommitSHAAnnotation: repo.Status.GitSHA,
+	}
+	if commit := repo.Status.Commit; commit != nil {
+		annotations[CommitAuthorAnnotation] = commit.Author
+		annotations[CommitCommitterAnnotation] = commit.Committer
+		annotations[CommitSubjectAnnotation] = commit.Subject
+		annotations[CommitTimestampAnnotation] = commit.Timestamp.UTC().Format(time.RFC3339)
+	}
+	return annotations
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
@@ -20,6 +25,14 @@ import (
 	repov1alpha1 "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
 	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/generated/clientset/versioned/fake"
 	informers "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/generated/informers/externalversions"
+	health "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/health"
+	multinamespace "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/multinamespace"
+	outputs "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/outputs"
+	prcomment "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/prcomment"
+	runnercache "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/runnercache"
+	runresult "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/runresult"
+	scheduler "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/scheduler"
+	sharding "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/sharding"
 )
 
 var (
@@ -36,12 +49,25 @@ type fixture struct {
 	// Objects to put in the store.
 	reposLister []*repov1alpha1.Repo
 	jobsLister  []*batchv1.Job
+	podsLister  []*corev1.Pod
 	// Actions expected to happen on the client.
 	kubeactions []core.Action
 	actions     []core.Action
 	// Objects from here preloaded into NewSimpleFake.
 	kubeobjects []runtime.Object
 	objects     []runtime.Object
+	// Repos handled by the controller replica under test
+	shards sharding.Filter
+	// Limits on the runs in progress
+	limits scheduler.Limits
+	// Cache shared by the runners
+	runnerCache runnercache.Cache
+	// Notifications of the progress of runs
+	notifications []repov1alpha1.NotificationEvent
+}
+
+func (f *fixture) Notify(repo *repov1alpha1.Repo, event repov1alpha1.NotificationEvent) {
+	f.notifications = append(f.notifications, event)
 }
 
 func newFixture(t *testing.T) *fixture {
@@ -49,6 +75,7 @@ func newFixture(t *testing.T) *fixture {
 	f.t = t
 	f.objects = []runtime.Object{}
 	f.kubeobjects = []runtime.Object{}
+	f.shards = sharding.Unsharded{}
 	return f
 }
 
@@ -69,15 +96,22 @@ func (f *fixture) newController() (*Controller, informers.SharedInformerFactory,
 	f.batchclient = k8sfake.NewSimpleClientset(f.kubeobjects...)
 	f.kubeclient = k8sfake.NewSimpleClientset(f.kubeobjects...)
 	f.repoclient = fake.NewSimpleClientset(f.objects...)
-	repoStatusManager := status.NewRepoStatusManager(f.repoclient)
+	repoStatusManager := status.NewRepoStatusManager(f.repoclient).WithNotifier(f)
 	kubeInformerFactory := kubeinformers.NewSharedInformerFactory(f.kubeclient, noResyncPeriodFunc())
 	repoInformerFactory := informers.NewSharedInformerFactory(f.repoclient, noResyncPeriodFunc())
 
 	c := NewController(f.batchclient.BatchV1(), f.kubeclient, repoStatusManager,
-		kubeInformerFactory.Batch().V1().Jobs(), repoInformerFactory.Repo().V1alpha1().Repos())
+		[]multinamespace.Informers{{
+			Namespace: multinamespace.AllNamespaces,
+			Jobs:      kubeInformerFactory.Batch().V1().Jobs(),
+			Repos:     repoInformerFactory.Repo().V1alpha1().Repos(),
+			Pods:      kubeInformerFactory.Core().V1().Pods(),
+		}},
+		health.NewMonitor(), f.shards, f.limits, f.runnerCache, "terraform-planner")
 
 	c.reposSynced = alwaysReady
 	c.jobsSynced = alwaysReady
+	c.podsSynced = alwaysReady
 	c.recorder = &record.FakeRecorder{}
 
 	for _, f := range f.reposLister {
@@ -88,6 +122,10 @@ func (f *fixture) newController() (*Controller, informers.SharedInformerFactory,
 		kubeInformerFactory.Batch().V1().Jobs().Informer().GetIndexer().Add(d)
 	}
 
+	for _, p := range f.podsLister {
+		kubeInformerFactory.Core().V1().Pods().Informer().GetIndexer().Add(p)
+	}
+
 	return c, repoInformerFactory, kubeInformerFactory
 }
 
@@ -249,7 +287,28 @@ func TestCreatesJob(t *testing.T) {
 
 	expJob := newJob(repo)
 	f.expectCreateJobAction(expJob)
-	f.expectUpdateRepoStatusAction(repo)
+	pending := repo.DeepCopy()
+	pending.Status.RunStatus = "Pending"
+	f.expectUpdateRepoStatusAction(pending)
+
+	f.run(getKey(repo, t))
+}
+
+func TestMountsRunnerCache(t *testing.T) {
+	f := newFixture(t)
+	f.runnerCache = runnercache.Cache{ClaimName: "terraform-cache"}
+	repo := newRepo("test-repo")
+	repo.Status.RunStatus = "New"
+
+	f.reposLister = append(f.reposLister, repo)
+	f.objects = append(f.objects, repo)
+
+	expJob := newJob(repo)
+	f.runnerCache.Mount(expJob, repo)
+	f.expectCreateJobAction(expJob)
+	pending := repo.DeepCopy()
+	pending.Status.RunStatus = "Pending"
+	f.expectUpdateRepoStatusAction(pending)
 
 	f.run(getKey(repo, t))
 }
@@ -281,4 +340,837 @@ func TestNotControlledByResource(t *testing.T) {
 	f.runExpectError(getKey(repo, t))
 }
 
+type ownsNothing struct{}
+
+func (ownsNothing) Owns(key string) bool {
+	return false
+}
+
+func TestDoNothingWhenRepoIsHandledByAnotherReplica(t *testing.T) {
+	f := newFixture(t)
+	f.shards = ownsNothing{}
+	repo := newRepo("test-repo")
+	repo.Status.RunStatus = "New"
+
+	f.reposLister = append(f.reposLister, repo)
+	f.objects = append(f.objects, repo)
+
+	f.run(getKey(repo, t))
+}
+
+func newRunningJob(repo *repov1alpha1.Repo) *batchv1.Job {
+	job := newJob(repo)
+	job.Status.Active = 1
+	return job
+}
+
+func TestQueuesRunWhenTooManyRunsInProgress(t *testing.T) {
+	f := newFixture(t)
+	f.limits = scheduler.Limits{MaxConcurrentRuns: 1}
+	running := newRepo("running-repo")
+	running.Status.RunJobName = "terraform-run-0d3c8a1"
+	repo := newRepo("test-repo")
+	repo.Status.RunJobName = "terraform-run-f7b8777"
+	repo.Status.RunStatus = "New"
+
+	f.reposLister = append(f.reposLister, repo)
+	f.objects = append(f.objects, repo)
+	f.jobsLister = append(f.jobsLister, newRunningJob(running))
+
+	queued := repo.DeepCopy()
+	queued.Status.RunStatus = "Queued"
+	f.expectUpdateRepoStatusAction(queued)
+
+	f.run(getKey(repo, t))
+}
+
+// owns the Repos of the given keys only
+type ownsKeys map[string]bool
+
+func (keys ownsKeys) Owns(key string) bool {
+	return keys[key]
+}
+
+func TestCountsRunsOfOtherReplicasAgainstLimits(t *testing.T) {
+	f := newFixture(t)
+	f.limits = scheduler.Limits{MaxConcurrentRuns: 1}
+	f.shards = ownsKeys{"default/test-repo": true}
+	// runs in the shard of another replica
+	running := newRepo("running-repo")
+	running.Status.RunJobName = "terraform-run-0d3c8a1"
+	repo := newRepo("test-repo")
+	repo.Status.RunJobName = "terraform-run-f7b8777"
+	repo.Status.RunStatus = "New"
+
+	f.reposLister = append(f.reposLister, repo)
+	f.objects = append(f.objects, repo)
+	f.jobsLister = append(f.jobsLister, newRunningJob(running))
+
+	queued := repo.DeepCopy()
+	queued.Status.RunStatus = "Queued"
+	f.expectUpdateRepoStatusAction(queued)
+
+	f.run(getKey(repo, t))
+}
+
+func TestStartsQueuedRunOnceRunsFinish(t *testing.T) {
+	f := newFixture(t)
+	f.limits = scheduler.Limits{MaxConcurrentRuns: 1}
+	done := newRepo("finished-repo")
+	done.Status.RunJobName = "terraform-run-0d3c8a1"
+	finished := newRunningJob(done)
+	finished.Status.Active = 0
+	finished.Status.Succeeded = 1
+	finished.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+	repo := newRepo("test-repo")
+	repo.Status.RunJobName = "terraform-run-f7b8777"
+	repo.Status.RunStatus = "Queued"
+
+	f.reposLister = append(f.reposLister, repo)
+	f.objects = append(f.objects, repo)
+	f.jobsLister = append(f.jobsLister, finished)
+
+	f.expectCreateJobAction(newJob(repo))
+	pending := repo.DeepCopy()
+	pending.Status.RunStatus = "Pending"
+	f.expectUpdateRepoStatusAction(pending)
+
+	f.run(getKey(repo, t))
+}
+
+func TestStopsPollersOfDeletedRepos(t *testing.T) {
+	f := newFixture(t)
+	repo := newRepo("test-repo")
+	f.reposLister = append(f.reposLister, repo)
+	f.objects = append(f.objects, repo)
+
+	c, _, _ := f.newController()
+	c.startRepoPoller(getKey(repo, t))
+	c.startRepoPoller("default/deleted-repo")
+	c.reconcilePollers()
+
+	if scheduled := c.pollScheduler.Scheduled(); !reflect.DeepEqual(scheduled, []string{"default/test-repo"}) {
+		t.Errorf("got pollers %v; want [default/test-repo]", scheduled)
+	}
+}
+
+func newFailedJob(repo *repov1alpha1.Repo) *batchv1.Job {
+	job := newJob(repo)
+	job.Status.Failed = 1
+	job.Status.Conditions = []batchv1.JobCondition{{
+		Type:    batchv1.JobFailed,
+		Status:  corev1.ConditionTrue,
+		Reason:  "BackoffLimitExceeded",
+		Message: "Job has reached the specified backoff limit",
+	}}
+	return job
+}
+
+func newCompletedJob(repo *repov1alpha1.Repo) *batchv1.Job {
+	job := newJob(repo)
+	job.Status.Succeeded = 1
+	job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+	return job
+}
+
+func newRunnerPod(job *batchv1.Job, exitCode int32, message string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      job.Name + "-x7k2p",
+			Namespace: job.Namespace,
+			Labels:    map[string]string{"job-name": job.Name, "controller": jobControllerLabel},
+		},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{{
+				Name: runnerContainerName,
+				State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{
+					ExitCode: exitCode,
+					Message:  message,
+				}},
+			}},
+		},
+	}
+}
+
+// lastRepoWrite returns the last Repo written by the controller
+func (f *fixture) lastRepoWrite() *repov1alpha1.Repo {
+	var repo *repov1alpha1.Repo
+	for _, action := range f.repoclient.Actions() {
+		if write, ok := action.(core.CreateAction); ok {
+			repo = write.GetObject().(*repov1alpha1.Repo)
+		}
+	}
+	return repo
+}
+
+func TestRecordsRunResult(t *testing.T) {
+	f := newFixture(t)
+	repo := newRepo("test-repo")
+	repo.Status.GitSHA = "f7b877701fbf855b44c0a9e86f3fdce2c298b07f"
+	repo.Status.RunJobName = "terraform-run-f7b8777"
+	repo.Status.RunStatus = "Running"
+	job := newCompletedJob(repo)
+	message, _ := runresult.Result{
+		GitSHA:           "f7b877701fbf855b44c0a9e86f3fdce2c298b07f",
+		TerraformVersion: "0.12.20",
+		Stages: []runresult.Stage{
+			{Name: "clone", DurationMillis: 1500},
+			{Name: "apply", DurationMillis: 42000},
+		},
+		Resources: &runresult.Resources{Add: 3, Change: 1},
+	}.Message()
+	f.reposLister = append(f.reposLister, repo)
+	f.objects = append(f.objects, repo)
+	f.jobsLister = append(f.jobsLister, job)
+	f.podsLister = append(f.podsLister, newRunnerPod(job, 0, message))
+
+	c, _, _ := f.newController()
+	if err := c.updateRepoStatus(repo, job); err != nil {
+		t.Fatal(err)
+	}
+
+	completed := f.lastRepoWrite()
+	expected := &repov1alpha1.RunResult{
+		GitSHA:           "f7b877701fbf855b44c0a9e86f3fdce2c298b07f",
+		TerraformVersion: "0.12.20",
+		Stages: []repov1alpha1.RunStage{
+			{Name: "clone", Duration: metav1.Duration{Duration: 1500 * time.Millisecond}},
+			{Name: "apply", Duration: metav1.Duration{Duration: 42 * time.Second}},
+		},
+		Resources: &repov1alpha1.ResourceChanges{Add: 3, Change: 1},
+	}
+	if !reflect.DeepEqual(completed.Status.Result, expected) {
+		t.Errorf("got result %+v; want %+v", completed.Status.Result, expected)
+	}
+	if completed.Status.Failure != nil {
+		t.Errorf("got failure %+v; want none", completed.Status.Failure)
+	}
+	if completed.Status.AppliedGitSHA != repo.Status.GitSHA {
+		t.Errorf("got applied revision %q; want %s", completed.Status.AppliedGitSHA, repo.Status.GitSHA)
+	}
+}
+
+func TestNotifiesRunTransitions(t *testing.T) {
+	f := newFixture(t)
+	repo := newRepo("test-repo")
+	repo.Status.RunJobName = "terraform-run-f7b8777"
+	repo.Status.RunStatus = "Pending"
+	job := newRunningJob(repo)
+	f.reposLister = append(f.reposLister, repo)
+	f.objects = append(f.objects, repo)
+
+	c, _, _ := f.newController()
+	if err := c.updateRepoStatus(repo, job); err != nil {
+		t.Fatal(err)
+	}
+	// no transition, no notification
+	if err := c.updateRepoStatus(f.lastRepoWrite(), job); err != nil {
+		t.Fatal(err)
+	}
+
+	job = newCompletedJob(repo)
+	message, _ := runresult.Result{
+		Stages: []runresult.Stage{{Name: "apply"}},
+		Plan:   &runresult.PlanSummary{Add: 1},
+	}.Message()
+	f.kubeobjects = append(f.kubeobjects, job)
+	f.podsLister = append(f.podsLister, newRunnerPod(job, 0, message))
+	running := f.lastRepoWrite()
+	c, _, _ = f.newController()
+	if err := c.updateRepoStatus(running, job); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []repov1alpha1.NotificationEvent{
+		repov1alpha1.RunStarted, repov1alpha1.PlanReady, repov1alpha1.RunSucceeded,
+	}
+	if !reflect.DeepEqual(f.notifications, expected) {
+		t.Errorf("got notifications %v; want %v", f.notifications, expected)
+	}
+}
+
+func TestRecordsPlanSummary(t *testing.T) {
+	f := newFixture(t)
+	repo := newRepo("test-repo")
+	repo.Status.RunJobName = "terraform-run-f7b8777"
+	repo.Status.RunStatus = "Running"
+	job := newCompletedJob(repo)
+	message, _ := runresult.Result{
+		Stages: []runresult.Stage{{Name: "plan"}, {Name: "show"}, {Name: "apply"}},
+		Plan: &runresult.PlanSummary{
+			Add:     3,
+			Change:  1,
+			Destroy: 1,
+			Replace: 1,
+			Changes: []runresult.PlanChange{
+				{Address: "aws_instance.web", Action: runresult.ActionReplace},
+				{Address: "aws_s3_bucket.logs", Action: runresult.ActionCreate},
+				{Address: "aws_s3_bucket.assets", Action: runresult.ActionCreate},
+				{Address: "aws_security_group.web", Action: runresult.ActionUpdate},
+			},
+		},
+	}.Message()
+	f.reposLister = append(f.reposLister, repo)
+	f.objects = append(f.objects, repo)
+	f.jobsLister = append(f.jobsLister, job)
+	f.kubeobjects = append(f.kubeobjects, job)
+	f.podsLister = append(f.podsLister, newRunnerPod(job, 0, message))
+
+	c, _, _ := f.newController()
+	recorder := record.NewFakeRecorder(10)
+	c.recorder = recorder
+	if err := c.updateRepoStatus(repo, job); err != nil {
+		t.Fatal(err)
+	}
+
+	plan := f.lastRepoWrite().Status.Result.Plan
+	if plan == nil || plan.Add != 3 || plan.Change != 1 || plan.Destroy != 1 || plan.Replace != 1 || len(plan.Changes) != 4 {
+		t.Errorf("got plan %+v", plan)
+	}
+	if event := <-recorder.Events; event != "Normal Planned Plan: 3 to add, 1 to change, 1 to destroy" {
+		t.Errorf("got event %q", event)
+	}
+
+	annotated, err := f.batchclient.BatchV1().Jobs(job.Namespace).Get(job.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		PlanAddAnnotation:     "3",
+		PlanChangeAnnotation:  "1",
+		PlanDestroyAnnotation: "1",
+		PlanReplaceAnnotation: "1",
+	}
+	for key, value := range expected {
+		if annotated.Annotations[key] != value {
+			t.Errorf("got annotation %s=%q; want %q", key, annotated.Annotations[key], value)
+		}
+	}
+	if annotated.Annotations[CommitSHAAnnotation] != job.Annotations[CommitSHAAnnotation] {
+		t.Error("expected the commit annotations to be kept")
+	}
+}
+
+func TestRecordsRunFailure(t *testing.T) {
+	f := newFixture(t)
+	repo := newRepo("test-repo")
+	repo.Status.RunJobName = "terraform-run-f7b8777"
+	repo.Status.RunStatus = "Running"
+	job := newFailedJob(repo)
+	message, _ := runresult.Result{
+		Stages: []runresult.Stage{
+			{Name: "clone", DurationMillis: 1500},
+			{Name: "apply", ExitCode: 1, DurationMillis: 3000},
+		},
+		Failure: &runresult.Failure{
+			Step:   "apply",
+			Reason: "Error: BucketAlreadyExists",
+			Output: "aws_s3_bucket.logs: Creating...\n\nError: BucketAlreadyExists\n",
+		},
+	}.Message()
+	f.reposLister = append(f.reposLister, repo)
+	f.objects = append(f.objects, repo)
+	f.jobsLister = append(f.jobsLister, job)
+	f.podsLister = append(f.podsLister, newRunnerPod(job, 1, message))
+
+	c, _, _ := f.newController()
+	recorder := record.NewFakeRecorder(10)
+	c.recorder = recorder
+	if err := c.updateRepoStatus(repo, job); err != nil {
+		t.Fatal(err)
+	}
+
+	failed := f.lastRepoWrite()
+	if failed.Status.RunStatus != "Failed" {
+		t.Errorf("got run status %s; want Failed", failed.Status.RunStatus)
+	}
+	expected := &repov1alpha1.RunFailure{
+		Step:   "apply",
+		Reason: "Error: BucketAlreadyExists",
+		Output: "aws_s3_bucket.logs: Creating...\n\nError: BucketAlreadyExists\n",
+	}
+	if !reflect.DeepEqual(failed.Status.Failure, expected) {
+		t.Errorf("got failure %+v; want %+v", failed.Status.Failure, expected)
+	}
+	if stages := failed.Status.Result.Stages; len(stages) != 2 || stages[1].ExitCode != 1 {
+		t.Errorf("got stages %+v", stages)
+	}
+	if event := <-recorder.Events; event != "Warning RunFailed Run terraform-run-f7b8777 failed at step apply: Error: BucketAlreadyExists" {
+		t.Errorf("got event %q", event)
+	}
+}
+
+func TestRecordsUnstructuredRunFailure(t *testing.T) {
+	f := newFixture(t)
+	repo := newRepo("test-repo")
+	repo.Status.RunJobName = "terraform-run-f7b8777"
+	repo.Status.RunStatus = "Running"
+	job := newFailedJob(repo)
+	f.reposLister = append(f.reposLister, repo)
+	f.objects = append(f.objects, repo)
+	f.jobsLister = append(f.jobsLister, job)
+	f.podsLister = append(f.podsLister, newRunnerPod(job, 2, "Starting terraform-runner...\npanic: runtime error\n"))
+
+	c, _, _ := f.newController()
+	if err := c.updateRepoStatus(repo, job); err != nil {
+		t.Fatal(err)
+	}
+
+	failed := f.lastRepoWrite()
+	if failed.Status.Result != nil {
+		t.Errorf("got result %+v; want none", failed.Status.Result)
+	}
+	if failure := failed.Status.Failure; failure == nil || failure.Reason != "panic: runtime error" {
+		t.Errorf("got failure %+v", failure)
+	}
+}
+
+func TestRecordsJobFailureWithoutRunnerPod(t *testing.T) {
+	f := newFixture(t)
+	repo := newRepo("test-repo")
+	repo.Status.RunJobName = "terraform-run-f7b8777"
+	repo.Status.RunStatus = "Running"
+	job := newFailedJob(repo)
+	f.reposLister = append(f.reposLister, repo)
+	f.objects = append(f.objects, repo)
+	f.jobsLister = append(f.jobsLister, job)
+
+	c, _, _ := f.newController()
+	if err := c.updateRepoStatus(repo, job); err != nil {
+		t.Fatal(err)
+	}
+
+	failure := f.lastRepoWrite().Status.Failure
+	if failure == nil || failure.Reason != "BackoffLimitExceeded: Job has reached the specified backoff limit" {
+		t.Errorf("got failure %+v", failure)
+	}
+}
+
+func TestHoldsPlanForApproval(t *testing.T) {
+	f := newFixture(t)
+	repo := newRepo("test-repo")
+	repo.Spec.Policy = &repov1alpha1.PlanPolicy{RequireApprovalOnDestroy: true}
+	repo.Status.GitSHA = "f7b877701fbf855b44c0a9e86f3fdce2c298b07f"
+	repo.Status.RunJobName = "terraform-run-f7b877701fbf855b44c0a9e86f3fdce2c298b07f"
+	repo.Status.RunStatus = "Running"
+	job := newCompletedJob(repo)
+	message, _ := runresult.Result{
+		Stages: []runresult.Stage{{Name: "plan"}, {Name: "show"}, {Name: "policy"}},
+		Plan:   &runresult.PlanSummary{Destroy: 1},
+		Policy: &runresult.PolicyOutcome{
+			Decision:   string(repov1alpha1.PolicyApprovalRequired),
+			Violations: []string{"destroys 1 resources"},
+		},
+	}.Message()
+	f.reposLister = append(f.reposLister, repo)
+	f.objects = append(f.objects, repo)
+	f.jobsLister = append(f.jobsLister, job)
+	f.kubeobjects = append(f.kubeobjects, job)
+	f.podsLister = append(f.podsLister, newRunnerPod(job, 0, message))
+
+	c, _, _ := f.newController()
+	recorder := record.NewFakeRecorder(10)
+	c.recorder = recorder
+	if err := c.updateRepoStatus(repo, job); err != nil {
+		t.Fatal(err)
+	}
+
+	held := f.lastRepoWrite()
+	if held.Status.RunStatus != "AwaitingApproval" {
+		t.Errorf("got run status %s; want AwaitingApproval", held.Status.RunStatus)
+	}
+	if held.Status.Failure != nil {
+		t.Errorf("got failure %+v; want none", held.Status.Failure)
+	}
+	if held.Status.AppliedGitSHA != "" {
+		t.Errorf("got applied revision %s; want none until approved", held.Status.AppliedGitSHA)
+	}
+	<-recorder.Events
+	expected := "Normal AwaitingApproval Run terraform-run-f7b877701fbf855b44c0a9e86f3fdce2c298b07f is awaiting approval, " +
+		"the plan destroys 1 resources. Set the terraform.gitops.k8s.io/approved-sha annotation to " +
+		"f7b877701fbf855b44c0a9e86f3fdce2c298b07f to apply it"
+	if event := <-recorder.Events; event != expected {
+		t.Errorf("got event %q", event)
+	}
+
+	// later updates of the Job leave the run awaiting approval
+	if err := c.updateRepoStatus(held, job); err != nil {
+		t.Fatal(err)
+	}
+	if runStatus := f.lastRepoWrite().Status.RunStatus; runStatus != "AwaitingApproval" {
+		t.Errorf("got run status %s; want AwaitingApproval", runStatus)
+	}
+}
+
+func TestFailsRunDeniedByPolicy(t *testing.T) {
+	f := newFixture(t)
+	repo := newRepo("test-repo")
+	repo.Spec.Policy = &repov1alpha1.PlanPolicy{DenyDestroyTypes: []string{"aws_db_instance"}}
+	repo.Status.RunJobName = "terraform-run-f7b8777"
+	repo.Status.RunStatus = "Running"
+	job := newCompletedJob(repo)
+	message, _ := runresult.Result{
+		Stages: []runresult.Stage{{Name: "plan"}, {Name: "show"}, {Name: "policy"}},
+		Plan:   &runresult.PlanSummary{Add: 1, Destroy: 1, Replace: 1},
+		Policy: &runresult.PolicyOutcome{
+			Decision:   string(repov1alpha1.PolicyDenied),
+			Violations: []string{"destroys [aws_db_instance.main], whose types must not be destroyed"},
+		},
+		Failure: &runresult.Failure{
+			Step:   "policy",
+			Reason: "Plan denied by policy: destroys [aws_db_instance.main], whose types must not be destroyed",
+		},
+	}.Message()
+	f.reposLister = append(f.reposLister, repo)
+	f.objects = append(f.objects, repo)
+	f.jobsLister = append(f.jobsLister, job)
+	f.kubeobjects = append(f.kubeobjects, job)
+	f.podsLister = append(f.podsLister, newRunnerPod(job, 0, message))
+
+	c, _, _ := f.newController()
+	if err := c.updateRepoStatus(repo, job); err != nil {
+		t.Fatal(err)
+	}
+
+	denied := f.lastRepoWrite()
+	if denied.Status.RunStatus != "Failed" {
+		t.Errorf("got run status %s; want Failed", denied.Status.RunStatus)
+	}
+	if failure := denied.Status.Failure; failure == nil || failure.Step != "policy" {
+		t.Errorf("got failure %+v", failure)
+	}
+	if policy := denied.Status.Result.Policy; policy == nil || policy.Decision != repov1alpha1.PolicyDenied {
+		t.Errorf("got policy outcome %+v", policy)
+	}
+}
+
+func TestFailsPolicyRunWithoutDecision(t *testing.T) {
+	f := newFixture(t)
+	repo := newRepo("test-repo")
+	repo.Spec.Policy = &repov1alpha1.PlanPolicy{DenyDestroyTypes: []string{"aws_db_instance"}}
+	repo.Status.RunJobName = "terraform-run-f7b8777"
+	repo.Status.RunStatus = "Running"
+	job := newCompletedJob(repo)
+	// a termination message cut by the kubelet is no longer JSON
+	message := `{"stages":[{"name":"plan"},{"name":"show"},{"name":"policy"}],"policy":{"decision":"Den`
+	f.reposLister = append(f.reposLister, repo)
+	f.objects = append(f.objects, repo)
+	f.jobsLister = append(f.jobsLister, job)
+	f.kubeobjects = append(f.kubeobjects, job)
+	f.podsLister = append(f.podsLister, newRunnerPod(job, 0, message))
+
+	c, _, _ := f.newController()
+	if err := c.updateRepoStatus(repo, job); err != nil {
+		t.Fatal(err)
+	}
+
+	failed := f.lastRepoWrite()
+	if failed.Status.RunStatus != "Failed" {
+		t.Errorf("got run status %s; want Failed", failed.Status.RunStatus)
+	}
+	if failure := failed.Status.Failure; failure == nil || failure.Step != "policy" {
+		t.Errorf("got failure %+v", failure)
+	}
+}
+
+func TestStartsApprovedRun(t *testing.T) {
+	f := newFixture(t)
+	repo := newRepo("test-repo")
+	repo.Annotations = map[string]string{repov1alpha1.ApprovedGitSHAAnnotation: "f7b877701fbf855b44c0a9e86f3fdce2c298b07f"}
+	repo.Spec.Policy = &repov1alpha1.PlanPolicy{RequireApprovalOnDestroy: true}
+	repo.Status.GitSHA = "f7b877701fbf855b44c0a9e86f3fdce2c298b07f"
+	repo.Status.RunJobName = "terraform-run-f7b877701fbf855b44c0a9e86f3fdce2c298b07f"
+	repo.Status.RunStatus = "AwaitingApproval"
+	repo.Status.Result = &repov1alpha1.RunResult{Plan: &repov1alpha1.PlanSummary{
+		Destroy: 1,
+		Changes: []repov1alpha1.PlanChange{{Address: "aws_eip.legacy", Action: "delete"}},
+	}}
+	f.reposLister = append(f.reposLister, repo)
+	f.objects = append(f.objects, repo)
+
+	c, _, _ := f.newController()
+	if err := c.syncHandler(getKey(repo, t)); err != nil {
+		t.Fatal(err)
+	}
+
+	approved := f.lastRepoWrite()
+	if approved.Status.RunJobName != "terraform-run-f7b877701fbf855b44c0a9e86f3fdce2c298b07f-approved" ||
+		approved.Status.RunStatus != "New" {
+		t.Errorf("got run %s with status %s", approved.Status.RunJobName, approved.Status.RunStatus)
+	}
+
+	env := map[string]string{}
+	for _, variable := range newJob(approved).Spec.Template.Spec.Containers[0].Env {
+		env[variable.Name] = variable.Value
+	}
+	expected := `{"add":0,"change":0,"destroy":1,"replace":0,"changes":[{"address":"aws_eip.legacy","action":"delete"}]}`
+	if env["PLAN_POLICY"] != `{"requireApprovalOnDestroy":true}` || env["PLAN_APPROVED"] != expected {
+		t.Errorf("got policy %q, approved plan %q", env["PLAN_POLICY"], env["PLAN_APPROVED"])
+	}
+}
+
+func TestDoesNotApproveRevisionBeforeItsPlanIsHeld(t *testing.T) {
+	repo := newRepo("test-repo")
+	repo.Annotations = map[string]string{repov1alpha1.ApprovedGitSHAAnnotation: "f7b877701fbf855b44c0a9e86f3fdce2c298b07f"}
+	repo.Spec.Policy = &repov1alpha1.PlanPolicy{RequireApprovalOnDestroy: true}
+	repo.Status.GitSHA = "f7b877701fbf855b44c0a9e86f3fdce2c298b07f"
+	repo.Status.RunJobName = "terraform-run-f7b877701fbf855b44c0a9e86f3fdce2c298b07f"
+
+	for _, variable := range newJob(repo).Spec.Template.Spec.Containers[0].Env {
+		if variable.Name == "PLAN_APPROVED" && variable.Value != "" {
+			t.Errorf("got approved plan %q; want none", variable.Value)
+		}
+	}
+}
+
+func TestPublishesOutputsOfSuccessfulRun(t *testing.T) {
+	f := newFixture(t)
+	repo := newRepo("test-repo")
+	repo.Spec.Outputs = &repov1alpha1.OutputsSpec{ConfigMapName: "test-repo-outputs", SecretName: "test-repo-secrets"}
+	repo.Status.RunJobName = "terraform-run-f7b8777"
+	repo.Status.RunStatus = "Running"
+	job := newCompletedJob(repo)
+	message, _ := runresult.Result{Stages: []runresult.Stage{{Name: "apply"}, {Name: "output"}}}.Message()
+	staging := outputs.NewStagingSecret(outputs.StagingSecretName(job.Name), job.Namespace,
+		metav1.OwnerReference{APIVersion: "v1", Kind: "Pod", Name: job.Name + "-x7k2p"},
+		[]byte(`{"db_endpoint": {"sensitive": false, "value": "db.internal:5432"}, "db_password": {"sensitive": true, "value": "hunter2"}}`))
+	f.reposLister = append(f.reposLister, repo)
+	f.objects = append(f.objects, repo)
+	f.jobsLister = append(f.jobsLister, job)
+	f.kubeobjects = append(f.kubeobjects, staging)
+	f.podsLister = append(f.podsLister, newRunnerPod(job, 0, message))
+
+	c, _, _ := f.newController()
+	recorder := record.NewFakeRecorder(10)
+	c.recorder = recorder
+	if err := c.updateRepoStatus(repo, job); err != nil {
+		t.Fatal(err)
+	}
+	completed := f.lastRepoWrite()
+	if !c.repoStatusManager.HasPendingOutputs(completed) {
+		t.Fatalf("got conditions %+v; want the outputs pending", completed.Status.Conditions)
+	}
+
+	// the status update brings the Repo back to publish the outputs
+	f.reposLister[0] = completed
+	c, _, _ = f.newController()
+	c.recorder = recorder
+	if err := c.syncHandler(getKey(repo, t)); err != nil {
+		t.Fatal(err)
+	}
+
+	configMap, err := f.kubeclient.CoreV1().ConfigMaps(repo.Namespace).Get("test-repo-outputs", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configMap.Data["db_endpoint"] != "db.internal:5432" {
+		t.Errorf("got ConfigMap data %v", configMap.Data)
+	}
+	if event := <-recorder.Events; event != "Normal OutputsPublished Published 1 outputs and 1 sensitive outputs of run terraform-run-f7b8777" {
+		t.Errorf("got event %q", event)
+	}
+	if c.repoStatusManager.HasPendingOutputs(f.lastRepoWrite()) {
+		t.Error("expected the outputs to be recorded as published")
+	}
+}
+
+func TestRetriesPublishingOutputs(t *testing.T) {
+	f := newFixture(t)
+	repo := newRepo("test-repo")
+	repo.Spec.Outputs = &repov1alpha1.OutputsSpec{ConfigMapName: "test-repo-outputs"}
+	repo.Status.RunJobName = "terraform-run-f7b8777"
+	repo.Status.RunStatus = "Completed"
+	repo.Status.Conditions = []repov1alpha1.RepoCondition{{Type: repov1alpha1.OutputsPending, Status: corev1.ConditionTrue}}
+	f.reposLister = append(f.reposLister, repo)
+	f.objects = append(f.objects, repo)
+
+	c, _, _ := f.newController()
+	c.recorder = record.NewFakeRecorder(10)
+	if err := c.syncHandler(getKey(repo, t)); err == nil {
+		t.Error("expected the outputs that could not be published to be synced again")
+	}
+}
+
+func TestTellsRunnerWhereToStageOutputs(t *testing.T) {
+	repo := newRepo("test-repo")
+	repo.Spec.Outputs = &repov1alpha1.OutputsSpec{ConfigMapName: "test-repo-outputs"}
+	repo.Status.RunJobName = "terraform-run-f7b8777"
+
+	env := map[string]corev1.EnvVar{}
+	for _, variable := range newJob(repo).Spec.Template.Spec.Containers[0].Env {
+		env[variable.Name] = variable
+	}
+	if env["OUTPUTS_SECRET"].Value != "terraform-run-f7b8777-outputs" {
+		t.Errorf("got staging Secret %q", env["OUTPUTS_SECRET"].Value)
+	}
+	if uid := env["POD_UID"].ValueFrom; uid == nil || uid.FieldRef.FieldPath != "metadata.uid" {
+		t.Error("expected the runner to be given its pod UID to own the staging Secret")
+	}
+}
+
+func TestJobDescribesCommit(t *testing.T) {
+	repo := newRepo("test-repo")
+	repo.Status.GitSHA = "f7b877701fbf855b44c0a9e86f3fdce2c298b07f"
+	repo.Status.Commit = &repov1alpha1.CommitInfo{
+		Author:    "Jane <jane@example.com>",
+		Committer: "GitHub <noreply@github.com>",
+		Subject:   "Add bucket",
+		Timestamp: metav1.NewTime(time.Date(2019, 10, 19, 8, 30, 0, 0, time.UTC)),
+	}
+
+	annotations := newJob(repo).Annotations
+	expected := map[string]string{
+		CommitSHAAnnotation:       "f7b877701fbf855b44c0a9e86f3fdce2c298b07f",
+		CommitAuthorAnnotation:    "Jane <jane@example.com>",
+		CommitCommitterAnnotation: "GitHub <noreply@github.com>",
+		CommitSubjectAnnotation:   "Add bucket",
+		CommitTimestampAnnotation: "2019-10-19T08:30:00Z",
+	}
+	if !reflect.DeepEqual(annotations, expected) {
+		t.Errorf("got = %v; want %v", annotations, expected)
+	}
+}
+
 func int32Ptr(i int32) *int32 { return &i }
+
+func newPullRequestRepo(apiURL string) *repov1alpha1.Repo {
+	repo := newRepo("test-repo")
+	repo.Spec.CommitStatus = &repov1alpha1.CommitStatusSpec{Provider: repov1alpha1.GitHubProvider, APIURL: apiURL}
+	repo.Spec.PullRequests = &repov1alpha1.PullRequestsSpec{TokenSecretRef: corev1.SecretKeySelector{
+		LocalObjectReference: corev1.LocalObjectReference{Name: "github"},
+		Key:                  "token",
+	}}
+	repo.Status.PullRequests = []repov1alpha1.PullRequestRun{{
+		Number:     42,
+		Ref:        "refs/pull/42/head",
+		GitSHA:     "0a1b2c3d4e5f67890a1b2c3d4e5f67890a1b2c3d",
+		RunJobName: "terraform-plan-0a1b2c3d4e5f67890a1b2c3d4e5f67890a1b2c3d-0208984",
+		RunStatus:  "New",
+	}}
+	return repo
+}
+
+func TestPlansHeadOfPullRequest(t *testing.T) {
+	f := newFixture(t)
+	f.runnerCache = runnercache.Cache{ClaimName: "terraform-cache"}
+	repo := newPullRequestRepo("")
+	repo.Spec.Policy = &repov1alpha1.PlanPolicy{MaxChanges: 10}
+	f.reposLister = append(f.reposLister, repo)
+	f.objects = append(f.objects, repo)
+
+	c, _, _ := f.newController()
+	if err := c.syncHandler(getKey(repo, t)); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := f.batchclient.BatchV1().Jobs(repo.Namespace).Get(repo.Status.PullRequests[0].RunJobName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{}
+	for _, variable := range job.Spec.Template.Spec.Containers[0].Env {
+		env[variable.Name] = variable.Value
+	}
+	if env["GIT_REF"] != "refs/pull/42/head" || env["GIT_SHA"] != "0a1b2c3d4e5f67890a1b2c3d4e5f67890a1b2c3d" ||
+		env["PLAN_ONLY"] != "true" || env["PLAN_SECRET"] != job.Name+"-plan" {
+		t.Errorf("got env %v", env)
+	}
+	if _, found := env["PLAN_POLICY"]; found {
+		t.Error("got the plan policy passed to a plan run")
+	}
+	if len(job.Spec.Template.Spec.Volumes) != 0 {
+		t.Errorf("got volumes %+v; want no cache shared with pull requests", job.Spec.Template.Spec.Volumes)
+	}
+	if account := job.Spec.Template.Spec.ServiceAccountName; account != "terraform-planner" {
+		t.Errorf("got service account %q; want the plan service account", account)
+	}
+	if runs := f.lastRepoWrite().Status.PullRequests; len(runs) != 1 || runs[0].RunStatus != "Pending" {
+		t.Errorf("got pull request runs %+v", runs)
+	}
+}
+
+func TestQueuesPlanOfPullRequestWhenTooManyRunsInProgress(t *testing.T) {
+	f := newFixture(t)
+	f.limits = scheduler.Limits{MaxConcurrentRuns: 1}
+	running := newRepo("running-repo")
+	running.Status.RunJobName = "terraform-run-0d3c8a1"
+	repo := newPullRequestRepo("")
+	f.reposLister = append(f.reposLister, repo)
+	f.objects = append(f.objects, repo)
+	f.jobsLister = append(f.jobsLister, newRunningJob(running))
+
+	c, _, _ := f.newController()
+	if err := c.syncHandler(getKey(repo, t)); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, _ := f.batchclient.BatchV1().Jobs(repo.Namespace).List(metav1.ListOptions{})
+	if len(jobs.Items) != 0 {
+		t.Errorf("got Jobs %+v; want the plan held back", jobs.Items)
+	}
+	if runs := f.lastRepoWrite().Status.PullRequests; len(runs) != 1 || runs[0].RunStatus != "Queued" {
+		t.Errorf("got pull request runs %+v", runs)
+	}
+}
+
+func TestCommentsPlanOfPullRequest(t *testing.T) {
+	var requests []string
+	var comment string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if r.Method == http.MethodGet {
+			w.Write([]byte("[]"))
+			return
+		}
+		var body struct {
+			Body string `json:"body"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		comment = body.Body
+	}))
+	defer server.Close()
+
+	f := newFixture(t)
+	repo := newPullRequestRepo(server.URL)
+	job := newCompletedJob(repo)
+	job.Name = repo.Status.PullRequests[0].RunJobName
+	message, _ := runresult.Result{
+		Stages: []runresult.Stage{{Name: "plan"}, {Name: "show"}, {Name: "render"}},
+		Plan:   &runresult.PlanSummary{Add: 1},
+	}.Message()
+	staging := prcomment.NewStagingSecret(prcomment.StagingSecretName(job.Name), job.Namespace,
+		metav1.OwnerReference{APIVersion: "v1", Kind: "Pod", Name: job.Name + "-x7k2p"},
+		[]byte("+ resource \"aws_s3_bucket\" \"logs\" {\n"))
+	token := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "github", Namespace: repo.Namespace},
+		Data:       map[string][]byte{"token": []byte("s3cr3t")},
+	}
+	f.reposLister = append(f.reposLister, repo)
+	f.objects = append(f.objects, repo)
+	f.jobsLister = append(f.jobsLister, job)
+	f.kubeobjects = append(f.kubeobjects, staging, token)
+	f.podsLister = append(f.podsLister, newRunnerPod(job, 0, message))
+
+	c, _, _ := f.newController()
+	if err := c.syncHandler(getKey(repo, t)); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"GET /repos/davidmontoyago/some-repo/issues/42/comments", "POST /repos/davidmontoyago/some-repo/issues/42/comments"}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("got requests %v; want %v", requests, expected)
+	}
+	if !strings.Contains(comment, "**Plan: 1 to add, 0 to change, 0 to destroy.**") || !strings.Contains(comment, "aws_s3_bucket") {
+		t.Errorf("got comment %q", comment)
+	}
+	run := f.lastRepoWrite().Status.PullRequests[0]
+	if run.RunStatus != "Completed" || !run.Commented || run.Plan == nil || run.Plan.Add != 1 {
+		t.Errorf("got pull request run %+v", run)
+	}
+	if repo := f.lastRepoWrite(); repo.Status.RunJobName != "" {
+		t.Errorf("got run %s; want the plan kept out of the run of the Repo", repo.Status.RunJobName)
+	}
+	if expected := []repov1alpha1.NotificationEvent{repov1alpha1.PullRequestPlanned}; !reflect.DeepEqual(f.notifications, expected) {
+		t.Errorf("got notifications %v; want %v", f.notifications, expected)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog"
+)
+
+// leaderElectionConfig holds the settings of the Lease used to elect the
+// replica that runs pollers and workers
+type leaderElectionConfig struct {
+	enabled       bool
+	namespace     string
+	name          string
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+}
+
+// runWithLeaderElection blocks until this replica acquires the Lease, then
+// calls run. Replicas that lose the Lease exit so that a fresh process can
+// stand by again without leftover pollers.
+func runWithLeaderElection(config leaderElectionConfig, kubeClient kubernetes.Interface, stopCh <-chan struct{}, run func()) {
+	identity, err := os.Hostname()
+	if err != nil {
+		klog.Fatalf("Error getting hostname: %s", err.Error())
+	}
+	identity = identity + "_" + string(uuid.NewUUID())
+
+	lock, err := resourcelock.New(resourcelock.LeasesResourceLock,
+		config.namespace,
+		config.name,
+		kubeClient.CoreV1(),
+		kubeClient.CoordinationV1(),
+		resourcelock.ResourceLockConfig{Identity: identity})
+	if err != nil {
+		klog.Fatalf("Error creating leader election lock: %s", err.Error())
+	}
+
+	// the Lease is released once the controller has drained, so that the
+	// next leader does not start while Repos are still being synced
+	leading := make(chan struct{})
+	drained := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopCh
+		select {
+		case <-leading:
+			<-drained
+		default:
+		}
+		cancel()
+	}()
+
+	klog.Infof("Waiting to acquire lease %s/%s as %s", config.namespace, config.name, identity)
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   config.leaseDuration,
+		RenewDeadline:   config.renewDeadline,
+		RetryPeriod:     config.retryPeriod,
+		ReleaseOnCancel: true,
+		Name:            config.name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				klog.Infof("Acquired lease %s/%s, starting controller", config.namespace, config.name)
+				close(leading)
+				defer close(drained)
+				run()
+			},
+			OnStoppedLeading: func() {
+				select {
+				case <-stopCh:
+					klog.Info("Released leadership on shutdown")
+				default:
+					klog.Fatalf("Lost lease %s/%s, exiting", config.namespace, config.name)
+				}
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					klog.Infof("Standing by, current leader is %s", leader)
+				}
+			},
+		},
+	})
+}
+
+// podNamespace is the namespace the controller runs in, when deployed in-cluster
+func podNamespace() string {
+	if namespace := os.Getenv("POD_NAMESPACE"); namespace != "" {
+		return namespace
+	}
+	return "default"
+}
@@ -2,8 +2,14 @@ package main
 
 import (
 	"flag"
+	"net/http"
+	"strings"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	batchclientset "k8s.io/client-go/kubernetes/typed/batch/v1"
@@ -14,14 +20,37 @@ import (
 	// _ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 
 	status "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/status"
+	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/commitstatus"
 	clientset "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/generated/clientset/versioned"
 	informers "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/generated/informers/externalversions"
+	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/health"
+	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/multinamespace"
+	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/notify"
+	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/runnercache"
+	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/scheduler"
+	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/sharding"
 	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/signals"
 )
 
 var (
-	masterURL  string
-	kubeconfig string
+	masterURL   string
+	kubeconfig  string
+	metricsAddr string
+	healthAddr  string
+
+	namespaces   string
+	repoSelector string
+
+	leaderElection leaderElectionConfig
+	shards         shardingConfig
+
+	runLimits           scheduler.Limits
+	runnerCache         runnercache.Cache
+	planServiceAccount  string
+	pollWorkers         int
+	notificationWorkers int
+	commitStatusWorkers int
+	shutdownTimeout     time.Duration
 )
 
 func main() {
@@ -51,29 +80,166 @@ func main() {
 		klog.Fatalf("Error building example clientset: %s", err.Error())
 	}
 
-	kubeInformerFactory := kubeinformers.NewSharedInformerFactory(kubeClient, time.Second*30)
-	repoInformerFactory := informers.NewSharedInformerFactory(repoClient, time.Second*30)
+	if _, err := labels.Parse(repoSelector); err != nil {
+		klog.Fatalf("Error parsing Repo selector: %s", err.Error())
+	}
+
+	if err := runnerCache.Validate(); err != nil {
+		klog.Fatalf("Error configuring plugin cache: %s", err.Error())
+	}
+
+	// one pair of informer factories per watched namespace, so that the
+	// controller only needs access to those namespaces
+	var kubeInformerFactories []kubeinformers.SharedInformerFactory
+	var repoInformerFactories []informers.SharedInformerFactory
+	var namespaceInformers []multinamespace.Informers
+	for _, namespace := range watchedNamespaces() {
+		kubeInformerFactory := kubeinformers.NewSharedInformerFactoryWithOptions(kubeClient, time.Second*30,
+			kubeinformers.WithNamespace(namespace))
+		repoInformerFactory := informers.NewSharedInformerFactoryWithOptions(repoClient, time.Second*30,
+			informers.WithNamespace(namespace),
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.LabelSelector = repoSelector
+			}))
+		// only the pods of the runners are watched
+		podInformerFactory := kubeinformers.NewSharedInformerFactoryWithOptions(kubeClient, time.Second*30,
+			kubeinformers.WithNamespace(namespace),
+			kubeinformers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.LabelSelector = labels.Set{"controller": jobControllerLabel}.String()
+			}))
+		kubeInformerFactories = append(kubeInformerFactories, kubeInformerFactory, podInformerFactory)
+		repoInformerFactories = append(repoInformerFactories, repoInformerFactory)
+		namespaceInformers = append(namespaceInformers, multinamespace.Informers{
+			Namespace: namespace,
+			Jobs:      kubeInformerFactory.Batch().V1().Jobs(),
+			Repos:     repoInformerFactory.Repo().V1alpha1().Repos(),
+			Pods:      podInformerFactory.Core().V1().Pods(),
+		})
+	}
 
-	repoStatusManager := status.NewRepoStatusManager(repoClient)
+	notifier := notify.NewDispatcher(kubeClient)
+	commitStatusReporter := commitstatus.NewReporter(kubeClient)
+	repoStatusManager := status.NewRepoStatusManager(repoClient).
+		WithNotifier(notifier).
+		WithNotifier(commitStatusReporter)
+	monitor := health.NewMonitor()
+
+	var sharder *sharding.Sharder
+	var shardFilter sharding.Filter = sharding.Unsharded{}
+	if shards.enabled {
+		sharder = newSharder(shards, kubeClient)
+		shardFilter = sharder
+	}
 
 	controller := NewController(
 		batchClient,
 		kubeClient,
 		repoStatusManager,
-		kubeInformerFactory.Batch().V1().Jobs(),
-		repoInformerFactory.Repo().V1alpha1().Repos())
+		namespaceInformers,
+		monitor,
+		shardFilter,
+		runLimits,
+		runnerCache,
+		planServiceAccount)
+
+	go serveMetrics(metricsAddr)
+	go serveHealthProbes(healthAddr, monitor)
+
+	run := func() {
+		// notice that there is no need to run Start methods in a separate goroutine. (i.e. go kubeInformerFactory.Start(stopCh)
+		// Start method is non-blocking and runs all registered informers in a dedicated goroutine.
+		for _, kubeInformerFactory := range kubeInformerFactories {
+			kubeInformerFactory.Start(stopCh)
+		}
+		for _, repoInformerFactory := range repoInformerFactories {
+			repoInformerFactory.Start(stopCh)
+		}
+
+		go notifier.Run(notificationWorkers, stopCh)
+		go commitStatusReporter.Run(commitStatusWorkers, stopCh)
+
+		if err := controller.Run(2, pollWorkers, shutdownTimeout, stopCh); err != nil {
+			klog.Fatalf("Error running controller: %s", err.Error())
+		}
+	}
+
+	// sharded replicas are all active, each one on its own Repos
+	if sharder != nil {
+		sharder.OnChange(controller.Rebalance)
+		if err := sharder.Start(stopCh); err != nil {
+			klog.Fatalf("Error joining shard group: %s", err.Error())
+		}
+		run()
+		return
+	}
 
-	// notice that there is no need to run Start methods in a separate goroutine. (i.e. go kubeInformerFactory.Start(stopCh)
-	// Start method is non-blocking and runs all registered informers in a dedicated goroutine.
-	kubeInformerFactory.Start(stopCh)
-	repoInformerFactory.Start(stopCh)
+	if !leaderElection.enabled {
+		run()
+		return
+	}
+	// standby replicas are ready to take over
+	monitor.SetReady(true)
+	runWithLeaderElection(leaderElection, kubeClient, stopCh, run)
+}
+
+// watchedNamespaces splits the --namespaces flag, defaulting to all namespaces
+func watchedNamespaces() []string {
+	var watched []string
+	for _, namespace := range strings.Split(namespaces, ",") {
+		if namespace = strings.TrimSpace(namespace); namespace != "" {
+			watched = append(watched, namespace)
+		}
+	}
+	if len(watched) == 0 {
+		return []string{multinamespace.AllNamespaces}
+	}
+	return watched
+}
+
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	klog.Infof("Serving metrics on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		klog.Fatalf("Error serving metrics: %s", err.Error())
+	}
+}
 
-	if err = controller.Run(2, stopCh); err != nil {
-		klog.Fatalf("Error running controller: %s", err.Error())
+func serveHealthProbes(addr string, monitor *health.Monitor) {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", monitor.LivenessHandler())
+	mux.Handle("/readyz", monitor.ReadinessHandler())
+	klog.Infof("Serving health probes on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		klog.Fatalf("Error serving health probes: %s", err.Error())
 	}
 }
 
 func init() {
 	flag.StringVar(&kubeconfig, "kubeconfig", "", "Path to a kubeconfig. Only required if out-of-cluster.")
 	flag.StringVar(&masterURL, "master", "", "The address of the Kubernetes API server. Overrides any value in kubeconfig. Only required if out-of-cluster.")
+	flag.StringVar(&namespaces, "namespaces", "", "Comma separated list of the namespaces to watch. Defaults to all namespaces.")
+	flag.StringVar(&repoSelector, "selector", "", "Label selector of the Repos to handle, e.g. tenant=payments. Defaults to all Repos.")
+	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the Prometheus metrics endpoint binds to.")
+	flag.StringVar(&healthAddr, "health-addr", ":8081", "The address the /healthz and /readyz probes bind to.")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 20*time.Second, "How long to wait on shutdown for the Repos being synced or checked for new revisions.")
+	flag.IntVar(&pollWorkers, "poll-workers", 5, "The number of Repos checked for new revisions at once.")
+	flag.IntVar(&notificationWorkers, "notification-workers", 2, "The number of run notifications delivered at once.")
+	flag.IntVar(&commitStatusWorkers, "commit-status-workers", 2, "The number of commit statuses set on git hosts at once.")
+	flag.IntVar(&runLimits.MaxConcurrentRuns, "max-concurrent-runs", 0, "The maximum number of Terraform Jobs running at once. New runs are queued until running Jobs finish. Defaults to no limit.")
+	flag.IntVar(&runLimits.MaxConcurrentRunsPerNamespace, "max-concurrent-runs-per-namespace", 0, "The maximum number of Terraform Jobs running at once in a namespace. Defaults to no limit.")
+	flag.StringVar(&runnerCache.ClaimName, "plugin-cache-claim", "", "A PersistentVolumeClaim mounted in runner Jobs to cache provider plugins between runs. The claim is expected in every namespace Repos run in.")
+	flag.StringVar(&runnerCache.HostPath, "plugin-cache-host-path", "", "A directory of the nodes mounted in runner Jobs to cache provider plugins between runs, instead of a PersistentVolumeClaim.")
+	flag.StringVar(&planServiceAccount, "plan-service-account", "terraform-planner", "The service account the plan Jobs of pull requests run as. It is expected in every namespace Repos plan pull requests in, without the credentials of the runs applying Repos.")
+	flag.BoolVar(&leaderElection.enabled, "leader-elect", false, "Elect a leader among controller replicas. Only the leader polls repos and runs workers.")
+	flag.StringVar(&leaderElection.namespace, "leader-elect-namespace", podNamespace(), "The namespace of the leader election Lease. Defaults to the POD_NAMESPACE environment variable.")
+	flag.StringVar(&leaderElection.name, "leader-elect-name", "repo-pull-controller", "The name of the leader election Lease.")
+	flag.DurationVar(&leaderElection.leaseDuration, "leader-elect-lease-duration", 15*time.Second, "How long standby replicas wait before taking over a Lease that was not renewed.")
+	flag.DurationVar(&leaderElection.renewDeadline, "leader-elect-renew-deadline", 10*time.Second, "How long the leader keeps retrying to renew the Lease before giving it up.")
+	flag.DurationVar(&leaderElection.retryPeriod, "leader-elect-retry-period", 2*time.Second, "How long replicas wait between attempts to acquire or renew the Lease.")
+	flag.BoolVar(&shards.enabled, "sharding", false, "Split Repos between all controller replicas instead of electing a leader.")
+	flag.StringVar(&shards.namespace, "shard-namespace", podNamespace(), "The namespace of the Leases of the shard group members. Defaults to the POD_NAMESPACE environment variable.")
+	flag.StringVar(&shards.group, "shard-group", "repo-pull-controller", "The name of the shard group replicas join.")
+	flag.DurationVar(&shards.leaseDuration, "shard-lease-duration", 30*time.Second, "How long a replica that stopped renewing its Lease keeps its Repos.")
+	flag.DurationVar(&shards.renewPeriod, "shard-renew-period", 10*time.Second, "How often replicas renew their Lease and check for members joining or leaving.")
 }
@@ -0,0 +1,48 @@
+package status
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	repov1alpha1 "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
+)
+
+// GetCondition returns the condition with the given type, or nil if the
+// Repo does not have it.
+func GetCondition(status repov1alpha1.RepoStatus, conditionType repov1alpha1.RepoConditionType) *repov1alpha1.RepoCondition {
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == conditionType {
+			return &status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// setCondition adds or replaces the condition of the same type. The
+// transition time is only moved when the condition status changes.
+func setCondition(status *repov1alpha1.RepoStatus, conditionType repov1alpha1.RepoConditionType, conditionStatus corev1.ConditionStatus, reason, message string) {
+	newCondition := repov1alpha1.RepoCondition{
+		Type:               conditionType,
+		Status:             conditionStatus,
+		LastTransitionTime: metav1.Now(),
+		Reason:             reason,
+		Message:            message,
+	}
+	if current := GetCondition(*status, conditionType); current != nil {
+		if current.Status == conditionStatus {
+			newCondition.LastTransitionTime = current.LastTransitionTime
+		}
+		*current = newCondition
+		return
+	}
+	status.Conditions = append(status.Conditions, newCondition)
+}
+
+// clearCondition sets an existing condition to False. Conditions the Repo
+// never had are not added.
+func clearCondition(status *repov1alpha1.RepoStatus, conditionType repov1alpha1.RepoConditionType, reason, message string) {
+	if GetCondition(*status, conditionType) == nil {
+		return
+	}
+	setCondition(status, conditionType, corev1.ConditionFalse, reason, message)
+}
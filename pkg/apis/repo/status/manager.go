@@ -2,13 +2,17 @@ package status
 
 import (
 	"fmt"
+	"hash/fnv"
 
 	"github.com/pkg/errors"
 	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
 	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
-	repo "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
+	repov1alpha1 "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
 	clientset "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/generated/clientset/versioned"
+	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/policy"
 )
 
 // Allows changing a Repo resource state.
@@ -16,6 +20,12 @@ import (
 // Hence the DeepCopy() before every operation.
 type RepoStatusManager struct {
 	repoclientset clientset.Interface
+	notifiers     []Notifier
+}
+
+// Notifier is told about the progress of the runs of Repos, once recorded
+type Notifier interface {
+	Notify(repo *repov1alpha1.Repo, event repov1alpha1.NotificationEvent)
 }
 
 func NewRepoStatusManager(repoclientset clientset.Interface) RepoStatusManager {
@@ -24,7 +34,57 @@ func NewRepoStatusManager(repoclientset clientset.Interface) RepoStatusManager {
 	}
 }
 
-func (statusManager RepoStatusManager) update(repo *repo.Repo) error {
+// WithNotifier returns a manager also notifying the progress of runs to notifier
+func (statusManager RepoStatusManager) WithNotifier(notifier Notifier) RepoStatusManager {
+	notifiers := make([]Notifier, 0, len(statusManager.notifiers)+1)
+	statusManager.notifiers = append(append(notifiers, statusManager.notifiers...), notifier)
+	return statusManager
+}
+
+func (statusManager RepoStatusManager) notify(repo *repov1alpha1.Repo, events ...repov1alpha1.NotificationEvent) {
+	for _, notifier := range statusManager.notifiers {
+		for _, event := range events {
+			notifier.Notify(repo, event)
+		}
+	}
+}
+
+// updateRun records a new run status, then notifies the transition
+func (statusManager RepoStatusManager) updateRun(repo *repov1alpha1.Repo, previousStatus string) error {
+	if repo.Status.RunStatus == "Completed" {
+		repo.Status.AppliedGitSHA = repo.Status.GitSHA
+		if repo.Spec.Outputs != nil && previousStatus != "Completed" {
+			setCondition(&repo.Status, repov1alpha1.OutputsPending, corev1.ConditionTrue, "Staged",
+				fmt.Sprintf("Outputs of run %s are waiting to be published", repo.Status.RunJobName))
+		}
+	}
+	if err := statusManager.update(repo); err != nil {
+		return err
+	}
+	if repo.Status.RunStatus == previousStatus {
+		return nil
+	}
+	var events []repov1alpha1.NotificationEvent
+	if result := repo.Status.Result; result != nil && result.Plan != nil {
+		events = append(events, repov1alpha1.PlanReady)
+	}
+	switch repo.Status.RunStatus {
+	case "Running":
+		events = []repov1alpha1.NotificationEvent{repov1alpha1.RunStarted}
+	case "Completed":
+		events = append(events, repov1alpha1.RunSucceeded)
+	case "Failed":
+		events = append(events, repov1alpha1.RunFailed)
+	case "AwaitingApproval":
+		events = append(events, repov1alpha1.AwaitingApproval)
+	default:
+		return nil
+	}
+	statusManager.notify(repo, events...)
+	return nil
+}
+
+func (statusManager RepoStatusManager) update(repo *repov1alpha1.Repo) error {
 	// If the CustomResourceSubresources feature gate is not enabled,
 	// we must use Update instead of UpdateStatus to update the Status block of the Repo resource.
 	// UpdateStatus will not allow changes to the Spec of the resource,
@@ -47,24 +107,245 @@ func (statusManager RepoStatusManager) update(repo *repo.Repo) error {
 }
 
 // Set desired state as new job run
-func (statusManager RepoStatusManager) SetNewJobRun(repo *repo.Repo, newGitSha string) error {
+func (statusManager RepoStatusManager) SetNewJobRun(repo *repov1alpha1.Repo, newGitSha string, commit *repov1alpha1.CommitInfo) error {
 	repo.Status.RunJobName = fmt.Sprintf("terraform-run-%s", newGitSha)
 	repo.Status.GitSHA = newGitSha
+	repo.Status.Commit = commit
+	detectedTime := metav1.Now()
+	repo.Status.RevisionDetectedTime = &detectedTime
+	repo.Status.ObservedGitSHA = newGitSha
+	repo.Status.RunStatus = "New"
+	repo.Status.Result = nil
+	repo.Status.Failure = nil
+	repo.Status.ApprovedPlan = nil
+	clearCondition(&repo.Status, repov1alpha1.VerificationFailed, "Verified",
+		fmt.Sprintf("Revision %s was scheduled to run", newGitSha))
+	clearCondition(&repo.Status, repov1alpha1.OutputsPending, "Replaced",
+		fmt.Sprintf("Revision %s was scheduled to run, its run publishes the outputs", newGitSha))
+	if err := statusManager.update(repo); err != nil {
+		return err
+	}
+	statusManager.notify(repo, repov1alpha1.RevisionDetected)
+	return nil
+}
+
+// Record a revision that was seen but does not need to run
+func (statusManager RepoStatusManager) SetObservedRevision(repo *repov1alpha1.Repo, gitSha string) error {
+	repo.Status.ObservedGitSHA = gitSha
+	return statusManager.update(repo)
+}
+
+// Record a revision that was not run because its commit message asked to skip it
+func (statusManager RepoStatusManager) SetSkippedRevision(repo *repov1alpha1.Repo, gitSha string) error {
+	repo.Status.ObservedGitSHA = gitSha
+	repo.Status.SkippedGitSHA = gitSha
+	return statusManager.update(repo)
+}
+
+// Record a revision that was refused because its signature could not be verified.
+// The last scheduled run is left untouched.
+func (statusManager RepoStatusManager) SetVerificationFailed(repo *repov1alpha1.Repo, gitSha string, message string) error {
+	repo.Status.ObservedGitSHA = gitSha
+	setCondition(&repo.Status, repov1alpha1.VerificationFailed, corev1.ConditionTrue, "UntrustedCommit",
+		fmt.Sprintf("Revision %s was not run: %s", gitSha, message))
+	return statusManager.update(repo)
+}
+
+// Record the status of the Job of a run
+func (statusManager RepoStatusManager) SetJobRunStatus(repo *repov1alpha1.Repo, job *batchv1.Job) error {
+	previousStatus := repo.Status.RunStatus
+	repo.Status.RunStatus = determineRunStatus(job, repo.Status.Result)
+	return statusManager.updateRun(repo, previousStatus)
+}
+
+// Record the status of the Job of a finished run, along with the result
+// reported by the runner and the failure of a failed run
+func (statusManager RepoStatusManager) SetRunFinished(repo *repov1alpha1.Repo, job *batchv1.Job,
+	result *repov1alpha1.RunResult, failure *repov1alpha1.RunFailure) error {
+	previousStatus := repo.Status.RunStatus
+	repo.Status.RunStatus = determineRunStatus(job, result)
+	repo.Status.Result = result
+	if repo.Status.RunStatus == "Failed" {
+		repo.Status.Failure = failure
+	} else {
+		repo.Status.Failure = nil
+	}
+	return statusManager.updateRun(repo, previousStatus)
+}
+
+// Start a new run of a revision held for approval, once it is approved. The
+// plan held is kept for the new run to apply only the plan approved.
+func (statusManager RepoStatusManager) SetApprovedRun(repo *repov1alpha1.Repo) error {
+	if result := repo.Status.Result; result != nil {
+		repo.Status.ApprovedPlan = result.Plan
+	}
+	repo.Status.RunJobName = fmt.Sprintf("terraform-run-%s-approved", repo.Status.GitSHA)
 	repo.Status.RunStatus = "New"
+	repo.Status.Result = nil
+	repo.Status.Failure = nil
 	return statusManager.update(repo)
 }
 
-func (statusManager RepoStatusManager) SetJobRunStatus(repo *repo.Repo, job *batchv1.Job) error {
-	// TODO set last ran datetime & last run status/run output
-	repo.Status.RunStatus = determineRunStatus(job)
+// Record a run that has to wait for other runs to finish before its Job is created
+func (statusManager RepoStatusManager) SetQueued(repo *repov1alpha1.Repo) error {
+	repo.Status.RunStatus = "Queued"
 	return statusManager.update(repo)
 }
 
-func (statusManager RepoStatusManager) IsNewRepoRun(repo *repo.Repo) bool {
-	return repo.Status.RunStatus == "New"
+// Record the heads of the open pull requests. Heads not planned yet get a
+// new plan run, and the runs of closed pull requests are dropped.
+func (statusManager RepoStatusManager) SetPullRequestHeads(repo *repov1alpha1.Repo, heads []repov1alpha1.PullRequestRun) error {
+	planned := map[int32]repov1alpha1.PullRequestRun{}
+	for _, run := range repo.Status.PullRequests {
+		planned[run.Number] = run
+	}
+	var runs []repov1alpha1.PullRequestRun
+	for _, head := range heads {
+		if run, found := planned[head.Number]; found && run.GitSHA == head.GitSHA {
+			runs = append(runs, run)
+			continue
+		}
+		head.RunJobName = pullRequestJobName(repo, head.GitSHA)
+		head.RunStatus = "New"
+		head.Plan = nil
+		head.Failure = nil
+		head.Commented = false
+		runs = append(runs, head)
+	}
+	repo.Status.PullRequests = runs
+	return statusManager.update(repo)
+}
+
+// pullRequestJobName names the plan Job of a head after the Repo too, so that
+// Repos of the same source in a namespace plan their heads apart. The name is
+// hashed to keep it within the 63 characters of the job-name label.
+func pullRequestJobName(repo *repov1alpha1.Repo, gitSha string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(repo.Name))
+	return fmt.Sprintf("terraform-plan-%s-%07x", gitSha, hash.Sum32()&0xfffffff)
+}
+
+// Record the progress of the plan runs of pull requests, then notify the
+// transitions of the runs since the previous status
+func (statusManager RepoStatusManager) SetPullRequestRuns(repo *repov1alpha1.Repo, previous []repov1alpha1.PullRequestRun) error {
+	if err := statusManager.update(repo); err != nil {
+		return err
+	}
+	previousStatuses := map[string]string{}
+	for _, run := range previous {
+		previousStatuses[run.RunJobName] = run.RunStatus
+	}
+	for _, run := range repo.Status.PullRequests {
+		if run.RunStatus == previousStatuses[run.RunJobName] {
+			continue
+		}
+		switch run.RunStatus {
+		case "Running":
+			statusManager.notify(pullRequestView(repo, run), repov1alpha1.PullRequestPlanStarted)
+		case "Completed":
+			statusManager.notify(pullRequestView(repo, run), repov1alpha1.PullRequestPlanned)
+		case "Failed":
+			statusManager.notify(pullRequestView(repo, run), repov1alpha1.PullRequestPlanFailed)
+		}
+	}
+	return nil
+}
+
+// pullRequestView is the Repo as notifiers see the plan run of a pull
+// request: its status describes the run, and lists the pull request alone
+func pullRequestView(repo *repov1alpha1.Repo, run repov1alpha1.PullRequestRun) *repov1alpha1.Repo {
+	view := repo.DeepCopy()
+	view.Status = repov1alpha1.RepoStatus{
+		RunJobName:   run.RunJobName,
+		GitSHA:       run.GitSHA,
+		RunStatus:    run.RunStatus,
+		Result:       &repov1alpha1.RunResult{GitSHA: run.GitSHA, Plan: run.Plan},
+		Failure:      run.Failure,
+		PullRequests: []repov1alpha1.PullRequestRun{run},
+	}
+	return view
+}
+
+// A new run is waiting for its Job to be created
+func (statusManager RepoStatusManager) IsNewRepoRun(repo *repov1alpha1.Repo) bool {
+	return repo.Status.RunStatus == "New" || statusManager.IsQueued(repo)
+}
+
+func (statusManager RepoStatusManager) IsQueued(repo *repov1alpha1.Repo) bool {
+	return repo.Status.RunStatus == "Queued"
+}
+
+// A plan run of a pull request is waiting for other runs to finish
+func (statusManager RepoStatusManager) HasQueuedPullRequests(repo *repov1alpha1.Repo) bool {
+	for _, run := range repo.Status.PullRequests {
+		if run.RunStatus == "Queued" {
+			return true
+		}
+	}
+	return false
+}
+
+// The run is over, whether it was applied or not
+func (statusManager RepoStatusManager) IsRunFinished(repo *repov1alpha1.Repo) bool {
+	switch repo.Status.RunStatus {
+	case "Completed", "Failed", "AwaitingApproval":
+		return true
+	}
+	return false
+}
+
+// The outputs of the last completed run are yet to be published
+func (statusManager RepoStatusManager) HasPendingOutputs(repo *repov1alpha1.Repo) bool {
+	condition := GetCondition(repo.Status, repov1alpha1.OutputsPending)
+	return repo.Status.RunStatus == "Completed" && condition != nil && condition.Status == corev1.ConditionTrue
+}
+
+// Record the outputs of the last completed run as published
+func (statusManager RepoStatusManager) SetOutputsPublished(repo *repov1alpha1.Repo) error {
+	clearCondition(&repo.Status, repov1alpha1.OutputsPending, "Published",
+		fmt.Sprintf("Outputs of run %s were published", repo.Status.RunJobName))
+	return statusManager.update(repo)
+}
+
+// The revision held by the plan policy was approved
+func (statusManager RepoStatusManager) IsApproved(repo *repov1alpha1.Repo) bool {
+	return repo.Status.RunStatus == "AwaitingApproval" &&
+		repo.Annotations[repov1alpha1.ApprovedGitSHAAnnotation] == repo.Status.GitSHA
+}
+
+// Runners end without applying plans not allowed by the plan policy, so
+// their Job completes while the run failed or awaits approval
+func determineRunStatus(job *batchv1.Job, result *repov1alpha1.RunResult) string {
+	runStatus := DetermineRunStatus(job)
+	if runStatus != "Completed" {
+		return runStatus
+	}
+	if result == nil || result.Policy == nil {
+		// the runner completed without telling what the policy decided
+		if policy.Enforced(job) {
+			return "Failed"
+		}
+		return runStatus
+	}
+	switch result.Policy.Decision {
+	case repov1alpha1.PolicyDenied:
+		return "Failed"
+	case repov1alpha1.PolicyApprovalRequired:
+		return "AwaitingApproval"
+	}
+	return runStatus
+}
+
+// AppliedRevision is the revision of the last run of a Repo that completed
+func AppliedRevision(repo *repov1alpha1.Repo) string {
+	if repo.Status.AppliedGitSHA == "" && repo.Status.RunStatus == "Completed" {
+		// completed before the applied revision was recorded
+		return repo.Status.GitSHA
+	}
+	return repo.Status.AppliedGitSHA
 }
 
-func determineRunStatus(job *batchv1.Job) string {
+func DetermineRunStatus(job *batchv1.Job) string {
 	if job.Status.Active != 0 {
 		return "Running"
 	}
@@ -1,6 +1,7 @@
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -19,6 +20,177 @@ type Repo struct {
 // RepoSpec is the spec for a Repo resource
 type RepoSpec struct {
 	Url string `json:"url"`
+	// Verification restricts runs to commits signed by trusted keys
+	// +optional
+	Verification *VerificationSpec `json:"verification,omitempty"`
+	// IncludePaths are glob patterns of the files that trigger a run when
+	// changed. All files are included when empty.
+	// +optional
+	IncludePaths []string `json:"includePaths,omitempty"`
+	// IgnorePaths are glob patterns of the files whose changes never
+	// trigger a run, even if they match IncludePaths
+	// +optional
+	IgnorePaths []string `json:"ignorePaths,omitempty"`
+	// SkipMarkers are strings that, when found in a commit message, prevent
+	// the revision from running. Defaults to "[skip tf]".
+	// +optional
+	SkipMarkers []string `json:"skipMarkers,omitempty"`
+	// Priority orders the runs queued by concurrency limits. Runs of Repos
+	// with a higher priority start first. Defaults to 0.
+	// +optional
+	Priority int32 `json:"priority,omitempty"`
+	// Policy is evaluated against the plan of every run before it is applied
+	// +optional
+	Policy *PlanPolicy `json:"policy,omitempty"`
+	// Outputs publishes the Terraform outputs after every successful apply
+	// +optional
+	Outputs *OutputsSpec `json:"outputs,omitempty"`
+	// Notifications send the progress of the runs to external receivers
+	// +optional
+	Notifications []NotificationSpec `json:"notifications,omitempty"`
+	// CommitStatus reports the status of the runs on the commits of the git host
+	// +optional
+	CommitStatus *CommitStatusSpec `json:"commitStatus,omitempty"`
+	// PullRequests plans the heads of the open pull requests and comments
+	// the plans on them
+	// +optional
+	PullRequests *PullRequestsSpec `json:"pullRequests,omitempty"`
+}
+
+// PullRequestsSpec plans the head of every open pull request, without
+// applying it, and comments the plan on the pull request. Pull requests are
+// found through the refs/pull/<number>/head references of GitHub and the
+// refs/merge-requests/<number>/head references of GitLab.
+type PullRequestsSpec struct {
+	// TokenSecretRef selects the key of a Secret in the Repo namespace holding
+	// an API token allowed to comment pull requests. The git host is the one
+	// of commitStatus, or detected from the Repo url.
+	TokenSecretRef corev1.SecretKeySelector `json:"tokenSecretRef"`
+}
+
+// GitProvider is the API of a git host
+type GitProvider string
+
+const (
+	GitHubProvider    GitProvider = "GitHub"
+	GitLabProvider    GitProvider = "GitLab"
+	BitbucketProvider GitProvider = "Bitbucket"
+)
+
+// CommitStatusSpec sets a status on every commit run: pending while it runs
+// and success or failure once it finished
+type CommitStatusSpec struct {
+	// Provider is the API of the git host. Detected from the Repo url when
+	// hosted on github.com, bitbucket.org or a host named after GitLab.
+	// +optional
+	Provider GitProvider `json:"provider,omitempty"`
+	// APIURL is the API endpoint of a self-hosted git host, e.g.
+	// https://github.example.com/api/v3
+	// +optional
+	APIURL string `json:"apiURL,omitempty"`
+	// TokenSecretRef selects the key of a Secret in the Repo namespace holding
+	// an API token allowed to set commit statuses
+	TokenSecretRef corev1.SecretKeySelector `json:"tokenSecretRef"`
+	// Context names the status among the other checks of a commit.
+	// Defaults to terraform/<Repo name>.
+	// +optional
+	Context string `json:"context,omitempty"`
+	// TargetURL is linked from the status, e.g. a dashboard of the runs
+	// +optional
+	TargetURL string `json:"targetURL,omitempty"`
+}
+
+// NotificationType is the format of the notifications sent to a receiver
+type NotificationType string
+
+const (
+	// WebhookNotification posts the notification as JSON
+	WebhookNotification NotificationType = "Webhook"
+	// SlackNotification posts a Slack incoming webhook message
+	SlackNotification NotificationType = "Slack"
+	// CloudEventsNotification posts a CloudEvent in structured mode
+	CloudEventsNotification NotificationType = "CloudEvents"
+)
+
+// NotificationEvent is a step in the progress of the runs of a Repo
+type NotificationEvent string
+
+const (
+	RevisionDetected NotificationEvent = "RevisionDetected"
+	RunStarted       NotificationEvent = "RunStarted"
+	PlanReady        NotificationEvent = "PlanReady"
+	AwaitingApproval NotificationEvent = "AwaitingApproval"
+	RunSucceeded     NotificationEvent = "RunSucceeded"
+	RunFailed        NotificationEvent = "RunFailed"
+	// the plan runs of the heads of pull requests
+	PullRequestPlanStarted NotificationEvent = "PullRequestPlanStarted"
+	PullRequestPlanned     NotificationEvent = "PullRequestPlanned"
+	PullRequestPlanFailed  NotificationEvent = "PullRequestPlanFailed"
+)
+
+// NotificationSpec sends notifications to a receiver
+type NotificationSpec struct {
+	Type NotificationType `json:"type"`
+	// URLSecretRef selects the key of a Secret in the Repo namespace holding
+	// the URL notifications are posted to, as URLs often embed a token
+	URLSecretRef corev1.SecretKeySelector `json:"urlSecretRef"`
+	// Events are the events sent. All events are sent when empty.
+	// +optional
+	Events []NotificationEvent `json:"events,omitempty"`
+	// Retries is the number of times a failed delivery is retried. Defaults to 3.
+	// +optional
+	Retries *int32 `json:"retries,omitempty"`
+}
+
+// OutputsSpec names the objects the Terraform outputs are published to, in
+// the namespace of the Repo. Objects that are not named are not written.
+type OutputsSpec struct {
+	// ConfigMapName is the ConfigMap receiving the outputs not marked sensitive
+	// +optional
+	ConfigMapName string `json:"configMapName,omitempty"`
+	// SecretName is the Secret receiving the outputs marked sensitive
+	// +optional
+	SecretName string `json:"secretName,omitempty"`
+}
+
+// ApprovedGitSHAAnnotation approves a revision held by the plan policy of a
+// Repo when set to its SHA
+const ApprovedGitSHAAnnotation = "terraform.gitops.k8s.io/approved-sha"
+
+// PlanPolicy restricts the plans applied without review
+type PlanPolicy struct {
+	// DenyDestroyTypes are resource types that must never be destroyed or
+	// replaced, e.g. aws_db_instance. Plans destroying them are not applied.
+	// +optional
+	DenyDestroyTypes []string `json:"denyDestroyTypes,omitempty"`
+	// MaxChanges caps the number of resources a plan may add, change or
+	// destroy. Larger plans are not applied. Zero means no limit.
+	// +optional
+	MaxChanges int32 `json:"maxChanges,omitempty"`
+	// RequireApprovalOnDestroy holds plans destroying or replacing any
+	// resource until the revision is approved
+	// +optional
+	RequireApprovalOnDestroy bool `json:"requireApprovalOnDestroy,omitempty"`
+	// AutoApplyAdditiveOnly holds plans changing or destroying any resource
+	// until the revision is approved, so only additions are applied unattended
+	// +optional
+	AutoApplyAdditiveOnly bool `json:"autoApplyAdditiveOnly,omitempty"`
+}
+
+// VerificationSpec lists the public keys trusted to sign commits.
+// When set, unsigned commits or commits signed by any other key are not run.
+type VerificationSpec struct {
+	// GPGKeys are ASCII armored GPG public keys
+	// +optional
+	GPGKeys []string `json:"gpgKeys,omitempty"`
+	// SSHKeys are SSH public keys in authorized_keys format
+	// +optional
+	SSHKeys []string `json:"sshKeys,omitempty"`
+	// SecretRef is a Secret in the Repo namespace holding additional
+	// trusted keys. Every data entry is read as either an armored GPG
+	// public key or a list of SSH public keys.
+	// +optional
+	SecretRef *corev1.LocalObjectReference `json:"secretRef,omitempty"`
 }
 
 // RepoStatus is the status for a Repo resource
@@ -26,6 +198,172 @@ type RepoStatus struct {
 	RunJobName string `json:"runJobName"`
 	GitSHA     string `json:"gitSHA"`
 	RunStatus  string `json:"runStatus"`
+	// RevisionDetectedTime is when the revision being applied was found
+	// +optional
+	RevisionDetectedTime *metav1.Time `json:"revisionDetectedTime,omitempty"`
+	// Commit describes the revision being applied
+	// +optional
+	Commit *CommitInfo `json:"commit,omitempty"`
+	// ObservedGitSHA is the latest revision seen by the poller, whether
+	// or not a run was scheduled for it
+	// +optional
+	ObservedGitSHA string `json:"observedGitSHA,omitempty"`
+	// SkippedGitSHA is the latest revision not run because of a skip marker
+	// +optional
+	SkippedGitSHA string `json:"skippedGitSHA,omitempty"`
+	// AppliedGitSHA is the revision of the last run that completed
+	// +optional
+	AppliedGitSHA string `json:"appliedGitSHA,omitempty"`
+	// ApprovedPlan is the plan held for approval that was approved. The run
+	// of the approved revision only applies the same plan.
+	// +optional
+	ApprovedPlan *PlanSummary `json:"approvedPlan,omitempty"`
+	// Result describes the finished run, as reported by the runner
+	// +optional
+	Result *RunResult `json:"result,omitempty"`
+	// Failure describes why the run failed
+	// +optional
+	Failure *RunFailure `json:"failure,omitempty"`
+	// +optional
+	Conditions []RepoCondition `json:"conditions,omitempty"`
+	// PullRequests are the plan runs of the heads of the open pull requests
+	// +optional
+	PullRequests []PullRequestRun `json:"pullRequests,omitempty"`
+}
+
+// PullRequestRun is the plan run of the head of a pull request
+type PullRequestRun struct {
+	Number int32 `json:"number"`
+	// Ref is the git reference of the head, e.g. refs/pull/42/head
+	Ref        string `json:"ref"`
+	GitSHA     string `json:"gitSHA"`
+	RunJobName string `json:"runJobName"`
+	RunStatus  string `json:"runStatus"`
+	// Plan summarizes the changes the head would make
+	// +optional
+	Plan *PlanSummary `json:"plan,omitempty"`
+	// Failure describes why the plan failed
+	// +optional
+	Failure *RunFailure `json:"failure,omitempty"`
+	// Commented is true once the plan is commented on the pull request
+	// +optional
+	Commented bool `json:"commented,omitempty"`
+}
+
+// CommitInfo describes the commit of a revision
+type CommitInfo struct {
+	Author    string      `json:"author"`
+	Committer string      `json:"committer"`
+	Subject   string      `json:"subject"`
+	Timestamp metav1.Time `json:"timestamp"`
+}
+
+// RunResult describes a finished run, as reported by the runner
+type RunResult struct {
+	// GitSHA is the revision checked out by the runner
+	// +optional
+	GitSHA string `json:"gitSHA,omitempty"`
+	// TerraformVersion is the version of Terraform that ran, e.g. "0.12.20"
+	// +optional
+	TerraformVersion string `json:"terraformVersion,omitempty"`
+	// Stages are the runner stages run, in order
+	// +optional
+	Stages []RunStage `json:"stages,omitempty"`
+	// Plan summarizes the changes planned before the apply
+	// +optional
+	Plan *PlanSummary `json:"plan,omitempty"`
+	// Policy is the decision of the plan policy on the plan
+	// +optional
+	Policy *PolicyOutcome `json:"policy,omitempty"`
+	// Resources counts the resources changed by the apply
+	// +optional
+	Resources *ResourceChanges `json:"resources,omitempty"`
+}
+
+// PlanSummary counts the resource changes of a plan. As in the output of
+// terraform plan, replaced resources are counted as added and destroyed.
+type PlanSummary struct {
+	Add     int32 `json:"add"`
+	Change  int32 `json:"change"`
+	Destroy int32 `json:"destroy"`
+	Replace int32 `json:"replace"`
+	// Changes are the resources changed, left out of large plans
+	// +optional
+	Changes []PlanChange `json:"changes,omitempty"`
+}
+
+// PlanChange is the action planned for a resource: create, update,
+// delete or replace
+type PlanChange struct {
+	Address string `json:"address"`
+	Action  string `json:"action"`
+}
+
+// RunStage is a step of a run, such as "clone", "init" or "apply"
+type RunStage struct {
+	Name     string          `json:"name"`
+	ExitCode int32           `json:"exitCode"`
+	Duration metav1.Duration `json:"duration"`
+}
+
+// ResourceChanges counts the resources added, changed and destroyed by a run
+type ResourceChanges struct {
+	Add     int32 `json:"add"`
+	Change  int32 `json:"change"`
+	Destroy int32 `json:"destroy"`
+}
+
+// PolicyDecision is the decision of a plan policy on a plan
+type PolicyDecision string
+
+const (
+	// PolicyAllowed plans are applied
+	PolicyAllowed PolicyDecision = "Allowed"
+	// PolicyDenied plans are not applied, and the run fails
+	PolicyDenied PolicyDecision = "Denied"
+	// PolicyApprovalRequired plans are applied once the revision is approved
+	PolicyApprovalRequired PolicyDecision = "ApprovalRequired"
+)
+
+// PolicyOutcome describes the decision of the plan policy on the plan of a run
+type PolicyOutcome struct {
+	Decision PolicyDecision `json:"decision"`
+	// Violations are the rules the plan breaks
+	// +optional
+	Violations []string `json:"violations,omitempty"`
+}
+
+// RunFailure describes why a run failed, as reported by the runner
+type RunFailure struct {
+	// Step is the runner step that failed, e.g. "init" or "apply"
+	// +optional
+	Step string `json:"step,omitempty"`
+	// Reason is a concise description of the failure
+	Reason string `json:"reason"`
+	// Output is the tail of the output of the failing step
+	// +optional
+	Output string `json:"output,omitempty"`
+}
+
+// RepoConditionType is a valid value for RepoCondition.Type
+type RepoConditionType string
+
+const (
+	// VerificationFailed is True when the latest observed revision was
+	// refused because its signature could not be verified
+	VerificationFailed RepoConditionType = "VerificationFailed"
+	// OutputsPending is True while the outputs of the last completed run
+	// are yet to be published
+	OutputsPending RepoConditionType = "OutputsPending"
+)
+
+// RepoCondition describes the state of a Repo at a certain point
+type RepoCondition struct {
+	Type               RepoConditionType      `json:"type"`
+	Status             corev1.ConditionStatus `json:"status"`
+	LastTransitionTime metav1.Time            `json:"lastTransitionTime,omitempty"`
+	Reason             string                 `json:"reason,omitempty"`
+	Message            string                 `json:"message,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -19,16 +19,216 @@ limitations under the License.
 package v1alpha1
 
 import (
+	v1 "k8s.io/api/core/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CommitInfo) DeepCopyInto(out *CommitInfo) {
+	*out = *in
+	in.Timestamp.DeepCopyInto(&out.Timestamp)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CommitInfo.
+func (in *CommitInfo) DeepCopy() *CommitInfo {
+	if in == nil {
+		return nil
+	}
+	out := new(CommitInfo)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CommitStatusSpec) DeepCopyInto(out *CommitStatusSpec) {
+	*out = *in
+	in.TokenSecretRef.DeepCopyInto(&out.TokenSecretRef)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CommitStatusSpec.
+func (in *CommitStatusSpec) DeepCopy() *CommitStatusSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(CommitStatusSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NotificationSpec) DeepCopyInto(out *NotificationSpec) {
+	*out = *in
+	in.URLSecretRef.DeepCopyInto(&out.URLSecretRef)
+	if in.Events != nil {
+		in, out := &in.Events, &out.Events
+		*out = make([]NotificationEvent, len(*in))
+		copy(*out, *in)
+	}
+	if in.Retries != nil {
+		in, out := &in.Retries, &out.Retries
+		*out = new(int32)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NotificationSpec.
+func (in *NotificationSpec) DeepCopy() *NotificationSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(NotificationSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OutputsSpec) DeepCopyInto(out *OutputsSpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OutputsSpec.
+func (in *OutputsSpec) DeepCopy() *OutputsSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(OutputsSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PlanChange) DeepCopyInto(out *PlanChange) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PlanChange.
+func (in *PlanChange) DeepCopy() *PlanChange {
+	if in == nil {
+		return nil
+	}
+	out := new(PlanChange)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PlanPolicy) DeepCopyInto(out *PlanPolicy) {
+	*out = *in
+	if in.DenyDestroyTypes != nil {
+		in, out := &in.DenyDestroyTypes, &out.DenyDestroyTypes
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PlanPolicy.
+func (in *PlanPolicy) DeepCopy() *PlanPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(PlanPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PlanSummary) DeepCopyInto(out *PlanSummary) {
+	*out = *in
+	if in.Changes != nil {
+		in, out := &in.Changes, &out.Changes
+		*out = make([]PlanChange, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PlanSummary.
+func (in *PlanSummary) DeepCopy() *PlanSummary {
+	if in == nil {
+		return nil
+	}
+	out := new(PlanSummary)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PolicyOutcome) DeepCopyInto(out *PolicyOutcome) {
+	*out = *in
+	if in.Violations != nil {
+		in, out := &in.Violations, &out.Violations
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PolicyOutcome.
+func (in *PolicyOutcome) DeepCopy() *PolicyOutcome {
+	if in == nil {
+		return nil
+	}
+	out := new(PolicyOutcome)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PullRequestRun) DeepCopyInto(out *PullRequestRun) {
+	*out = *in
+	if in.Plan != nil {
+		in, out := &in.Plan, &out.Plan
+		*out = new(PlanSummary)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Failure != nil {
+		in, out := &in.Failure, &out.Failure
+		*out = new(RunFailure)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PullRequestRun.
+func (in *PullRequestRun) DeepCopy() *PullRequestRun {
+	if in == nil {
+		return nil
+	}
+	out := new(PullRequestRun)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PullRequestsSpec) DeepCopyInto(out *PullRequestsSpec) {
+	*out = *in
+	in.TokenSecretRef.DeepCopyInto(&out.TokenSecretRef)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PullRequestsSpec.
+func (in *PullRequestsSpec) DeepCopy() *PullRequestsSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(PullRequestsSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Repo) DeepCopyInto(out *Repo) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
-	out.Spec = in.Spec
-	out.Status = in.Status
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
 	return
 }
 
@@ -50,6 +250,23 @@ func (in *Repo) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RepoCondition) DeepCopyInto(out *RepoCondition) {
+	*out = *in
+	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RepoCondition.
+func (in *RepoCondition) DeepCopy() *RepoCondition {
+	if in == nil {
+		return nil
+	}
+	out := new(RepoCondition)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *RepoList) DeepCopyInto(out *RepoList) {
 	*out = *in
@@ -86,6 +303,53 @@ func (in *RepoList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *RepoSpec) DeepCopyInto(out *RepoSpec) {
 	*out = *in
+	if in.Verification != nil {
+		in, out := &in.Verification, &out.Verification
+		*out = new(VerificationSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.IncludePaths != nil {
+		in, out := &in.IncludePaths, &out.IncludePaths
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.IgnorePaths != nil {
+		in, out := &in.IgnorePaths, &out.IgnorePaths
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.SkipMarkers != nil {
+		in, out := &in.SkipMarkers, &out.SkipMarkers
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Policy != nil {
+		in, out := &in.Policy, &out.Policy
+		*out = new(PlanPolicy)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Outputs != nil {
+		in, out := &in.Outputs, &out.Outputs
+		*out = new(OutputsSpec)
+		**out = **in
+	}
+	if in.Notifications != nil {
+		in, out := &in.Notifications, &out.Notifications
+		*out = make([]NotificationSpec, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.CommitStatus != nil {
+		in, out := &in.CommitStatus, &out.CommitStatus
+		*out = new(CommitStatusSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.PullRequests != nil {
+		in, out := &in.PullRequests, &out.PullRequests
+		*out = new(PullRequestsSpec)
+		(*in).DeepCopyInto(*out)
+	}
 	return
 }
 
@@ -102,6 +366,44 @@ func (in *RepoSpec) DeepCopy() *RepoSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *RepoStatus) DeepCopyInto(out *RepoStatus) {
 	*out = *in
+	if in.RevisionDetectedTime != nil {
+		in, out := &in.RevisionDetectedTime, &out.RevisionDetectedTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Commit != nil {
+		in, out := &in.Commit, &out.Commit
+		*out = new(CommitInfo)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ApprovedPlan != nil {
+		in, out := &in.ApprovedPlan, &out.ApprovedPlan
+		*out = new(PlanSummary)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Result != nil {
+		in, out := &in.Result, &out.Result
+		*out = new(RunResult)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Failure != nil {
+		in, out := &in.Failure, &out.Failure
+		*out = new(RunFailure)
+		**out = **in
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]RepoCondition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.PullRequests != nil {
+		in, out := &in.PullRequests, &out.PullRequests
+		*out = make([]PullRequestRun, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	return
 }
 
@@ -114,3 +416,119 @@ func (in *RepoStatus) DeepCopy() *RepoStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ResourceChanges) DeepCopyInto(out *ResourceChanges) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ResourceChanges.
+func (in *ResourceChanges) DeepCopy() *ResourceChanges {
+	if in == nil {
+		return nil
+	}
+	out := new(ResourceChanges)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RunFailure) DeepCopyInto(out *RunFailure) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RunFailure.
+func (in *RunFailure) DeepCopy() *RunFailure {
+	if in == nil {
+		return nil
+	}
+	out := new(RunFailure)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RunResult) DeepCopyInto(out *RunResult) {
+	*out = *in
+	if in.Stages != nil {
+		in, out := &in.Stages, &out.Stages
+		*out = make([]RunStage, len(*in))
+		copy(*out, *in)
+	}
+	if in.Plan != nil {
+		in, out := &in.Plan, &out.Plan
+		*out = new(PlanSummary)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Policy != nil {
+		in, out := &in.Policy, &out.Policy
+		*out = new(PolicyOutcome)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Resources != nil {
+		in, out := &in.Resources, &out.Resources
+		*out = new(ResourceChanges)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RunResult.
+func (in *RunResult) DeepCopy() *RunResult {
+	if in == nil {
+		return nil
+	}
+	out := new(RunResult)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RunStage) DeepCopyInto(out *RunStage) {
+	*out = *in
+	out.Duration = in.Duration
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RunStage.
+func (in *RunStage) DeepCopy() *RunStage {
+	if in == nil {
+		return nil
+	}
+	out := new(RunStage)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VerificationSpec) DeepCopyInto(out *VerificationSpec) {
+	*out = *in
+	if in.GPGKeys != nil {
+		in, out := &in.GPGKeys, &out.GPGKeys
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.SSHKeys != nil {
+		in, out := &in.SSHKeys, &out.SSHKeys
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.SecretRef != nil {
+		in, out := &in.SecretRef, &out.SecretRef
+		*out = new(v1.LocalObjectReference)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VerificationSpec.
+func (in *VerificationSpec) DeepCopy() *VerificationSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(VerificationSpec)
+	in.DeepCopyInto(out)
+	return out
+}
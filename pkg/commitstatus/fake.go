@@ -0,0 +1,34 @@
+package commitstatus
+
+import (
+	"sync"
+)
+
+// FakeProvider records the statuses it is given instead of calling a git host
+type FakeProvider struct {
+	sync.Mutex
+	// Err is returned by SetStatus when set
+	Err      error
+	Statuses map[string][]Status
+}
+
+func NewFakeProvider() *FakeProvider {
+	return &FakeProvider{Statuses: map[string][]Status{}}
+}
+
+func (fake *FakeProvider) SetStatus(sha string, status Status) error {
+	fake.Lock()
+	defer fake.Unlock()
+	if fake.Err != nil {
+		return fake.Err
+	}
+	fake.Statuses[sha] = append(fake.Statuses[sha], status)
+	return nil
+}
+
+// StatusesOf returns the statuses set on a commit, oldest first
+func (fake *FakeProvider) StatusesOf(sha string) []Status {
+	fake.Lock()
+	defer fake.Unlock()
+	return append([]Status(nil), fake.Statuses[sha]...)
+}
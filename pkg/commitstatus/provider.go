@@ -0,0 +1,246 @@
+// Package commitstatus reports the status of the runs of Repos on the
+// commits of their git host, next to the other checks of pull requests.
+package commitstatus
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	repov1alpha1 "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
+)
+
+// Longest description git hosts accept
+const maxDescriptionLength = 140
+
+// State is the state of a commit status
+type State string
+
+const (
+	Pending State = "pending"
+	Success State = "success"
+	Failure State = "failure"
+)
+
+// Status is the status of a run of a commit
+type Status struct {
+	State State
+	// Context names the status among the other checks of the commit
+	Context     string
+	Description string
+	// TargetURL is linked from the status
+	TargetURL string
+}
+
+// Provider sets statuses on the commits of a repository of a git host
+type Provider interface {
+	SetStatus(sha string, status Status) error
+}
+
+// Repository locates a repository on a git host
+type Repository struct {
+	Host string
+	// Path is the path of the repository on the host, e.g. owner/name
+	Path string
+}
+
+// ParseRepository reads the host and the path of a git URL, in the https,
+// ssh or scp-like syntax
+func ParseRepository(repoURL string) (Repository, error) {
+	if !strings.Contains(repoURL, "://") {
+		// scp-like syntax, e.g. git@github.com:owner/name.git
+		if i := strings.Index(repoURL, ":"); i > 0 {
+			repoURL = "ssh://" + repoURL[:i] + "/" + repoURL[i+1:]
+		}
+	}
+	parsed, err := url.Parse(repoURL)
+	if err != nil {
+		return Repository{}, errors.Wrapf(err, "parsing repo url failed")
+	}
+	path := strings.TrimSuffix(strings.Trim(parsed.Path, "/"), ".git")
+	if parsed.Hostname() == "" || path == "" {
+		return Repository{}, errors.Errorf("repo url %q names no repository", repoURL)
+	}
+	return Repository{Host: parsed.Hostname(), Path: path}, nil
+}
+
+// DetectProvider guesses the API of a git host from its name
+func DetectProvider(host string) (repov1alpha1.GitProvider, error) {
+	switch {
+	case host == "github.com":
+		return repov1alpha1.GitHubProvider, nil
+	case host == "bitbucket.org":
+		return repov1alpha1.BitbucketProvider, nil
+	case strings.Contains(host, "gitlab"):
+		return repov1alpha1.GitLabProvider, nil
+	}
+	return "", errors.Errorf("git host %s is not known, set the provider of the commit status", host)
+}
+
+// NewProvider returns the provider of the git host of a Repo
+func NewProvider(repo *repov1alpha1.Repo, token string, client *http.Client) (Provider, error) {
+	spec := repo.Spec.CommitStatus
+	repository, err := ParseRepository(repo.Spec.Url)
+	if err != nil {
+		return nil, err
+	}
+	provider := spec.Provider
+	if provider == "" {
+		if provider, err = DetectProvider(repository.Host); err != nil {
+			return nil, err
+		}
+	}
+	apiURL := strings.TrimSuffix(spec.APIURL, "/")
+
+	switch provider {
+	case repov1alpha1.GitHubProvider:
+		if apiURL == "" {
+			apiURL = "https://api.github.com"
+		}
+		return GitHub{apiURL: apiURL, repository: repository, token: token, client: client}, nil
+	case repov1alpha1.GitLabProvider:
+		if apiURL == "" {
+			apiURL = "https://" + repository.Host + "/api/v4"
+		}
+		return GitLab{apiURL: apiURL, repository: repository, token: token, client: client}, nil
+	case repov1alpha1.BitbucketProvider:
+		if apiURL == "" {
+			apiURL = "https://api.bitbucket.org/2.0"
+		}
+		return Bitbucket{apiURL: apiURL, repository: repository, token: token, client: client}, nil
+	}
+	return nil, errors.Errorf("unknown git provider %q", provider)
+}
+
+// GitHub sets commit statuses through the GitHub REST API
+type GitHub struct {
+	apiURL     string
+	repository Repository
+	token      string
+	client     *http.Client
+}
+
+type gitHubStatus struct {
+	State       string `json:"state"`
+	TargetURL   string `json:"target_url,omitempty"`
+	Description string `json:"description"`
+	Context     string `json:"context"`
+}
+
+func (gitHub GitHub) SetStatus(sha string, status Status) error {
+	endpoint := fmt.Sprintf("%s/repos/%s/statuses/%s", gitHub.apiURL, gitHub.repository.Path, sha)
+	return post(gitHub.client, endpoint, "token "+gitHub.token, gitHubStatus{
+		State:       string(status.State),
+		TargetURL:   status.TargetURL,
+		Description: truncate(status.Description),
+		Context:     status.Context,
+	})
+}
+
+// GitLab sets commit statuses through the GitLab REST API
+type GitLab struct {
+	apiURL     string
+	repository Repository
+	token      string
+	client     *http.Client
+}
+
+type gitLabStatus struct {
+	State       string `json:"state"`
+	Name        string `json:"name"`
+	TargetURL   string `json:"target_url,omitempty"`
+	Description string `json:"description"`
+}
+
+func (gitLab GitLab) SetStatus(sha string, status Status) error {
+	state := string(status.State)
+	if status.State == Failure {
+		state = "failed"
+	}
+	endpoint := fmt.Sprintf("%s/projects/%s/statuses/%s", gitLab.apiURL, url.PathEscape(gitLab.repository.Path), sha)
+	return post(gitLab.client, endpoint, "Bearer "+gitLab.token, gitLabStatus{
+		State:       state,
+		Name:        status.Context,
+		TargetURL:   status.TargetURL,
+		Description: truncate(status.Description),
+	})
+}
+
+// Bitbucket sets build statuses through the Bitbucket Cloud REST API
+type Bitbucket struct {
+	apiURL     string
+	repository Repository
+	token      string
+	client     *http.Client
+}
+
+type bitbucketStatus struct {
+	Key         string `json:"key"`
+	State       string `json:"state"`
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	Description string `json:"description"`
+}
+
+var bitbucketStates = map[State]string{
+	Pending: "INPROGRESS",
+	Success: "SUCCESSFUL",
+	Failure: "FAILED",
+}
+
+func (bitbucket Bitbucket) SetStatus(sha string, status Status) error {
+	// Bitbucket requires a link, the commit itself is the next best thing
+	targetURL := status.TargetURL
+	if targetURL == "" {
+		targetURL = fmt.Sprintf("https://%s/%s/commits/%s", bitbucket.repository.Host, bitbucket.repository.Path, sha)
+	}
+	endpoint := fmt.Sprintf("%s/repositories/%s/commit/%s/statuses/build", bitbucket.apiURL, bitbucket.repository.Path, sha)
+	return post(bitbucket.client, endpoint, "Bearer "+bitbucket.token, bitbucketStatus{
+		// keys are limited to 40 characters
+		Key:         truncateTo(status.Context, 40),
+		State:       bitbucketStates[status.State],
+		Name:        status.Context,
+		URL:         targetURL,
+		Description: truncate(status.Description),
+	})
+}
+
+func post(client *http.Client, endpoint string, authorization string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", authorization)
+
+	response, err := client.Do(request)
+	if err != nil {
+		return errors.Wrapf(err, "setting commit status failed")
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return errors.Errorf("setting commit status failed: git host answered %s", response.Status)
+	}
+	return nil
+}
+
+func truncate(description string) string {
+	return truncateTo(description, maxDescriptionLength)
+}
+
+func truncateTo(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	return string(runes[:max-3]) + "..."
+}
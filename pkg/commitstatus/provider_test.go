@@ -0,0 +1,186 @@
+package commitstatus
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	repov1alpha1 "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
+)
+
+const sha = "f7b877701fbf855b44c0a9e86f3fdce2c298b07f"
+
+func TestParsesRepository(t *testing.T) {
+	tests := []struct {
+		url      string
+		expected Repository
+	}{
+		{"https://github.com/acme/infra.git", Repository{Host: "github.com", Path: "acme/infra"}},
+		{"https://gitlab.example.com/platform/payments/infra", Repository{Host: "gitlab.example.com", Path: "platform/payments/infra"}},
+		{"ssh://git@bitbucket.org/acme/infra.git", Repository{Host: "bitbucket.org", Path: "acme/infra"}},
+		{"git@github.com:acme/infra.git", Repository{Host: "github.com", Path: "acme/infra"}},
+	}
+	for _, test := range tests {
+		repository, err := ParseRepository(test.url)
+		if err != nil {
+			t.Errorf("parsing %s: %v", test.url, err)
+			continue
+		}
+		if repository != test.expected {
+			t.Errorf("got %+v for %s; want %+v", repository, test.url, test.expected)
+		}
+	}
+
+	if _, err := ParseRepository("https://github.com/"); err == nil {
+		t.Error("got no error for a url naming no repository")
+	}
+}
+
+func TestDetectsProvider(t *testing.T) {
+	tests := map[string]repov1alpha1.GitProvider{
+		"github.com":         repov1alpha1.GitHubProvider,
+		"gitlab.com":         repov1alpha1.GitLabProvider,
+		"gitlab.example.com": repov1alpha1.GitLabProvider,
+		"bitbucket.org":      repov1alpha1.BitbucketProvider,
+	}
+	for host, expected := range tests {
+		if provider, err := DetectProvider(host); err != nil || provider != expected {
+			t.Errorf("got %q, %v for %s; want %q", provider, err, host, expected)
+		}
+	}
+	if _, err := DetectProvider("git.example.com"); err == nil {
+		t.Error("got no error for an unknown host")
+	}
+}
+
+type request struct {
+	path          string
+	authorization string
+	body          map[string]interface{}
+}
+
+func serve(t *testing.T, requests *[]request) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		*requests = append(*requests, request{path: r.URL.EscapedPath(), authorization: r.Header.Get("Authorization"), body: body})
+		w.WriteHeader(http.StatusCreated)
+	}))
+}
+
+func newProvider(t *testing.T, provider repov1alpha1.GitProvider, repoURL string, apiURL string) Provider {
+	repo := &repov1alpha1.Repo{Spec: repov1alpha1.RepoSpec{
+		Url:          repoURL,
+		CommitStatus: &repov1alpha1.CommitStatusSpec{Provider: provider, APIURL: apiURL},
+	}}
+	p, err := NewProvider(repo, "s3cr3t", http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestSetsGitHubStatus(t *testing.T) {
+	var requests []request
+	server := serve(t, &requests)
+	defer server.Close()
+	provider := newProvider(t, repov1alpha1.GitHubProvider, "https://github.example.com/acme/infra.git", server.URL)
+
+	err := provider.SetStatus(sha, Status{State: Failure, Context: "terraform/infra", Description: "Failed at apply: Error: AccessDenied"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []request{{
+		path:          "/repos/acme/infra/statuses/" + sha,
+		authorization: "token s3cr3t",
+		body: map[string]interface{}{
+			"state":       "failure",
+			"context":     "terraform/infra",
+			"description": "Failed at apply: Error: AccessDenied",
+		},
+	}}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("got %+v; want %+v", requests, expected)
+	}
+}
+
+func TestSetsGitLabStatus(t *testing.T) {
+	var requests []request
+	server := serve(t, &requests)
+	defer server.Close()
+	provider := newProvider(t, "", "https://gitlab.example.com/platform/infra.git", server.URL)
+
+	err := provider.SetStatus(sha, Status{State: Failure, Context: "terraform/infra", TargetURL: "https://runs.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []request{{
+		path:          "/projects/platform%2Finfra/statuses/" + sha,
+		authorization: "Bearer s3cr3t",
+		body: map[string]interface{}{
+			"state":       "failed",
+			"name":        "terraform/infra",
+			"target_url":  "https://runs.example.com",
+			"description": "",
+		},
+	}}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("got %+v; want %+v", requests, expected)
+	}
+}
+
+func TestSetsBitbucketStatus(t *testing.T) {
+	var requests []request
+	server := serve(t, &requests)
+	defer server.Close()
+	provider := newProvider(t, "", "git@bitbucket.org:acme/infra.git", server.URL)
+
+	err := provider.SetStatus(sha, Status{State: Pending, Context: "terraform/infra", Description: "Terraform run started"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []request{{
+		path:          "/repositories/acme/infra/commit/" + sha + "/statuses/build",
+		authorization: "Bearer s3cr3t",
+		body: map[string]interface{}{
+			"key":         "terraform/infra",
+			"state":       "INPROGRESS",
+			"name":        "terraform/infra",
+			"url":         "https://bitbucket.org/acme/infra/commits/" + sha,
+			"description": "Terraform run started",
+		},
+	}}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("got %+v; want %+v", requests, expected)
+	}
+}
+
+func TestFailsOnRejectedStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	provider := newProvider(t, repov1alpha1.GitHubProvider, "https://github.com/acme/infra.git", server.URL)
+
+	if err := provider.SetStatus(sha, Status{State: Pending}); err == nil {
+		t.Error("got no error; want the rejection reported")
+	}
+}
+
+func TestTruncatesDescription(t *testing.T) {
+	description := truncate(strings.Repeat("é", 200))
+	if n := len([]rune(description)); n != maxDescriptionLength {
+		t.Errorf("got %d characters; want %d", n, maxDescriptionLength)
+	}
+	if !strings.HasSuffix(description, "...") {
+		t.Errorf("got %q; want it marked as truncated", description)
+	}
+}
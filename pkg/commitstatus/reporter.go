@@ -0,0 +1,234 @@
+package commitstatus
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog"
+
+	repov1alpha1 "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
+)
+
+const (
+	// Commits waiting beyond this are dropped rather than block the controller
+	queueSize      = 1000
+	retries        = 3
+	requestTimeout = 10 * time.Second
+)
+
+type update struct {
+	repo   *repov1alpha1.Repo
+	sha    string
+	status Status
+	// generation tells updates of the same commit apart
+	generation uint64
+}
+
+// Reporter sets the status of runs on the commits they run, from a pool of
+// workers so that slow git hosts never hold up the controller. Commits are
+// queued rather than their statuses: a commit is updated by one worker at a
+// time, with the latest status of its run, so that a retried status never
+// overwrites a newer one. Failed updates are retried with an exponential
+// backoff.
+type Reporter struct {
+	kubeclientset kubernetes.Interface
+	client        *http.Client
+	workqueue     workqueue.RateLimitingInterface
+	// latest holds the status to report of every queued commit
+	lock        sync.Mutex
+	latest      map[string]update
+	generation  uint64
+	newProvider func(repo *repov1alpha1.Repo, token string, client *http.Client) (Provider, error)
+}
+
+func NewReporter(kubeclientset kubernetes.Interface) *Reporter {
+	return &Reporter{
+		kubeclientset: kubeclientset,
+		client:        &http.Client{Timeout: requestTimeout},
+		workqueue:     newQueue(time.Second),
+		latest:        map[string]update{},
+		newProvider:   NewProvider,
+	}
+}
+
+// newQueue returns a queue retrying a commit after backoff, doubled for
+// every retry after it
+func newQueue(backoff time.Duration) workqueue.RateLimitingInterface {
+	return workqueue.NewNamedRateLimitingQueue(
+		workqueue.NewItemExponentialFailureRateLimiter(backoff, time.Minute), "CommitStatuses")
+}
+
+// Notify queues the commit status matching a step of the progress of a run:
+// pending once the run started or while its plan awaits approval, success or
+// failure once it finished. The plan runs of pull requests are reported on
+// their heads likewise. It replaces the status still queued for the
+// commit, if any.
+func (reporter *Reporter) Notify(repo *repov1alpha1.Repo, event repov1alpha1.NotificationEvent) {
+	if repo.Spec.CommitStatus == nil || repo.Status.GitSHA == "" {
+		return
+	}
+	status, found := NewStatus(repo, event)
+	if !found {
+		return
+	}
+	key := fmt.Sprintf("%s/%s/%s", repo.Namespace, repo.Name, repo.Status.GitSHA)
+
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+	if _, queued := reporter.latest[key]; !queued && len(reporter.latest) >= queueSize {
+		klog.Warningf("Dropped %s commit status of '%s/%s': too many commit statuses pending",
+			status.State, repo.Namespace, repo.Name)
+		return
+	}
+	reporter.generation++
+	reporter.latest[key] = update{repo: repo.DeepCopy(), sha: repo.Status.GitSHA, status: status, generation: reporter.generation}
+	reporter.workqueue.Add(key)
+}
+
+// NewStatus describes the state of the run of a Repo as a commit status
+func NewStatus(repo *repov1alpha1.Repo, event repov1alpha1.NotificationEvent) (Status, bool) {
+	spec := repo.Spec.CommitStatus
+	status := Status{Context: spec.Context, TargetURL: spec.TargetURL}
+	if status.Context == "" {
+		status.Context = "terraform/" + repo.Name
+	}
+	var plan string
+	if result := repo.Status.Result; result != nil && result.Plan != nil {
+		plan = fmt.Sprintf("Plan: %d to add, %d to change, %d to destroy",
+			result.Plan.Add, result.Plan.Change, result.Plan.Destroy)
+	}
+
+	switch event {
+	case repov1alpha1.RunStarted:
+		status.State = Pending
+		status.Description = "Terraform run started"
+	case repov1alpha1.AwaitingApproval:
+		status.State = Pending
+		status.Description = joinDescription("Awaiting approval", plan)
+	case repov1alpha1.RunSucceeded:
+		status.State = Success
+		status.Description = joinDescription("Applied", plan)
+	case repov1alpha1.RunFailed:
+		status.State = Failure
+		status.Description = "Terraform run failed"
+		if failure := repo.Status.Failure; failure != nil && failure.Step != "" {
+			status.Description = fmt.Sprintf("Failed at %s: %s", failure.Step, failure.Reason)
+		} else if failure != nil {
+			status.Description = "Failed: " + failure.Reason
+		}
+	case repov1alpha1.PullRequestPlanStarted:
+		status.State = Pending
+		status.Description = "Terraform plan started"
+	case repov1alpha1.PullRequestPlanned:
+		status.State = Success
+		status.Description = joinDescription("Planned", plan)
+	case repov1alpha1.PullRequestPlanFailed:
+		status.State = Failure
+		status.Description = "Terraform plan failed"
+		if failure := repo.Status.Failure; failure != nil && failure.Step != "" {
+			status.Description = fmt.Sprintf("Plan failed at %s: %s", failure.Step, failure.Reason)
+		} else if failure != nil {
+			status.Description = "Plan failed: " + failure.Reason
+		}
+	default:
+		return status, false
+	}
+	return status, true
+}
+
+func joinDescription(state string, plan string) string {
+	if plan == "" {
+		return state
+	}
+	return state + ". " + plan
+}
+
+// Run starts the workers. It blocks until stopCh is closed, at which point
+// pending updates are dropped.
+func (reporter *Reporter) Run(workers int, stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+	defer reporter.workqueue.ShutDown()
+
+	klog.Infof("Starting %d commit status workers", workers)
+	for i := 0; i < workers; i++ {
+		go wait.Until(reporter.runWorker, time.Second, stopCh)
+	}
+	<-stopCh
+	klog.Info("Shutting down commit status workers")
+}
+
+func (reporter *Reporter) runWorker() {
+	for reporter.processNextWorkItem() {
+	}
+}
+
+// processNextWorkItem reports the latest status of the next queued commit
+func (reporter *Reporter) processNextWorkItem() bool {
+	obj, shutdown := reporter.workqueue.Get()
+	if shutdown {
+		return false
+	}
+	defer reporter.workqueue.Done(obj)
+	key := obj.(string)
+
+	reporter.lock.Lock()
+	update, found := reporter.latest[key]
+	reporter.lock.Unlock()
+	if !found {
+		// reported already, on an earlier pass
+		reporter.workqueue.Forget(obj)
+		return true
+	}
+
+	repo := update.repo
+	err := reporter.setStatus(update)
+	if err != nil && reporter.workqueue.NumRequeues(obj) < retries {
+		reporter.workqueue.AddRateLimited(obj)
+		return true
+	}
+	reporter.workqueue.Forget(obj)
+	reporter.lock.Lock()
+	if reporter.latest[key].generation == update.generation {
+		delete(reporter.latest, key)
+	}
+	reporter.lock.Unlock()
+
+	if err != nil {
+		utilruntime.HandleError(errors.Wrapf(err, "setting %s commit status of revision %s of '%s/%s' failed after %d attempts",
+			update.status.State, update.sha, repo.Namespace, repo.Name, retries+1))
+		return true
+	}
+	klog.V(4).Infof("Set %s commit status of revision %s of '%s/%s'",
+		update.status.State, update.sha, repo.Namespace, repo.Name)
+	return true
+}
+
+// setStatus sets a status once. The token is read on every attempt, so a
+// Secret fixed in the meantime is used by the next retry.
+func (reporter *Reporter) setStatus(update update) error {
+	ref := update.repo.Spec.CommitStatus.TokenSecretRef
+	namespace := update.repo.Namespace
+	secret, err := reporter.kubeclientset.CoreV1().Secrets(namespace).Get(ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "reading git host token from secret %v/%v failed", namespace, ref.Name)
+	}
+	token, found := secret.Data[ref.Key]
+	if !found {
+		return errors.Errorf("secret %v/%v has no key %q", namespace, ref.Name, ref.Key)
+	}
+
+	provider, err := reporter.newProvider(update.repo, strings.TrimSpace(string(token)), reporter.client)
+	if err != nil {
+		return err
+	}
+	return provider.SetStatus(update.sha, update.status)
+}
@@ -0,0 +1,189 @@
+package commitstatus
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	repov1alpha1 "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
+)
+
+func newRepo() *repov1alpha1.Repo {
+	return &repov1alpha1.Repo{
+		ObjectMeta: metav1.ObjectMeta{Name: "infra", Namespace: "payments"},
+		Spec: repov1alpha1.RepoSpec{
+			Url: "https://github.com/acme/infra.git",
+			CommitStatus: &repov1alpha1.CommitStatusSpec{
+				TokenSecretRef: corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "github"},
+					Key:                  "token",
+				},
+			},
+		},
+		Status: repov1alpha1.RepoStatus{
+			GitSHA:    sha,
+			RunStatus: "Completed",
+			Result: &repov1alpha1.RunResult{
+				Plan: &repov1alpha1.PlanSummary{Add: 2, Change: 1},
+			},
+		},
+	}
+}
+
+func newTestReporter(provider *FakeProvider) (*Reporter, *string) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "github", Namespace: "payments"},
+		Data:       map[string][]byte{"token": []byte("s3cr3t\n")},
+	}
+	var token string
+	reporter := NewReporter(fake.NewSimpleClientset(secret))
+	reporter.workqueue = newQueue(time.Millisecond)
+	reporter.newProvider = func(repo *repov1alpha1.Repo, t string, client *http.Client) (Provider, error) {
+		token = t
+		return provider, nil
+	}
+	return reporter, &token
+}
+
+// drain reports the queued statuses, retries included
+func drain(reporter *Reporter) {
+	for len(reporter.latest) != 0 {
+		reporter.processNextWorkItem()
+	}
+}
+
+func TestReportsRunProgress(t *testing.T) {
+	provider := NewFakeProvider()
+	reporter, token := newTestReporter(provider)
+	repo := newRepo()
+
+	reporter.Notify(repo, repov1alpha1.RevisionDetected)
+	reporter.Notify(repo, repov1alpha1.RunStarted)
+	drain(reporter)
+	reporter.Notify(repo, repov1alpha1.PlanReady)
+	reporter.Notify(repo, repov1alpha1.RunSucceeded)
+	drain(reporter)
+
+	expected := []Status{
+		{State: Pending, Context: "terraform/infra", Description: "Terraform run started"},
+		{State: Success, Context: "terraform/infra", Description: "Applied. Plan: 2 to add, 1 to change, 0 to destroy"},
+	}
+	if statuses := provider.StatusesOf(sha); !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("got statuses %+v; want %+v", statuses, expected)
+	}
+	if *token != "s3cr3t" {
+		t.Errorf("got token %q", *token)
+	}
+}
+
+func TestReportsRunFailure(t *testing.T) {
+	repo := newRepo()
+	repo.Spec.CommitStatus.Context = "terraform/prod"
+	repo.Spec.CommitStatus.TargetURL = "https://runs.example.com/payments/infra"
+	repo.Status.Failure = &repov1alpha1.RunFailure{Step: "apply", Reason: "Error: AccessDenied"}
+
+	status, found := NewStatus(repo, repov1alpha1.RunFailed)
+	if !found {
+		t.Fatal("got no status for a failed run")
+	}
+	expected := Status{
+		State:       Failure,
+		Context:     "terraform/prod",
+		Description: "Failed at apply: Error: AccessDenied",
+		TargetURL:   "https://runs.example.com/payments/infra",
+	}
+	if status != expected {
+		t.Errorf("got %+v; want %+v", status, expected)
+	}
+}
+
+func TestReportsHeldPlanAsPending(t *testing.T) {
+	status, _ := NewStatus(newRepo(), repov1alpha1.AwaitingApproval)
+	if status.State != Pending || status.Description != "Awaiting approval. Plan: 2 to add, 1 to change, 0 to destroy" {
+		t.Errorf("got %+v", status)
+	}
+}
+
+func TestReportsPullRequestPlanOnItsHead(t *testing.T) {
+	provider := NewFakeProvider()
+	reporter, _ := newTestReporter(provider)
+	repo := newRepo()
+	head := "0a1b2c3d4e5f67890a1b2c3d4e5f67890a1b2c3d"
+	repo.Status = repov1alpha1.RepoStatus{
+		GitSHA:       head,
+		RunStatus:    "Failed",
+		Failure:      &repov1alpha1.RunFailure{Step: "plan", Reason: "Error: Invalid reference"},
+		PullRequests: []repov1alpha1.PullRequestRun{{Number: 42, GitSHA: head}},
+	}
+
+	reporter.Notify(repo, repov1alpha1.PullRequestPlanFailed)
+	drain(reporter)
+
+	expected := []Status{{State: Failure, Context: "terraform/infra", Description: "Plan failed at plan: Error: Invalid reference"}}
+	if statuses := provider.StatusesOf(head); !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("got statuses %+v; want %+v", statuses, expected)
+	}
+	if statuses := provider.StatusesOf(sha); len(statuses) != 0 {
+		t.Errorf("got statuses %+v on the tracked revision; want none", statuses)
+	}
+}
+
+func TestIgnoresReposWithoutCommitStatus(t *testing.T) {
+	provider := NewFakeProvider()
+	reporter, _ := newTestReporter(provider)
+	repo := newRepo()
+	repo.Spec.CommitStatus = nil
+
+	reporter.Notify(repo, repov1alpha1.RunSucceeded)
+	drain(reporter)
+
+	if len(provider.Statuses) != 0 {
+		t.Errorf("got statuses %+v; want none", provider.Statuses)
+	}
+}
+
+func TestRetriesFailedStatus(t *testing.T) {
+	provider := NewFakeProvider()
+	provider.Err = errors.New("git host answered 502 Bad Gateway")
+	reporter, _ := newTestReporter(provider)
+	attempts := 0
+	reporter.newProvider = func(repo *repov1alpha1.Repo, token string, client *http.Client) (Provider, error) {
+		attempts++
+		if attempts == 3 {
+			provider.Err = nil
+		}
+		return provider, nil
+	}
+
+	reporter.Notify(newRepo(), repov1alpha1.RunSucceeded)
+	drain(reporter)
+
+	if statuses := provider.StatusesOf(sha); len(statuses) != 1 || attempts != 3 {
+		t.Errorf("got statuses %+v after %d attempts; want 1 after 3", statuses, attempts)
+	}
+}
+
+func TestRetriesLatestStatusOfCommit(t *testing.T) {
+	provider := NewFakeProvider()
+	provider.Err = errors.New("git host answered 502 Bad Gateway")
+	reporter, _ := newTestReporter(provider)
+	repo := newRepo()
+
+	reporter.Notify(repo, repov1alpha1.RunStarted)
+	// the pending status fails, and the run succeeds before it is retried
+	reporter.processNextWorkItem()
+	reporter.Notify(repo, repov1alpha1.RunSucceeded)
+	provider.Err = nil
+	drain(reporter)
+
+	statuses := provider.StatusesOf(sha)
+	if len(statuses) != 1 || statuses[0].State != Success {
+		t.Errorf("got statuses %+v; want only the success", statuses)
+	}
+}
@@ -0,0 +1,65 @@
+package drain
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Tracker keeps track of the work in progress, by key, so that it can be
+// waited for on shutdown
+type Tracker struct {
+	mu       sync.Mutex
+	inFlight map[string]int
+	idle     *sync.Cond
+}
+
+func NewTracker() *Tracker {
+	tracker := &Tracker{inFlight: make(map[string]int)}
+	tracker.idle = sync.NewCond(&tracker.mu)
+	return tracker
+}
+
+// Start records work starting for a key
+func (tracker *Tracker) Start(key string) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	tracker.inFlight[key]++
+}
+
+// Done records work finishing for a key
+func (tracker *Tracker) Done(key string) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if tracker.inFlight[key]--; tracker.inFlight[key] <= 0 {
+		delete(tracker.inFlight, key)
+	}
+	if len(tracker.inFlight) == 0 {
+		tracker.idle.Broadcast()
+	}
+}
+
+// Wait blocks until no work is in progress, or the timeout expires. It
+// returns the keys of the work still in progress, which is abandoned.
+func (tracker *Tracker) Wait(timeout time.Duration) []string {
+	timer := time.AfterFunc(timeout, func() {
+		tracker.mu.Lock()
+		defer tracker.mu.Unlock()
+		tracker.idle.Broadcast()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(timeout)
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	for len(tracker.inFlight) != 0 && time.Now().Before(deadline) {
+		tracker.idle.Wait()
+	}
+
+	abandoned := make([]string, 0, len(tracker.inFlight))
+	for key := range tracker.inFlight {
+		abandoned = append(abandoned, key)
+	}
+	sort.Strings(abandoned)
+	return abandoned
+}
@@ -0,0 +1,47 @@
+package drain
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWaitsForWorkInProgress(t *testing.T) {
+	tracker := NewTracker()
+	tracker.Start("default/network")
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		tracker.Done("default/network")
+	}()
+
+	if abandoned := tracker.Wait(time.Second); len(abandoned) != 0 {
+		t.Errorf("expected no work to be abandoned, got %v", abandoned)
+	}
+}
+
+func TestAbandonsWorkAfterTimeout(t *testing.T) {
+	tracker := NewTracker()
+	tracker.Start("default/network")
+	tracker.Start("default/database")
+	tracker.Start("default/database")
+	tracker.Done("default/database")
+
+	start := time.Now()
+	abandoned := tracker.Wait(20 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected wait to stop at the timeout, waited %s", elapsed)
+	}
+	if !reflect.DeepEqual(abandoned, []string{"default/database", "default/network"}) {
+		t.Errorf("got abandoned work %v", abandoned)
+	}
+}
+
+func TestDoesNotWaitWhenIdle(t *testing.T) {
+	tracker := NewTracker()
+	tracker.Start("default/network")
+	tracker.Done("default/network")
+
+	if abandoned := tracker.Wait(time.Hour); len(abandoned) != 0 {
+		t.Errorf("expected no work to be abandoned, got %v", abandoned)
+	}
+}
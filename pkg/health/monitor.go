@@ -0,0 +1,97 @@
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Monitor tracks the readiness of the controller and the heartbeats of its
+// long running loops. A loop is considered stuck when it does not send a new
+// heartbeat before the deadline set by its previous one.
+type Monitor struct {
+	mu        sync.Mutex
+	ready     bool
+	deadlines map[string]time.Time
+	now       func() time.Time
+}
+
+func NewMonitor() *Monitor {
+	return &Monitor{
+		deadlines: make(map[string]time.Time),
+		now:       time.Now,
+	}
+}
+
+// SetReady marks the controller as ready, or not, to process Repos
+func (m *Monitor) SetReady(ready bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ready = ready
+}
+
+// Heartbeat records that the named loop is alive and expects the next
+// heartbeat, or the loop to be forgotten, within the timeout
+func (m *Monitor) Heartbeat(name string, timeout time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deadlines[name] = m.now().Add(timeout)
+}
+
+// Forget stops tracking a loop that finished
+func (m *Monitor) Forget(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.deadlines, name)
+}
+
+// Ready returns an error until the controller is ready
+func (m *Monitor) Ready() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.ready {
+		return fmt.Errorf("informer caches are not synced")
+	}
+	return nil
+}
+
+// Healthy returns an error listing the loops that missed their deadline
+func (m *Monitor) Healthy() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	var stuck []string
+	for name, deadline := range m.deadlines {
+		if now.After(deadline) {
+			stuck = append(stuck, name)
+		}
+	}
+	if len(stuck) != 0 {
+		sort.Strings(stuck)
+		return fmt.Errorf("stuck: %s", strings.Join(stuck, ", "))
+	}
+	return nil
+}
+
+// LivenessHandler serves the /healthz endpoint
+func (m *Monitor) LivenessHandler() http.Handler {
+	return checkHandler(m.Healthy, http.StatusInternalServerError)
+}
+
+// ReadinessHandler serves the /readyz endpoint
+func (m *Monitor) ReadinessHandler() http.Handler {
+	return checkHandler(m.Ready, http.StatusServiceUnavailable)
+}
+
+func checkHandler(check func() error, failureCode int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), failureCode)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	})
+}
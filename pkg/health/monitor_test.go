@@ -0,0 +1,53 @@
+package health
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadiness(t *testing.T) {
+	monitor := NewMonitor()
+	if code := get(monitor.ReadinessHandler()); code != http.StatusServiceUnavailable {
+		t.Errorf("got = %d; want %d", code, http.StatusServiceUnavailable)
+	}
+
+	monitor.SetReady(true)
+	if code := get(monitor.ReadinessHandler()); code != http.StatusOK {
+		t.Errorf("got = %d; want %d", code, http.StatusOK)
+	}
+}
+
+func TestLivenessDetectsMissedHeartbeats(t *testing.T) {
+	now := time.Now()
+	monitor := NewMonitor()
+	monitor.now = func() time.Time { return now }
+
+	monitor.Heartbeat("poller/default/test-repo", time.Minute)
+	monitor.Heartbeat("sync/default/test-repo", time.Minute)
+	if code := get(monitor.LivenessHandler()); code != http.StatusOK {
+		t.Errorf("got = %d; want %d", code, http.StatusOK)
+	}
+
+	now = now.Add(2 * time.Minute)
+	monitor.Forget("sync/default/test-repo")
+	err := monitor.Healthy()
+	if err == nil || err.Error() != "stuck: poller/default/test-repo" {
+		t.Errorf("expected poller to be reported stuck, got %v", err)
+	}
+	if code := get(monitor.LivenessHandler()); code != http.StatusInternalServerError {
+		t.Errorf("got = %d; want %d", code, http.StatusInternalServerError)
+	}
+
+	monitor.Heartbeat("poller/default/test-repo", time.Minute)
+	if err := monitor.Healthy(); err != nil {
+		t.Errorf("expected poller to recover, got %v", err)
+	}
+}
+
+func get(handler http.Handler) int {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	return recorder.Code
+}
@@ -0,0 +1,119 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "terraform_repo"
+
+var (
+	pollAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "poll_attempts_total",
+		Help:      "Number of times the source repository of a Repo was checked for new revisions.",
+	}, []string{"namespace", "repo"})
+
+	pollFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "poll_failures_total",
+		Help:      "Number of failed checks for new revisions.",
+	}, []string{"namespace", "repo"})
+
+	pollDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "poll_duration_seconds",
+		Help:      "Time taken to list the references of the source repository of a Repo.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"namespace", "repo"})
+
+	revisionsDetected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "revisions_detected_total",
+		Help:      "Number of new revisions found on the source repository of a Repo.",
+	}, []string{"namespace", "repo"})
+
+	jobsCreated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jobs_created_total",
+		Help:      "Number of Terraform Jobs created for a Repo.",
+	}, []string{"namespace", "repo"})
+
+	runs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "runs_total",
+		Help:      "Number of finished Terraform runs by outcome.",
+	}, []string{"namespace", "repo", "status"})
+
+	runDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "run_duration_seconds",
+		Help:      "Time from the start of a Terraform Job to its completion, by outcome.",
+		Buckets:   prometheus.ExponentialBuckets(10, 2, 10),
+	}, []string{"namespace", "repo", "status"})
+
+	detectionToApply = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "detection_to_apply_seconds",
+		Help:      "Time from the detection of a new revision to the completion of its run, by outcome.",
+		Buckets:   prometheus.ExponentialBuckets(10, 2, 12),
+	}, []string{"namespace", "repo", "status"})
+)
+
+// run outcomes tracked by the per status metrics
+var runStatuses = []string{"Completed", "Failed", "AwaitingApproval"}
+
+func init() {
+	prometheus.MustRegister(
+		pollAttempts,
+		pollFailures,
+		pollDuration,
+		revisionsDetected,
+		jobsCreated,
+		runs,
+		runDuration,
+		detectionToApply,
+	)
+}
+
+// ObservePoll records a check for new revisions and how long listing references took
+func ObservePoll(repoNamespace, repoName string, duration time.Duration, err error) {
+	pollAttempts.WithLabelValues(repoNamespace, repoName).Inc()
+	pollDuration.WithLabelValues(repoNamespace, repoName).Observe(duration.Seconds())
+	if err != nil {
+		pollFailures.WithLabelValues(repoNamespace, repoName).Inc()
+	}
+}
+
+func RevisionDetected(repoNamespace, repoName string) {
+	revisionsDetected.WithLabelValues(repoNamespace, repoName).Inc()
+}
+
+func JobCreated(repoNamespace, repoName string) {
+	jobsCreated.WithLabelValues(repoNamespace, repoName).Inc()
+}
+
+// RunFinished records the outcome of a run. Durations are skipped when not known.
+func RunFinished(repoNamespace, repoName, status string, runDurationTime, sinceDetection time.Duration) {
+	runs.WithLabelValues(repoNamespace, repoName, status).Inc()
+	if runDurationTime > 0 {
+		runDuration.WithLabelValues(repoNamespace, repoName, status).Observe(runDurationTime.Seconds())
+	}
+	if sinceDetection > 0 {
+		detectionToApply.WithLabelValues(repoNamespace, repoName, status).Observe(sinceDetection.Seconds())
+	}
+}
+
+// ForgetRepo drops the series of a deleted Repo
+func ForgetRepo(repoNamespace, repoName string) {
+	for _, vec := range []*prometheus.CounterVec{pollAttempts, pollFailures, revisionsDetected, jobsCreated} {
+		vec.DeleteLabelValues(repoNamespace, repoName)
+	}
+	pollDuration.DeleteLabelValues(repoNamespace, repoName)
+	for _, status := range runStatuses {
+		runs.DeleteLabelValues(repoNamespace, repoName, status)
+		runDuration.DeleteLabelValues(repoNamespace, repoName, status)
+		detectionToApply.DeleteLabelValues(repoNamespace, repoName, status)
+	}
+}
@@ -0,0 +1,37 @@
+package metrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObservePoll(t *testing.T) {
+	ObservePoll("default", "test-repo", time.Second, nil)
+	ObservePoll("default", "test-repo", time.Second, errors.New("connection refused"))
+
+	if got := testutil.ToFloat64(pollAttempts.WithLabelValues("default", "test-repo")); got != 2 {
+		t.Errorf("got %v poll attempts; want 2", got)
+	}
+	if got := testutil.ToFloat64(pollFailures.WithLabelValues("default", "test-repo")); got != 1 {
+		t.Errorf("got %v poll failures; want 1", got)
+	}
+
+	ForgetRepo("default", "test-repo")
+	if got := testutil.ToFloat64(pollAttempts.WithLabelValues("default", "test-repo")); got != 0 {
+		t.Errorf("expected series of forgotten repo to be reset, got %v", got)
+	}
+}
+
+func TestRunFinished(t *testing.T) {
+	RunFinished("default", "test-repo", "Failed", time.Minute, 0)
+
+	if got := testutil.ToFloat64(runs.WithLabelValues("default", "test-repo", "Failed")); got != 1 {
+		t.Errorf("got %v failed runs; want 1", got)
+	}
+	if got := testutil.ToFloat64(runs.WithLabelValues("default", "test-repo", "Completed")); got != 0 {
+		t.Errorf("got %v completed runs; want 0", got)
+	}
+}
@@ -0,0 +1,18 @@
+package multinamespace
+
+import (
+	batchinformers "k8s.io/client-go/informers/batch/v1"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+
+	informers "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/generated/informers/externalversions/repo/v1alpha1"
+)
+
+// Informers are the informers the controller needs in one watched namespace
+type Informers struct {
+	// Namespace watched by the informers, or AllNamespaces
+	Namespace string
+	Jobs      batchinformers.JobInformer
+	Repos     informers.RepoInformer
+	// Pods of the Terraform runners
+	Pods coreinformers.PodInformer
+}
@@ -0,0 +1,148 @@
+// Package multinamespace merges informers that each watch a single namespace,
+// so the controller can watch a set of namespaces without cluster-wide access.
+package multinamespace
+
+import (
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	batchlisters "k8s.io/client-go/listers/batch/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	repov1alpha1 "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
+	listers "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/generated/listers/repo/v1alpha1"
+)
+
+// AllNamespaces is the namespace of informers watching the whole cluster
+const AllNamespaces = ""
+
+// AllSynced combines the sync status of several informers
+func AllSynced(synced ...cache.InformerSynced) cache.InformerSynced {
+	return func() bool {
+		for _, hasSynced := range synced {
+			if !hasSynced() {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// emptyIndexer backs listers of namespaces that are not watched
+func emptyIndexer() cache.Indexer {
+	return cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+}
+
+// RepoLister lists Repos across the listers of several namespaces
+type RepoLister struct {
+	namespaces []string
+	listers    []listers.RepoLister
+}
+
+// NewRepoLister merges listers, each watching the namespace at the same index
+func NewRepoLister(namespaces []string, repoListers []listers.RepoLister) listers.RepoLister {
+	if len(repoListers) == 1 {
+		return repoListers[0]
+	}
+	return &RepoLister{namespaces: namespaces, listers: repoListers}
+}
+
+func (l *RepoLister) List(selector labels.Selector) ([]*repov1alpha1.Repo, error) {
+	var repos []*repov1alpha1.Repo
+	for _, lister := range l.listers {
+		items, err := lister.List(selector)
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, items...)
+	}
+	return repos, nil
+}
+
+func (l *RepoLister) Repos(namespace string) listers.RepoNamespaceLister {
+	for i, watched := range l.namespaces {
+		if watched == namespace || watched == AllNamespaces {
+			return l.listers[i].Repos(namespace)
+		}
+	}
+	return listers.NewRepoLister(emptyIndexer()).Repos(namespace)
+}
+
+// JobLister lists Jobs across the listers of several namespaces
+type JobLister struct {
+	namespaces []string
+	listers    []batchlisters.JobLister
+}
+
+// NewJobLister merges listers, each watching the namespace at the same index
+func NewJobLister(namespaces []string, jobListers []batchlisters.JobLister) batchlisters.JobLister {
+	if len(jobListers) == 1 {
+		return jobListers[0]
+	}
+	return &JobLister{namespaces: namespaces, listers: jobListers}
+}
+
+func (l *JobLister) List(selector labels.Selector) ([]*batchv1.Job, error) {
+	var jobs []*batchv1.Job
+	for _, lister := range l.listers {
+		items, err := lister.List(selector)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, items...)
+	}
+	return jobs, nil
+}
+
+func (l *JobLister) Jobs(namespace string) batchlisters.JobNamespaceLister {
+	return l.forNamespace(namespace).Jobs(namespace)
+}
+
+func (l *JobLister) GetPodJobs(pod *corev1.Pod) ([]batchv1.Job, error) {
+	return l.forNamespace(pod.Namespace).GetPodJobs(pod)
+}
+
+func (l *JobLister) forNamespace(namespace string) batchlisters.JobLister {
+	for i, watched := range l.namespaces {
+		if watched == namespace || watched == AllNamespaces {
+			return l.listers[i]
+		}
+	}
+	return batchlisters.NewJobLister(emptyIndexer())
+}
+
+// PodLister lists Pods across the listers of several namespaces
+type PodLister struct {
+	namespaces []string
+	listers    []corelisters.PodLister
+}
+
+// NewPodLister merges listers, each watching the namespace at the same index
+func NewPodLister(namespaces []string, podListers []corelisters.PodLister) corelisters.PodLister {
+	if len(podListers) == 1 {
+		return podListers[0]
+	}
+	return &PodLister{namespaces: namespaces, listers: podListers}
+}
+
+func (l *PodLister) List(selector labels.Selector) ([]*corev1.Pod, error) {
+	var pods []*corev1.Pod
+	for _, lister := range l.listers {
+		items, err := lister.List(selector)
+		if err != nil {
+			return nil, err
+		}
+		pods = append(pods, items...)
+	}
+	return pods, nil
+}
+
+func (l *PodLister) Pods(namespace string) corelisters.PodNamespaceLister {
+	for i, watched := range l.namespaces {
+		if watched == namespace || watched == AllNamespaces {
+			return l.listers[i].Pods(namespace)
+		}
+	}
+	return corelisters.NewPodLister(emptyIndexer()).Pods(namespace)
+}
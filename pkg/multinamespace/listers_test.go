@@ -0,0 +1,49 @@
+package multinamespace
+
+import (
+	"testing"
+
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	repov1alpha1 "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
+	listers "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/generated/listers/repo/v1alpha1"
+)
+
+func TestRepoListerMergesNamespaces(t *testing.T) {
+	payments := emptyIndexer()
+	payments.Add(newRepo("payments", "billing-infra"))
+	search := emptyIndexer()
+	search.Add(newRepo("search", "elasticsearch"))
+
+	lister := NewRepoLister([]string{"payments", "search"},
+		[]listers.RepoLister{listers.NewRepoLister(payments), listers.NewRepoLister(search)})
+
+	repos, err := lister.List(labels.Everything())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repos) != 2 {
+		t.Errorf("got %d repos; want 2", len(repos))
+	}
+
+	if _, err := lister.Repos("search").Get("elasticsearch"); err != nil {
+		t.Errorf("expected repo of a watched namespace to be found, got %v", err)
+	}
+	if _, err := lister.Repos("payments").Get("elasticsearch"); !kubeerrors.IsNotFound(err) {
+		t.Errorf("expected repo to only be found in its namespace, got %v", err)
+	}
+	if _, err := lister.Repos("default").Get("billing-infra"); !kubeerrors.IsNotFound(err) {
+		t.Errorf("expected repos of unwatched namespaces not to be found, got %v", err)
+	}
+}
+
+func newRepo(namespace, name string) *repov1alpha1.Repo {
+	return &repov1alpha1.Repo{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+	}
+}
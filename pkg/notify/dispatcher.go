@@ -0,0 +1,176 @@
+// Package notify sends the progress of the runs of Repos to the receivers
+// listed in their notifications spec: webhooks, Slack and CloudEvents.
+package notify
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	repov1alpha1 "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
+)
+
+const (
+	// Deliveries waiting beyond this are dropped rather than block the controller
+	queueSize      = 1000
+	defaultRetries = 3
+	requestTimeout = 10 * time.Second
+)
+
+type delivery struct {
+	namespace    string
+	notification repov1alpha1.NotificationSpec
+	event        Event
+}
+
+// Dispatcher delivers the notifications of Repos from a pool of workers, so
+// that slow or unreachable receivers never hold up the controller. Failed
+// deliveries are retried with an exponential backoff.
+type Dispatcher struct {
+	kubeclientset kubernetes.Interface
+	client        *http.Client
+	deliveries    chan delivery
+	// delay before the first retry, doubled for every retry after it
+	backoff time.Duration
+	now     func() time.Time
+}
+
+func NewDispatcher(kubeclientset kubernetes.Interface) *Dispatcher {
+	return &Dispatcher{
+		kubeclientset: kubeclientset,
+		client:        &http.Client{Timeout: requestTimeout},
+		deliveries:    make(chan delivery, queueSize),
+		backoff:       time.Second,
+		now:           time.Now,
+	}
+}
+
+// Notify queues an event for every receiver of the Repo interested in it
+func (dispatcher *Dispatcher) Notify(repo *repov1alpha1.Repo, eventType repov1alpha1.NotificationEvent) {
+	if len(repo.Spec.Notifications) == 0 {
+		return
+	}
+	event := NewEvent(repo, eventType, dispatcher.now())
+	for _, notification := range repo.Spec.Notifications {
+		if !wants(notification, eventType) {
+			continue
+		}
+		select {
+		case dispatcher.deliveries <- delivery{namespace: repo.Namespace, notification: notification, event: event}:
+		default:
+			klog.Warningf("Dropped %s notification of '%s/%s': too many notifications pending",
+				eventType, repo.Namespace, repo.Name)
+		}
+	}
+}
+
+// Run starts the delivery workers. It blocks until stopCh is closed, at which
+// point pending deliveries are dropped.
+func (dispatcher *Dispatcher) Run(workers int, stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+
+	klog.Infof("Starting %d notification workers", workers)
+	for i := 0; i < workers; i++ {
+		go dispatcher.runWorker(stopCh)
+	}
+	<-stopCh
+	klog.Info("Shutting down notification workers")
+}
+
+func (dispatcher *Dispatcher) runWorker(stopCh <-chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			return
+		case delivery := <-dispatcher.deliveries:
+			dispatcher.deliver(delivery, stopCh)
+		}
+	}
+}
+
+func (dispatcher *Dispatcher) deliver(delivery delivery, stopCh <-chan struct{}) {
+	retries := defaultRetries
+	if delivery.notification.Retries != nil {
+		retries = int(*delivery.notification.Retries)
+	}
+
+	backoff := dispatcher.backoff
+	for attempt := 0; ; attempt++ {
+		err := dispatcher.send(delivery)
+		if err == nil {
+			return
+		}
+		if attempt >= retries {
+			utilruntime.HandleError(errors.Wrapf(err, "sending %s notification of '%s/%s' failed after %d attempts",
+				delivery.event.Type, delivery.namespace, delivery.event.Repo, attempt+1))
+			return
+		}
+		klog.V(4).Infof("Retrying %s notification of '%s/%s' in %s: %v",
+			delivery.event.Type, delivery.namespace, delivery.event.Repo, backoff, err)
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// send posts an event once. The URL is read on every attempt, so a Secret
+// fixed in the meantime is used by the next retry.
+func (dispatcher *Dispatcher) send(delivery delivery) error {
+	sink, found := Sinks[delivery.notification.Type]
+	if !found {
+		return errors.Errorf("unknown notification type %q", delivery.notification.Type)
+	}
+	url, err := dispatcher.url(delivery.namespace, delivery.notification)
+	if err != nil {
+		return err
+	}
+	request, err := sink.NewRequest(url, delivery.event)
+	if err != nil {
+		return err
+	}
+
+	response, err := dispatcher.client.Do(request)
+	if err != nil {
+		// the URL may embed a token, and is not worth logging
+		return errors.Errorf("posting %s notification failed", delivery.notification.Type)
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return errors.Errorf("%s receiver answered %s", delivery.notification.Type, response.Status)
+	}
+	return nil
+}
+
+func (dispatcher *Dispatcher) url(namespace string, notification repov1alpha1.NotificationSpec) (string, error) {
+	ref := notification.URLSecretRef
+	secret, err := dispatcher.kubeclientset.CoreV1().Secrets(namespace).Get(ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "reading notification URL from secret %v/%v failed", namespace, ref.Name)
+	}
+	url, found := secret.Data[ref.Key]
+	if !found {
+		return "", errors.Errorf("secret %v/%v has no key %q", namespace, ref.Name, ref.Key)
+	}
+	return strings.TrimSpace(string(url)), nil
+}
+
+func wants(notification repov1alpha1.NotificationSpec, eventType repov1alpha1.NotificationEvent) bool {
+	if len(notification.Events) == 0 {
+		return true
+	}
+	for _, wanted := range notification.Events {
+		if wanted == eventType {
+			return true
+		}
+	}
+	return false
+}
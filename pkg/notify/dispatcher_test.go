@@ -0,0 +1,281 @@
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	repov1alpha1 "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
+)
+
+var eventTime = time.Date(2020, 2, 14, 9, 30, 0, 0, time.UTC)
+
+// receiver records the requests it is sent, failing the first ones
+type receiver struct {
+	sync.Mutex
+	failures    int
+	contentType string
+	bodies      [][]byte
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.Lock()
+	defer r.Unlock()
+	if r.failures > 0 {
+		r.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	r.contentType = req.Header.Get("Content-Type")
+	r.bodies = append(r.bodies, body)
+}
+
+func (r *receiver) received() [][]byte {
+	r.Lock()
+	defer r.Unlock()
+	return r.bodies
+}
+
+func newRepo(notifications ...repov1alpha1.NotificationSpec) *repov1alpha1.Repo {
+	return &repov1alpha1.Repo{
+		ObjectMeta: metav1.ObjectMeta{Name: "infra", Namespace: "payments"},
+		Spec:       repov1alpha1.RepoSpec{Notifications: notifications},
+		Status: repov1alpha1.RepoStatus{
+			GitSHA:     "f7b877701fbf855b44c0a9e86f3fdce2c298b07f",
+			RunJobName: "terraform-run-f7b8777",
+			RunStatus:  "Failed",
+			Commit:     &repov1alpha1.CommitInfo{Author: "Jane Doe", Subject: "Add logs bucket"},
+			Failure:    &repov1alpha1.RunFailure{Step: "apply", Reason: "Error: AccessDenied"},
+			Result: &repov1alpha1.RunResult{
+				Plan: &repov1alpha1.PlanSummary{
+					Add:     1,
+					Changes: []repov1alpha1.PlanChange{{Address: "aws_s3_bucket.logs", Action: "create"}},
+				},
+			},
+		},
+	}
+}
+
+func newNotification(notificationType repov1alpha1.NotificationType, events ...repov1alpha1.NotificationEvent) repov1alpha1.NotificationSpec {
+	retries := int32(2)
+	return repov1alpha1.NotificationSpec{
+		Type: notificationType,
+		URLSecretRef: corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "notifications"},
+			Key:                  "url",
+		},
+		Events:  events,
+		Retries: &retries,
+	}
+}
+
+func newDispatcher(url string) *Dispatcher {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "notifications", Namespace: "payments"},
+		Data:       map[string][]byte{"url": []byte(url + "\n")},
+	}
+	dispatcher := NewDispatcher(fake.NewSimpleClientset(secret))
+	dispatcher.backoff = time.Millisecond
+	dispatcher.now = func() time.Time { return eventTime }
+	return dispatcher
+}
+
+// drain delivers the queued notifications
+func drain(dispatcher *Dispatcher) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	for {
+		select {
+		case delivery := <-dispatcher.deliveries:
+			dispatcher.deliver(delivery, stopCh)
+		default:
+			return
+		}
+	}
+}
+
+func TestPostsWebhookEvent(t *testing.T) {
+	receiver := &receiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	dispatcher := newDispatcher(server.URL)
+
+	dispatcher.Notify(newRepo(newNotification(repov1alpha1.WebhookNotification)), repov1alpha1.RunFailed)
+	drain(dispatcher)
+
+	bodies := receiver.received()
+	if len(bodies) != 1 {
+		t.Fatalf("got %d requests; want 1", len(bodies))
+	}
+	var event Event
+	if err := json.Unmarshal(bodies[0], &event); err != nil {
+		t.Fatal(err)
+	}
+	if receiver.contentType != "application/json" {
+		t.Errorf("got content type %q", receiver.contentType)
+	}
+	if event.Type != repov1alpha1.RunFailed || event.Repo != "infra" || !event.Time.Equal(eventTime) {
+		t.Errorf("got event %+v", event)
+	}
+	expected := "payments/infra: run of revision f7b8777 failed at step apply: Error: AccessDenied"
+	if event.Message != expected {
+		t.Errorf("got message %q; want %q", event.Message, expected)
+	}
+	if event.Plan == nil || event.Plan.Add != 1 || event.Plan.Changes != nil {
+		t.Errorf("got plan %+v; want the counts only", event.Plan)
+	}
+}
+
+func TestPostsSlackMessage(t *testing.T) {
+	receiver := &receiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	dispatcher := newDispatcher(server.URL)
+
+	dispatcher.Notify(newRepo(newNotification(repov1alpha1.SlackNotification)), repov1alpha1.RevisionDetected)
+	drain(dispatcher)
+
+	bodies := receiver.received()
+	if len(bodies) != 1 {
+		t.Fatalf("got %d requests; want 1", len(bodies))
+	}
+	expected := `{"text":":information_source: payments/infra: new revision f7b8777 by Jane Doe: Add logs bucket"}`
+	if string(bodies[0]) != expected {
+		t.Errorf("got %s; want %s", bodies[0], expected)
+	}
+}
+
+func TestPostsPullRequestPlanEvent(t *testing.T) {
+	receiver := &receiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	dispatcher := newDispatcher(server.URL)
+	repo := newRepo(newNotification(repov1alpha1.WebhookNotification))
+	repo.Status.GitSHA = "0a1b2c3d4e5f67890a1b2c3d4e5f67890a1b2c3d"
+	repo.Status.RunStatus = "Completed"
+	repo.Status.Failure = nil
+	repo.Status.PullRequests = []repov1alpha1.PullRequestRun{{Number: 42, GitSHA: repo.Status.GitSHA}}
+
+	dispatcher.Notify(repo, repov1alpha1.PullRequestPlanned)
+	drain(dispatcher)
+
+	bodies := receiver.received()
+	if len(bodies) != 1 {
+		t.Fatalf("got %d requests; want 1", len(bodies))
+	}
+	var event Event
+	if err := json.Unmarshal(bodies[0], &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.PullRequest != 42 {
+		t.Errorf("got pull request %d; want 42", event.PullRequest)
+	}
+	expected := "payments/infra: pull request #42 at 0a1b2c3 plans to add 1, change 0 and destroy 0 resources"
+	if event.Message != expected {
+		t.Errorf("got message %q; want %q", event.Message, expected)
+	}
+}
+
+func TestPostsCloudEvent(t *testing.T) {
+	receiver := &receiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	dispatcher := newDispatcher(server.URL)
+
+	dispatcher.Notify(newRepo(newNotification(repov1alpha1.CloudEventsNotification)), repov1alpha1.PlanReady)
+	drain(dispatcher)
+
+	bodies := receiver.received()
+	if len(bodies) != 1 {
+		t.Fatalf("got %d requests; want 1", len(bodies))
+	}
+	var event cloudEvent
+	if err := json.Unmarshal(bodies[0], &event); err != nil {
+		t.Fatal(err)
+	}
+	if receiver.contentType != "application/cloudevents+json" {
+		t.Errorf("got content type %q", receiver.contentType)
+	}
+	if event.SpecVersion != "1.0" || event.Type != "terraform.gitops.k8s.io.planready" ||
+		event.Source != "/apis/terraform.gitops.k8s.io/v1alpha1/namespaces/payments/repos/infra" ||
+		event.Subject != "f7b877701fbf855b44c0a9e86f3fdce2c298b07f" {
+		t.Errorf("got cloud event %+v", event)
+	}
+	if event.Data.Type != repov1alpha1.PlanReady {
+		t.Errorf("got data %+v", event.Data)
+	}
+}
+
+func TestRetriesFailedDeliveries(t *testing.T) {
+	receiver := &receiver{failures: 2}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	dispatcher := newDispatcher(server.URL)
+
+	dispatcher.Notify(newRepo(newNotification(repov1alpha1.WebhookNotification)), repov1alpha1.RunFailed)
+	drain(dispatcher)
+
+	if bodies := receiver.received(); len(bodies) != 1 {
+		t.Errorf("got %d deliveries; want 1 after 2 retries", len(bodies))
+	}
+}
+
+func TestGivesUpAfterRetries(t *testing.T) {
+	receiver := &receiver{failures: 3}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	dispatcher := newDispatcher(server.URL)
+
+	dispatcher.Notify(newRepo(newNotification(repov1alpha1.WebhookNotification)), repov1alpha1.RunFailed)
+	drain(dispatcher)
+
+	if bodies := receiver.received(); len(bodies) != 0 {
+		t.Errorf("got %d deliveries; want none", len(bodies))
+	}
+	if receiver.failures != 0 {
+		t.Errorf("got %d attempts; want 3", 3-receiver.failures)
+	}
+}
+
+func TestNotifiesSubscribedEventsOnly(t *testing.T) {
+	receiver := &receiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	dispatcher := newDispatcher(server.URL)
+	repo := newRepo(newNotification(repov1alpha1.WebhookNotification, repov1alpha1.RunSucceeded, repov1alpha1.RunFailed))
+
+	dispatcher.Notify(repo, repov1alpha1.RunStarted)
+	dispatcher.Notify(repo, repov1alpha1.RunFailed)
+	drain(dispatcher)
+
+	bodies := receiver.received()
+	if len(bodies) != 1 {
+		t.Fatalf("got %d requests; want 1", len(bodies))
+	}
+	var event Event
+	if err := json.Unmarshal(bodies[0], &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != repov1alpha1.RunFailed {
+		t.Errorf("got event %s; want RunFailed", event.Type)
+	}
+}
+
+func TestFailsWithoutURLSecret(t *testing.T) {
+	dispatcher := NewDispatcher(fake.NewSimpleClientset())
+	notification := newNotification(repov1alpha1.WebhookNotification)
+
+	err := dispatcher.send(delivery{namespace: "payments", notification: notification, event: Event{Type: repov1alpha1.RunFailed}})
+	if err == nil {
+		t.Error("got no error; want the missing secret reported")
+	}
+}
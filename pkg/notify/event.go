@@ -0,0 +1,114 @@
+package notify
+
+import (
+	"fmt"
+	"time"
+
+	repov1alpha1 "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
+)
+
+// Event is a notification of the progress of the runs of a Repo
+type Event struct {
+	Type       repov1alpha1.NotificationEvent `json:"type"`
+	Namespace  string                         `json:"namespace"`
+	Repo       string                         `json:"repo"`
+	GitSHA     string                         `json:"gitSHA"`
+	RunJobName string                         `json:"runJobName"`
+	RunStatus  string                         `json:"runStatus"`
+	Time       time.Time                      `json:"time"`
+	// Message describes the event in a sentence
+	Message string                      `json:"message"`
+	Commit  *repov1alpha1.CommitInfo    `json:"commit,omitempty"`
+	Plan    *repov1alpha1.PlanSummary   `json:"plan,omitempty"`
+	Policy  *repov1alpha1.PolicyOutcome `json:"policy,omitempty"`
+	Failure *repov1alpha1.RunFailure    `json:"failure,omitempty"`
+	// PullRequest is the number of the pull request whose head is planned
+	PullRequest int32 `json:"pullRequest,omitempty"`
+}
+
+// NewEvent describes the state of a Repo at the time of an event
+func NewEvent(repo *repov1alpha1.Repo, eventType repov1alpha1.NotificationEvent, now time.Time) Event {
+	event := Event{
+		Type:       eventType,
+		Namespace:  repo.Namespace,
+		Repo:       repo.Name,
+		GitSHA:     repo.Status.GitSHA,
+		RunJobName: repo.Status.RunJobName,
+		RunStatus:  repo.Status.RunStatus,
+		Time:       now.UTC(),
+		Commit:     repo.Status.Commit,
+		Failure:    repo.Status.Failure,
+	}
+	if result := repo.Status.Result; result != nil && result.Plan != nil {
+		// the changes are left out, as a plan may change many resources
+		event.Plan = result.Plan.DeepCopy()
+		event.Plan.Changes = nil
+	}
+	if result := repo.Status.Result; result != nil {
+		event.Policy = result.Policy
+	}
+	// the status of the plan run of a pull request lists the pull request alone
+	if runs := repo.Status.PullRequests; len(runs) == 1 && isPullRequestEvent(eventType) {
+		event.PullRequest = runs[0].Number
+	}
+	event.Message = message(event)
+	return event
+}
+
+func message(event Event) string {
+	revision := event.GitSHA
+	if len(revision) > 7 {
+		revision = revision[:7]
+	}
+	prefix := fmt.Sprintf("%s/%s", event.Namespace, event.Repo)
+	switch event.Type {
+	case repov1alpha1.RevisionDetected:
+		if event.Commit != nil {
+			return fmt.Sprintf("%s: new revision %s by %s: %s", prefix, revision, event.Commit.Author, event.Commit.Subject)
+		}
+		return fmt.Sprintf("%s: new revision %s", prefix, revision)
+	case repov1alpha1.RunStarted:
+		return fmt.Sprintf("%s: run %s of revision %s started", prefix, event.RunJobName, revision)
+	case repov1alpha1.PlanReady:
+		if event.Plan != nil {
+			return fmt.Sprintf("%s: revision %s plans to add %d, change %d and destroy %d resources",
+				prefix, revision, event.Plan.Add, event.Plan.Change, event.Plan.Destroy)
+		}
+		return fmt.Sprintf("%s: plan of revision %s is ready", prefix, revision)
+	case repov1alpha1.AwaitingApproval:
+		return fmt.Sprintf("%s: revision %s is awaiting approval", prefix, revision)
+	case repov1alpha1.RunSucceeded:
+		return fmt.Sprintf("%s: revision %s was applied", prefix, revision)
+	case repov1alpha1.PullRequestPlanStarted:
+		return fmt.Sprintf("%s: plan %s of pull request #%d started", prefix, event.RunJobName, event.PullRequest)
+	case repov1alpha1.PullRequestPlanned:
+		if event.Plan != nil {
+			return fmt.Sprintf("%s: pull request #%d at %s plans to add %d, change %d and destroy %d resources",
+				prefix, event.PullRequest, revision, event.Plan.Add, event.Plan.Change, event.Plan.Destroy)
+		}
+		return fmt.Sprintf("%s: plan of pull request #%d at %s is ready", prefix, event.PullRequest, revision)
+	case repov1alpha1.PullRequestPlanFailed:
+		if event.Failure != nil && event.Failure.Step != "" {
+			return fmt.Sprintf("%s: plan of pull request #%d at %s failed at step %s: %s",
+				prefix, event.PullRequest, revision, event.Failure.Step, event.Failure.Reason)
+		}
+		return fmt.Sprintf("%s: plan of pull request #%d at %s failed", prefix, event.PullRequest, revision)
+	case repov1alpha1.RunFailed:
+		if event.Failure != nil && event.Failure.Step != "" {
+			return fmt.Sprintf("%s: run of revision %s failed at step %s: %s", prefix, revision, event.Failure.Step, event.Failure.Reason)
+		}
+		if event.Failure != nil {
+			return fmt.Sprintf("%s: run of revision %s failed: %s", prefix, revision, event.Failure.Reason)
+		}
+		return fmt.Sprintf("%s: run of revision %s failed", prefix, revision)
+	}
+	return fmt.Sprintf("%s: %s", prefix, event.Type)
+}
+
+func isPullRequestEvent(eventType repov1alpha1.NotificationEvent) bool {
+	switch eventType {
+	case repov1alpha1.PullRequestPlanStarted, repov1alpha1.PullRequestPlanned, repov1alpha1.PullRequestPlanFailed:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	repov1alpha1 "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
+)
+
+// Sink formats events for a type of receiver
+type Sink interface {
+	NewRequest(url string, event Event) (*http.Request, error)
+}
+
+// Sinks are the sinks of the notification types
+var Sinks = map[repov1alpha1.NotificationType]Sink{
+	repov1alpha1.WebhookNotification:     WebhookSink{},
+	repov1alpha1.SlackNotification:       SlackSink{},
+	repov1alpha1.CloudEventsNotification: CloudEventsSink{},
+}
+
+// WebhookSink posts events as JSON
+type WebhookSink struct{}
+
+func (WebhookSink) NewRequest(url string, event Event) (*http.Request, error) {
+	return newJSONRequest(url, "application/json", event)
+}
+
+// SlackSink posts the message of events to a Slack incoming webhook, or any
+// receiver accepting the same payload
+type SlackSink struct{}
+
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+func (SlackSink) NewRequest(url string, event Event) (*http.Request, error) {
+	icon := ":information_source:"
+	switch event.Type {
+	case repov1alpha1.RunSucceeded, repov1alpha1.PullRequestPlanned:
+		icon = ":white_check_mark:"
+	case repov1alpha1.RunFailed, repov1alpha1.PullRequestPlanFailed:
+		icon = ":x:"
+	case repov1alpha1.AwaitingApproval:
+		icon = ":raised_hand:"
+	}
+	return newJSONRequest(url, "application/json", slackMessage{Text: icon + " " + event.Message})
+}
+
+// CloudEventsSink posts events as CloudEvents 1.0 in structured mode
+type CloudEventsSink struct{}
+
+type cloudEvent struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Subject         string    `json:"subject,omitempty"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	Data            Event     `json:"data"`
+}
+
+func (CloudEventsSink) NewRequest(url string, event Event) (*http.Request, error) {
+	group := repov1alpha1.SchemeGroupVersion.Group
+	return newJSONRequest(url, "application/cloudevents+json", cloudEvent{
+		SpecVersion: "1.0",
+		// retries of an event keep its id, for receivers to drop duplicates
+		ID:              fmt.Sprintf("%s/%s/%s/%s/%d", event.Namespace, event.Repo, event.RunJobName, event.Type, event.Time.UnixNano()),
+		Source:          fmt.Sprintf("/apis/%s/namespaces/%s/repos/%s", repov1alpha1.SchemeGroupVersion, event.Namespace, event.Repo),
+		Type:            group + "." + strings.ToLower(string(event.Type)),
+		Subject:         event.GitSHA,
+		Time:            event.Time,
+		DataContentType: "application/json",
+		Data:            event,
+	})
+}
+
+func newJSONRequest(url string, contentType string, payload interface{}) (*http.Request, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", contentType)
+	return request, nil
+}
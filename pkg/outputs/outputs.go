@@ -0,0 +1,183 @@
+// Package outputs publishes the Terraform outputs of a run. The runner stages
+// the output of terraform output -json in a Secret, which the controller
+// splits into a ConfigMap for plain outputs and a Secret for sensitive ones.
+package outputs
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	repov1alpha1 "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
+)
+
+// Key of the output of terraform output -json in the staging Secret
+const stagingKey = "outputs.json"
+
+// StagingSecretName is the name of the Secret the runner of a Job stages its outputs in
+func StagingSecretName(jobName string) string {
+	return jobName + "-outputs"
+}
+
+// NewStagingSecret holds the output of terraform output -json for the
+// controller to publish. It is owned by the runner pod, so it is deleted
+// along with the Job even if it is never published.
+func NewStagingSecret(name string, namespace string, owner metav1.OwnerReference, outputsJSON []byte) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       namespace,
+			OwnerReferences: []metav1.OwnerReference{owner},
+		},
+		Data: map[string][]byte{stagingKey: outputsJSON},
+	}
+}
+
+// An output as listed by terraform output -json
+type output struct {
+	Sensitive bool            `json:"sensitive"`
+	Value     json.RawMessage `json:"value"`
+}
+
+// Split reads the output of terraform output -json into plain and sensitive
+// outputs. String values are kept as is, other values as compact JSON.
+func Split(outputsJSON []byte) (map[string]string, map[string]string, error) {
+	var outputs map[string]output
+	if err := json.Unmarshal(outputsJSON, &outputs); err != nil {
+		return nil, nil, errors.Wrap(err, "reading outputs")
+	}
+
+	plain, sensitive := make(map[string]string), make(map[string]string)
+	for name, output := range outputs {
+		var value string
+		if err := json.Unmarshal(output.Value, &value); err != nil {
+			var compact bytes.Buffer
+			if err := json.Compact(&compact, output.Value); err != nil {
+				return nil, nil, errors.Wrapf(err, "reading output %s", name)
+			}
+			value = compact.String()
+		}
+		if output.Sensitive {
+			sensitive[name] = value
+		} else {
+			plain[name] = value
+		}
+	}
+	return plain, sensitive, nil
+}
+
+// Publisher writes the outputs of the runs of Repos to the objects named by
+// their outputs spec
+type Publisher struct {
+	kubeclientset kubernetes.Interface
+}
+
+func NewPublisher(kubeclientset kubernetes.Interface) *Publisher {
+	return &Publisher{kubeclientset: kubeclientset}
+}
+
+// Published counts the outputs written to the ConfigMap and the Secret of a Repo
+type Published struct {
+	Plain     int
+	Sensitive int
+}
+
+// Publish writes the outputs staged by the runner of a Job. The ConfigMap and
+// the Secret are owned by the Repo, and objects of the same name not owned by
+// the Repo are left untouched. The staging Secret is kept, for the outputs to
+// be published again until they are recorded as published.
+func (publisher *Publisher) Publish(repo *repov1alpha1.Repo, jobName string) (Published, error) {
+	spec := repo.Spec.Outputs
+	secrets := publisher.kubeclientset.CoreV1().Secrets(repo.Namespace)
+	staging, err := secrets.Get(StagingSecretName(jobName), metav1.GetOptions{})
+	if err != nil {
+		return Published{}, errors.Wrapf(err, "reading outputs staged by %s", jobName)
+	}
+	plain, sensitive, err := Split(staging.Data[stagingKey])
+	if err != nil {
+		return Published{}, err
+	}
+
+	var published Published
+	if spec.ConfigMapName != "" {
+		if err := publisher.writeConfigMap(repo, spec.ConfigMapName, plain); err != nil {
+			return published, err
+		}
+		published.Plain = len(plain)
+	}
+	if spec.SecretName != "" {
+		if err := publisher.writeSecret(repo, spec.SecretName, sensitive); err != nil {
+			return published, err
+		}
+		published.Sensitive = len(sensitive)
+	}
+	return published, nil
+}
+
+// DeleteStaged deletes the outputs staged by the runner of a Job, once published
+func (publisher *Publisher) DeleteStaged(repo *repov1alpha1.Repo, jobName string) error {
+	err := publisher.kubeclientset.CoreV1().Secrets(repo.Namespace).Delete(StagingSecretName(jobName), &metav1.DeleteOptions{})
+	if err != nil && !kubeerrors.IsNotFound(err) {
+		return errors.Wrapf(err, "deleting outputs staged by %s", jobName)
+	}
+	return nil
+}
+
+func (publisher *Publisher) writeConfigMap(repo *repov1alpha1.Repo, name string, data map[string]string) error {
+	configMaps := publisher.kubeclientset.CoreV1().ConfigMaps(repo.Namespace)
+	configMap, err := configMaps.Get(name, metav1.GetOptions{})
+	if kubeerrors.IsNotFound(err) {
+		configMap = &corev1.ConfigMap{ObjectMeta: newObjectMeta(repo, name), Data: data}
+		_, err = configMaps.Create(configMap)
+		return errors.Wrapf(err, "creating ConfigMap %s", name)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "reading ConfigMap %s", name)
+	}
+	if !metav1.IsControlledBy(configMap, repo) {
+		return errors.Errorf("ConfigMap %s already exists and is not managed by Repo", name)
+	}
+	configMap = configMap.DeepCopy()
+	configMap.Data = data
+	_, err = configMaps.Update(configMap)
+	return errors.Wrapf(err, "updating ConfigMap %s", name)
+}
+
+func (publisher *Publisher) writeSecret(repo *repov1alpha1.Repo, name string, values map[string]string) error {
+	data := make(map[string][]byte, len(values))
+	for key, value := range values {
+		data[key] = []byte(value)
+	}
+	secrets := publisher.kubeclientset.CoreV1().Secrets(repo.Namespace)
+	secret, err := secrets.Get(name, metav1.GetOptions{})
+	if kubeerrors.IsNotFound(err) {
+		secret = &corev1.Secret{ObjectMeta: newObjectMeta(repo, name), Data: data}
+		_, err = secrets.Create(secret)
+		return errors.Wrapf(err, "creating Secret %s", name)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "reading Secret %s", name)
+	}
+	if !metav1.IsControlledBy(secret, repo) {
+		return errors.Errorf("Secret %s already exists and is not managed by Repo", name)
+	}
+	secret = secret.DeepCopy()
+	secret.Data = data
+	_, err = secrets.Update(secret)
+	return errors.Wrapf(err, "updating Secret %s", name)
+}
+
+func newObjectMeta(repo *repov1alpha1.Repo, name string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:      name,
+		Namespace: repo.Namespace,
+		OwnerReferences: []metav1.OwnerReference{
+			*metav1.NewControllerRef(repo, repov1alpha1.SchemeGroupVersion.WithKind("Repo")),
+		},
+	}
+}
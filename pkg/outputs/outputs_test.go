@@ -0,0 +1,131 @@
+package outputs
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+
+	repov1alpha1 "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
+)
+
+const outputsJSON = `{
+  "bucket_name": {"sensitive": false, "type": "string", "value": "acme-logs"},
+  "db_endpoint": {"sensitive": false, "type": "string", "value": "db.internal:5432"},
+  "db_password": {"sensitive": true, "type": "string", "value": "hunter2"},
+  "subnet_ids": {"sensitive": false, "type": ["list", "string"], "value": ["subnet-a", "subnet-b"]}
+}`
+
+func newRepo() *repov1alpha1.Repo {
+	return &repov1alpha1.Repo{
+		ObjectMeta: metav1.ObjectMeta{Name: "infra", Namespace: "payments", UID: "7d6b2c1e"},
+		Spec: repov1alpha1.RepoSpec{
+			Outputs: &repov1alpha1.OutputsSpec{ConfigMapName: "infra-outputs", SecretName: "infra-secrets"},
+		},
+	}
+}
+
+func newStagingSecret(jobName string) *corev1.Secret {
+	owner := metav1.OwnerReference{APIVersion: "v1", Kind: "Pod", Name: jobName + "-x7k2p", UID: "5f1c"}
+	return NewStagingSecret(StagingSecretName(jobName), "payments", owner, []byte(outputsJSON))
+}
+
+func TestSplitsOutputs(t *testing.T) {
+	plain, sensitive, err := Split([]byte(outputsJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedPlain := map[string]string{
+		"bucket_name": "acme-logs",
+		"db_endpoint": "db.internal:5432",
+		"subnet_ids":  `["subnet-a","subnet-b"]`,
+	}
+	if !reflect.DeepEqual(plain, expectedPlain) {
+		t.Errorf("got plain outputs %v; want %v", plain, expectedPlain)
+	}
+	if !reflect.DeepEqual(sensitive, map[string]string{"db_password": "hunter2"}) {
+		t.Errorf("got sensitive outputs %v", sensitive)
+	}
+}
+
+func TestPublishesOutputs(t *testing.T) {
+	repo := newRepo()
+	client := fake.NewSimpleClientset(newStagingSecret("terraform-run-f7b8777"))
+
+	published, err := NewPublisher(client).Publish(repo, "terraform-run-f7b8777")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if published != (Published{Plain: 3, Sensitive: 1}) {
+		t.Errorf("got %+v", published)
+	}
+
+	configMap, err := client.CoreV1().ConfigMaps("payments").Get("infra-outputs", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configMap.Data["db_endpoint"] != "db.internal:5432" || !metav1.IsControlledBy(configMap, repo) {
+		t.Errorf("got ConfigMap %+v", configMap)
+	}
+	secret, err := client.CoreV1().Secrets("payments").Get("infra-secrets", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Data["db_password"]) != "hunter2" || len(secret.Data) != 1 || !metav1.IsControlledBy(secret, repo) {
+		t.Errorf("got Secret %+v", secret)
+	}
+	if _, err := client.CoreV1().Secrets("payments").Get("terraform-run-f7b8777-outputs", metav1.GetOptions{}); err != nil {
+		t.Errorf("expected the staging Secret to be kept until the outputs are recorded as published: %v", err)
+	}
+
+	if err := NewPublisher(client).DeleteStaged(repo, "terraform-run-f7b8777"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CoreV1().Secrets("payments").Get("terraform-run-f7b8777-outputs", metav1.GetOptions{}); err == nil {
+		t.Error("expected the staging Secret to be deleted")
+	}
+}
+
+func TestReplacesPublishedOutputs(t *testing.T) {
+	repo := newRepo()
+	stale := &corev1.ConfigMap{ObjectMeta: newObjectMeta(repo, "infra-outputs"), Data: map[string]string{"removed": "x"}}
+	client := fake.NewSimpleClientset(newStagingSecret("terraform-run-f7b8777"), stale)
+
+	if _, err := NewPublisher(client).Publish(repo, "terraform-run-f7b8777"); err != nil {
+		t.Fatal(err)
+	}
+
+	configMap, _ := client.CoreV1().ConfigMaps("payments").Get("infra-outputs", metav1.GetOptions{})
+	if _, found := configMap.Data["removed"]; found || len(configMap.Data) != 3 {
+		t.Errorf("got ConfigMap data %v", configMap.Data)
+	}
+}
+
+func TestLeavesObjectsNotOwnedByRepo(t *testing.T) {
+	repo := newRepo()
+	tests := map[string]runtime.Object{
+		"ConfigMap": &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "infra-outputs", Namespace: "payments"}},
+		"Secret":    &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "infra-secrets", Namespace: "payments"}},
+	}
+	for kind, existing := range tests {
+		t.Run(kind, func(t *testing.T) {
+			client := fake.NewSimpleClientset(newStagingSecret("terraform-run-f7b8777"), existing)
+
+			if _, err := NewPublisher(client).Publish(repo, "terraform-run-f7b8777"); err == nil {
+				t.Errorf("expected %s not owned by the Repo to be left untouched", kind)
+			}
+		})
+	}
+}
+
+func TestFailsWithoutStagedOutputs(t *testing.T) {
+	client := fake.NewSimpleClientset()
+
+	if _, err := NewPublisher(client).Publish(newRepo(), "terraform-run-f7b8777"); err == nil {
+		t.Error("expected an error when the runner staged no outputs")
+	}
+}
@@ -0,0 +1,126 @@
+// Package policy decides whether the plan of a run may be applied, given the
+// plan policy of its Repo.
+package policy
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	batchv1 "k8s.io/api/batch/v1"
+
+	repov1alpha1 "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
+	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/runresult"
+)
+
+const (
+	// Env passes the plan policy of a Repo to its runner, as JSON
+	Env = "PLAN_POLICY"
+	// ApprovedEnv passes the plan approved for the revision the runner runs,
+	// as JSON. It is empty unless the revision is approved.
+	ApprovedEnv = "PLAN_APPROVED"
+)
+
+// Enforced tells if the runner of a Job was given a plan policy, in which
+// case it must report the decision of the policy in its result
+func Enforced(job *batchv1.Job) bool {
+	for _, container := range job.Spec.Template.Spec.Containers {
+		for _, variable := range container.Env {
+			if variable.Name == Env && variable.Value != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Evaluate checks a plan against a policy. Rules denying a plan always apply,
+// while the rules holding a plan for approval are waived for the approved
+// plan only: a plan of the approved revision that differs from it is denied,
+// as it is not what was approved. Plans breaking no rule are allowed.
+func Evaluate(policy *repov1alpha1.PlanPolicy, plan *runresult.PlanSummary, approved *repov1alpha1.PlanSummary) runresult.PolicyOutcome {
+	if policy == nil {
+		return runresult.PolicyOutcome{Decision: string(repov1alpha1.PolicyAllowed)}
+	}
+
+	var denied, held []string
+	if destroyed := destroyedOfTypes(plan, policy.DenyDestroyTypes); len(destroyed) != 0 {
+		denied = append(denied, fmt.Sprintf("destroys %s, whose types must not be destroyed", listAddresses(destroyed)))
+	}
+	if changes := len(plan.Changes); policy.MaxChanges != 0 && changes > int(policy.MaxChanges) {
+		denied = append(denied, fmt.Sprintf("changes %d resources, more than the %d allowed", changes, policy.MaxChanges))
+	}
+	if policy.RequireApprovalOnDestroy && plan.Destroy != 0 {
+		held = append(held, fmt.Sprintf("destroys %d resources", plan.Destroy))
+	}
+	if policy.AutoApplyAdditiveOnly && (plan.Change != 0 || plan.Destroy != 0) {
+		held = append(held, fmt.Sprintf("changes %d and destroys %d resources, only additions are applied without approval",
+			plan.Change, plan.Destroy))
+	}
+
+	if len(held) != 0 && approved != nil && !IsApprovedPlan(approved, plan) {
+		denied = append(denied, fmt.Sprintf("differs from the approved plan, which adds %d, changes %d and destroys %d resources",
+			approved.Add, approved.Change, approved.Destroy))
+	}
+
+	switch {
+	case len(denied) != 0:
+		return runresult.PolicyOutcome{Decision: string(repov1alpha1.PolicyDenied), Violations: denied}
+	case len(held) != 0 && approved == nil:
+		return runresult.PolicyOutcome{Decision: string(repov1alpha1.PolicyApprovalRequired), Violations: held}
+	}
+	return runresult.PolicyOutcome{Decision: string(repov1alpha1.PolicyAllowed)}
+}
+
+// IsApprovedPlan tells if a plan makes the changes of the approved plan. The
+// resources changed are compared when the approved plan lists them, large
+// plans are compared by their counts only.
+func IsApprovedPlan(approved *repov1alpha1.PlanSummary, plan *runresult.PlanSummary) bool {
+	if int(approved.Add) != plan.Add || int(approved.Change) != plan.Change ||
+		int(approved.Destroy) != plan.Destroy || int(approved.Replace) != plan.Replace {
+		return false
+	}
+	if len(approved.Changes) == 0 {
+		return true
+	}
+	approvedChanges := make([]string, 0, len(approved.Changes))
+	for _, change := range approved.Changes {
+		approvedChanges = append(approvedChanges, change.Action+" "+change.Address)
+	}
+	changes := make([]string, 0, len(plan.Changes))
+	for _, change := range plan.Changes {
+		changes = append(changes, change.Action+" "+change.Address)
+	}
+	sort.Strings(approvedChanges)
+	sort.Strings(changes)
+	return reflect.DeepEqual(approvedChanges, changes)
+}
+
+// Most addresses a violation lists, the plan has the others
+const maxListedAddresses = 10
+
+// listAddresses lists the first addresses of resources, counting the others
+func listAddresses(addresses []string) string {
+	if len(addresses) <= maxListedAddresses {
+		return fmt.Sprintf("%v", addresses)
+	}
+	return fmt.Sprintf("%v and %d more", addresses[:maxListedAddresses], len(addresses)-maxListedAddresses)
+}
+
+// destroyedOfTypes returns the addresses of the resources of the given types
+// destroyed or replaced by a plan
+func destroyedOfTypes(plan *runresult.PlanSummary, types []string) []string {
+	var destroyed []string
+	for _, change := range plan.Changes {
+		if change.Action != runresult.ActionDelete && change.Action != runresult.ActionReplace {
+			continue
+		}
+		for _, resourceType := range types {
+			if change.Type == resourceType {
+				destroyed = append(destroyed, change.Address)
+			}
+		}
+	}
+	sort.Strings(destroyed)
+	return destroyed
+}
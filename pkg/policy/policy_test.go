@@ -0,0 +1,149 @@
+package policy
+
+import (
+	"reflect"
+	"testing"
+
+	repov1alpha1 "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
+	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/runresult"
+)
+
+func newPlan(changes ...runresult.PlanChange) *runresult.PlanSummary {
+	plan := &runresult.PlanSummary{Changes: changes}
+	for _, change := range changes {
+		switch change.Action {
+		case runresult.ActionCreate:
+			plan.Add++
+		case runresult.ActionUpdate:
+			plan.Change++
+		case runresult.ActionDelete:
+			plan.Destroy++
+		case runresult.ActionReplace:
+			plan.Add++
+			plan.Destroy++
+			plan.Replace++
+		}
+	}
+	return plan
+}
+
+// newApprovedPlan is the plan of the given changes, as recorded in the Repo status
+func newApprovedPlan(changes ...runresult.PlanChange) *repov1alpha1.PlanSummary {
+	plan := newPlan(changes...)
+	approved := &repov1alpha1.PlanSummary{
+		Add:     int32(plan.Add),
+		Change:  int32(plan.Change),
+		Destroy: int32(plan.Destroy),
+		Replace: int32(plan.Replace),
+	}
+	for _, change := range changes {
+		approved.Changes = append(approved.Changes, repov1alpha1.PlanChange{Address: change.Address, Action: change.Action})
+	}
+	return approved
+}
+
+var (
+	bucketCreated = runresult.PlanChange{Address: "aws_s3_bucket.logs", Type: "aws_s3_bucket", Action: runresult.ActionCreate}
+	groupUpdated  = runresult.PlanChange{Address: "aws_security_group.web", Type: "aws_security_group", Action: runresult.ActionUpdate}
+	dbReplaced    = runresult.PlanChange{Address: "aws_db_instance.main", Type: "aws_db_instance", Action: runresult.ActionReplace}
+	eipDestroyed  = runresult.PlanChange{Address: "aws_eip.legacy", Type: "aws_eip", Action: runresult.ActionDelete}
+)
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     *repov1alpha1.PlanPolicy
+		plan       *runresult.PlanSummary
+		approved   *repov1alpha1.PlanSummary
+		decision   repov1alpha1.PolicyDecision
+		violations []string
+	}{
+		{
+			name:     "no policy",
+			plan:     newPlan(dbReplaced),
+			decision: repov1alpha1.PolicyAllowed,
+		},
+		{
+			name:       "denied destroy type",
+			policy:     &repov1alpha1.PlanPolicy{DenyDestroyTypes: []string{"aws_db_instance"}},
+			plan:       newPlan(bucketCreated, dbReplaced),
+			approved:   newApprovedPlan(bucketCreated, dbReplaced),
+			decision:   repov1alpha1.PolicyDenied,
+			violations: []string{"destroys [aws_db_instance.main], whose types must not be destroyed"},
+		},
+		{
+			name:     "destroy of other types",
+			policy:   &repov1alpha1.PlanPolicy{DenyDestroyTypes: []string{"aws_db_instance"}},
+			plan:     newPlan(eipDestroyed),
+			decision: repov1alpha1.PolicyAllowed,
+		},
+		{
+			name:       "too many changes",
+			policy:     &repov1alpha1.PlanPolicy{MaxChanges: 2},
+			plan:       newPlan(bucketCreated, groupUpdated, eipDestroyed),
+			decision:   repov1alpha1.PolicyDenied,
+			violations: []string{"changes 3 resources, more than the 2 allowed"},
+		},
+		{
+			name:       "destroy held for approval",
+			policy:     &repov1alpha1.PlanPolicy{RequireApprovalOnDestroy: true},
+			plan:       newPlan(bucketCreated, dbReplaced),
+			decision:   repov1alpha1.PolicyApprovalRequired,
+			violations: []string{"destroys 1 resources"},
+		},
+		{
+			name:     "approved destroy",
+			policy:   &repov1alpha1.PlanPolicy{RequireApprovalOnDestroy: true},
+			plan:     newPlan(bucketCreated, dbReplaced),
+			approved: newApprovedPlan(dbReplaced, bucketCreated),
+			decision: repov1alpha1.PolicyAllowed,
+		},
+		{
+			name:       "destroy of a plan other than the approved one",
+			policy:     &repov1alpha1.PlanPolicy{RequireApprovalOnDestroy: true},
+			plan:       newPlan(bucketCreated, dbReplaced, eipDestroyed),
+			approved:   newApprovedPlan(bucketCreated, dbReplaced),
+			decision:   repov1alpha1.PolicyDenied,
+			violations: []string{"differs from the approved plan, which adds 2, changes 0 and destroys 1 resources"},
+		},
+		{
+			name:     "approved large plan",
+			policy:   &repov1alpha1.PlanPolicy{RequireApprovalOnDestroy: true},
+			plan:     newPlan(bucketCreated, dbReplaced),
+			approved: &repov1alpha1.PlanSummary{Add: 2, Destroy: 1, Replace: 1},
+			decision: repov1alpha1.PolicyAllowed,
+		},
+		{
+			name:     "plan of an approved revision breaking no rule",
+			policy:   &repov1alpha1.PlanPolicy{RequireApprovalOnDestroy: true},
+			plan:     newPlan(bucketCreated),
+			approved: newApprovedPlan(bucketCreated, dbReplaced),
+			decision: repov1alpha1.PolicyAllowed,
+		},
+		{
+			name:     "additive plan",
+			policy:   &repov1alpha1.PlanPolicy{AutoApplyAdditiveOnly: true},
+			plan:     newPlan(bucketCreated),
+			decision: repov1alpha1.PolicyAllowed,
+		},
+		{
+			name:       "update held for approval",
+			policy:     &repov1alpha1.PlanPolicy{AutoApplyAdditiveOnly: true},
+			plan:       newPlan(bucketCreated, groupUpdated),
+			decision:   repov1alpha1.PolicyApprovalRequired,
+			violations: []string{"changes 1 and destroys 0 resources, only additions are applied without approval"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			outcome := Evaluate(test.policy, test.plan, test.approved)
+			if outcome.Decision != string(test.decision) {
+				t.Errorf("got decision %s; want %s", outcome.Decision, test.decision)
+			}
+			if !reflect.DeepEqual(outcome.Violations, test.violations) {
+				t.Errorf("got violations %q; want %q", outcome.Violations, test.violations)
+			}
+		})
+	}
+}
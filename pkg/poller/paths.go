@@ -0,0 +1,90 @@
+package poller
+
+import (
+	"path"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// MatchesPath tells if a slash separated file path matches a glob pattern.
+// Besides the path.Match syntax, a "**" segment matches any number of
+// directories. A pattern matching a directory matches every file under it.
+func MatchesPath(pattern string, filePath string) bool {
+	patternSegments := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathSegments := strings.Split(strings.Trim(filePath, "/"), "/")
+	for i := len(pathSegments); i > 0; i-- {
+		if matchSegments(patternSegments, pathSegments[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSegments(pattern []string, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if ok, err := path.Match(pattern[0], segments[0]); err != nil || !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], segments[1:])
+}
+
+// IsRelevantPath tells if changes to a file should trigger a run. Files must
+// match one of the include patterns, if any, and none of the ignore patterns.
+func IsRelevantPath(filePath string, includePaths []string, ignorePaths []string) bool {
+	for _, pattern := range ignorePaths {
+		if MatchesPath(pattern, filePath) {
+			return false
+		}
+	}
+	if len(includePaths) == 0 {
+		return true
+	}
+	for _, pattern := range includePaths {
+		if MatchesPath(pattern, filePath) {
+			return true
+		}
+	}
+	return false
+}
+
+// ChangedPaths lists the files added, modified or deleted between two commits
+func ChangedPaths(from *object.Commit, to *object.Commit) ([]string, error) {
+	fromTree, err := from.Tree()
+	if err != nil {
+		return nil, err
+	}
+	toTree, err := to.Tree()
+	if err != nil {
+		return nil, err
+	}
+	changes, err := object.DiffTree(fromTree, toTree)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, change := range changes {
+		// renames show up with a different name on each side
+		if change.From.Name != "" {
+			paths = append(paths, change.From.Name)
+		}
+		if change.To.Name != "" && change.To.Name != change.From.Name {
+			paths = append(paths, change.To.Name)
+		}
+	}
+	return paths, nil
+}
@@ -0,0 +1,47 @@
+package poller
+
+import "testing"
+
+func TestMatchesPath(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"main.tf", "main.tf", true},
+		{"*.tf", "main.tf", true},
+		{"*.tf", "modules/main.tf", false},
+		{"modules", "modules/network/main.tf", true},
+		{"modules/", "modules/network/main.tf", true},
+		{"envs/*/main.tf", "envs/prod/main.tf", true},
+		{"envs/*/main.tf", "envs/prod/eu/main.tf", false},
+		{"envs/**/main.tf", "envs/prod/eu/main.tf", true},
+		{"envs/**/main.tf", "envs/main.tf", true},
+		{"**/*.md", "README.md", true},
+		{"**/*.md", "docs/usage/README.md", true},
+		{"envs/prod", "envs/production/main.tf", false},
+	}
+	for _, test := range tests {
+		if got := MatchesPath(test.pattern, test.path); got != test.want {
+			t.Errorf("MatchesPath(%q, %q) = %v; want %v", test.pattern, test.path, got, test.want)
+		}
+	}
+}
+
+func TestIsRelevantPath(t *testing.T) {
+	include := []string{"envs/prod"}
+	ignore := []string{"**/*.md"}
+
+	if !IsRelevantPath("envs/prod/main.tf", include, ignore) {
+		t.Error("expected included file to be relevant")
+	}
+	if IsRelevantPath("envs/prod/README.md", include, ignore) {
+		t.Error("expected ignored file not to be relevant")
+	}
+	if IsRelevantPath("envs/staging/main.tf", include, ignore) {
+		t.Error("expected file outside included paths not to be relevant")
+	}
+	if !IsRelevantPath("envs/staging/main.tf", nil, ignore) {
+		t.Error("expected every file to be relevant without include paths")
+	}
+}
@@ -0,0 +1,94 @@
+package poller
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+
+	repo "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
+	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/verification"
+)
+
+// References of the heads of pull requests: refs/pull/<number>/head on
+// GitHub, refs/merge-requests/<number>/head on GitLab
+var pullRequestRef = regexp.MustCompile(`^refs/(?:pull|merge-requests)/([0-9]+)/head$`)
+
+// FindPullRequestHeads lists the heads of the open pull requests among the
+// references of a repository, ordered by pull request number
+func FindPullRequestHeads(refs []*plumbing.Reference) []repo.PullRequestRun {
+	var heads []repo.PullRequestRun
+	for _, ref := range refs {
+		match := pullRequestRef.FindStringSubmatch(ref.Name().String())
+		if match == nil || ref.Type() != plumbing.HashReference {
+			continue
+		}
+		number, err := strconv.ParseInt(match[1], 10, 32)
+		if err != nil {
+			continue
+		}
+		heads = append(heads, repo.PullRequestRun{Number: int32(number), Ref: ref.Name().String(), GitSHA: ref.Hash().String()})
+	}
+	sort.Slice(heads, func(i, j int) bool { return heads[i].Number < heads[j].Number })
+	return heads
+}
+
+// checkPullRequests records the heads of the open pull requests, for the
+// controller to plan the new ones. Heads refused by the verification of the
+// Repo are left out.
+func (poller *RepoPoller) checkPullRequests(ctx context.Context, remoteConfig *config.RemoteConfig, refs []*plumbing.Reference) {
+	planned := map[int32]string{}
+	for _, run := range poller.Repo.Status.PullRequests {
+		planned[run.Number] = run.GitSHA
+	}
+
+	var heads []repo.PullRequestRun
+	changed := false
+	for _, head := range FindPullRequestHeads(refs) {
+		if sha, found := planned[head.Number]; found && sha == head.GitSHA {
+			heads = append(heads, head)
+			delete(planned, head.Number)
+			continue
+		}
+		if poller.Repo.Spec.Verification != nil && !poller.verifyPullRequest(ctx, remoteConfig, head) {
+			continue
+		}
+		heads = append(heads, head)
+		changed = true
+	}
+	// the runs of the pull requests left are dropped
+	if poller.isCancelled(ctx) || (!changed && len(planned) == 0) {
+		return
+	}
+	klog.Infof("Found %d open pull requests of '%s'", len(heads), poller.RepoKey)
+	if err := poller.repoStatusManager.SetPullRequestHeads(poller.Repo, heads); err != nil {
+		klog.Errorf("Failed to record pull requests of '%s': %v", poller.RepoKey, err)
+	}
+}
+
+// verifyPullRequest checks the signature of the head of a pull request, as
+// planning it runs its code
+func (poller *RepoPoller) verifyPullRequest(ctx context.Context, remoteConfig *config.RemoteConfig, head repo.PullRequestRun) bool {
+	refSpec := config.RefSpec(fmt.Sprintf("+%s:%s", head.Ref, head.Ref))
+	_, commit, err := poller.fetchCommit(ctx, remoteConfig, refSpec, head.GitSHA, 1)
+	if err == nil {
+		err = poller.verifier.Verify(poller.Repo, commit)
+	}
+	if err != nil && !verification.IsRefused(err) {
+		klog.Errorf("Failed to verify pull request #%d of '%s': %v", head.Number, poller.RepoKey, err)
+		return false
+	}
+	if err != nil {
+		klog.Warningf("Refusing to plan pull request #%d of '%s': %v", head.Number, poller.RepoKey, err)
+		poller.recorder.Eventf(poller.Repo, corev1.EventTypeWarning, VerificationFailed,
+			"Revision %s of pull request #%d was not planned: %v", head.GitSHA, head.Number, err)
+		return false
+	}
+	return true
+}
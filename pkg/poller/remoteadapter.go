@@ -1,28 +1,55 @@
 package poller
 
 import (
+	"context"
+
 	"gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/config"
 	"gopkg.in/src-d/go-git.v4/plumbing"
 	"gopkg.in/src-d/go-git.v4/storage"
 )
 
+// GitRemote reaches the source repositories. Listing references cannot be
+// cancelled with go-git v4, so the context is only honored by Fetch.
 type GitRemote interface {
 	ListReferences(
+		ctx context.Context,
 		s storage.Storer,
 		c *config.RemoteConfig,
 		o *git.ListOptions,
 	) (rfs []*plumbing.Reference, err error)
+
+	Fetch(
+		ctx context.Context,
+		s storage.Storer,
+		c *config.RemoteConfig,
+		o *git.FetchOptions,
+	) error
 }
 
 type GitRemoteDelegator struct {
 }
 
 func (d GitRemoteDelegator) ListReferences(
+	ctx context.Context,
 	s storage.Storer,
 	c *config.RemoteConfig,
 	o *git.ListOptions,
 ) (rfs []*plumbing.Reference, err error) {
 	rem := git.NewRemote(s, c)
-	return rem.List(&git.ListOptions{})
+	return rem.List(o)
+}
+
+func (d GitRemoteDelegator) Fetch(
+	ctx context.Context,
+	s storage.Storer,
+	c *config.RemoteConfig,
+	o *git.FetchOptions,
+) error {
+	rem := git.NewRemote(s, c)
+	err := rem.FetchContext(ctx, o)
+	if err == git.NoErrAlreadyUpToDate {
+		return nil
+	}
+	return err
 }
@@ -1,86 +1,333 @@
 package poller
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/status"
 	repo "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
+	listers "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/generated/listers/repo/v1alpha1"
+	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/metrics"
+	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/verification"
 	"gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/config"
 	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage"
 	"gopkg.in/src-d/go-git.v4/storage/memory"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog"
 )
 
 const POLLING_FREQUENCY_SECONDS = 30
 
+// Depths the history of a branch is fetched at to find the last applied
+// revision, rather than fetching the whole history in memory
+var historyDepths = []int{16, 256, 4096}
+
+const (
+	// VerificationFailed is used as part of the Event 'reason' when a new
+	// revision is refused because its signature could not be verified
+	VerificationFailed = "VerificationFailed"
+	// RevisionSkipped is used as part of the Event 'reason' when a new
+	// revision is not run because its commit message has a skip marker
+	RevisionSkipped = "RevisionSkipped"
+)
+
+// DefaultSkipMarkers are used when a Repo does not set its own
+var DefaultSkipMarkers = []string{"[skip tf]"}
+
+// Checks that a commit can be trusted before it is scheduled to run
+type CommitVerifier interface {
+	Verify(repo *repo.Repo, commit *object.Commit) error
+}
+
+// RepoPoller checks the source of a Repo for new revisions. Checks are
+// scheduled by a PollScheduler.
 type RepoPoller struct {
-	RepoKey           string
-	Repo              *repo.Repo
-	Ticker            *time.Ticker
-	Done              chan bool
+	RepoKey string
+	// Repo is a copy of the Repo taken from the lister at the start of the
+	// last check, so that changes to its spec or status are always seen
+	Repo *repo.Repo
+	// Interval is the time between two checks
+	Interval          time.Duration
+	reposLister       listers.RepoLister
 	repoStatusManager status.RepoStatusManager
 	gitRemote         GitRemote
+	verifier          CommitVerifier
+	recorder          record.EventRecorder
 }
 
 func NewRepoPoller(repoKey string,
-	repo *repo.Repo,
+	reposLister listers.RepoLister,
 	repoStatusManager status.RepoStatusManager,
-	gitRemote GitRemote) *RepoPoller {
-
-	ticker := time.NewTicker(POLLING_FREQUENCY_SECONDS * time.Second)
-	done := make(chan bool)
+	gitRemote GitRemote,
+	verifier CommitVerifier,
+	recorder record.EventRecorder) *RepoPoller {
 
 	return &RepoPoller{
 		RepoKey:           repoKey,
-		Repo:              repo,
-		Ticker:            ticker,
-		Done:              done,
+		Interval:          POLLING_FREQUENCY_SECONDS * time.Second,
+		reposLister:       reposLister,
 		repoStatusManager: repoStatusManager,
 		gitRemote:         gitRemote,
+		verifier:          verifier,
+		recorder:          recorder,
+	}
+}
+
+// CheckForNewRevisions looks for a new revision of the Repo and decides
+// whether to run it. Nothing is recorded once the context is cancelled.
+func (poller *RepoPoller) CheckForNewRevisions(ctx context.Context) {
+	if !poller.refreshRepo() {
+		return
+	}
+	klog.Infof("Checking for new revisions at %s...", poller.Repo.Spec.Url)
+	remoteConfig := &config.RemoteConfig{
+		Name: "origin",
+		URLs: []string{poller.Repo.Spec.Url},
+	}
+	start := time.Now()
+	refs, err := poller.gitRemote.ListReferences(ctx, memory.NewStorage(), remoteConfig, &git.ListOptions{})
+	metrics.ObservePoll(poller.Repo.Namespace, poller.Repo.Name, time.Since(start), err)
+	if err != nil {
+		klog.Errorf("Failed to list references of '%s': %v", poller.RepoKey, err)
+		return
+	}
+	if poller.isCancelled(ctx) {
+		return
+	}
+
+	lastObservedRef := poller.Repo.Status.ObservedGitSHA
+	if lastObservedRef == "" {
+		lastObservedRef = poller.Repo.Status.GitSHA
+	}
+	if ok, masterHash := HasNewRevision(refs, lastObservedRef); ok {
+		metrics.RevisionDetected(poller.Repo.Namespace, poller.Repo.Name)
+		poller.evaluateRevision(ctx, remoteConfig, masterHash)
+		// the status was just written, pull requests wait for the next check
+		return
+	}
+	klog.Infof("No pending commits to run... nothing to do.")
+	if poller.Repo.Spec.PullRequests != nil {
+		poller.checkPullRequests(ctx, remoteConfig, refs)
 	}
 }
 
-func (poller *RepoPoller) Start() {
-	go func() {
-		for {
-			select {
-			case <-poller.Done:
+// refreshRepo reads the current Repo from the lister. It returns false
+// when the Repo no longer exists.
+func (poller *RepoPoller) refreshRepo() bool {
+	namespace, name, err := cache.SplitMetaNamespaceKey(poller.RepoKey)
+	if err != nil {
+		klog.Errorf("Invalid repo key '%s': %v", poller.RepoKey, err)
+		return false
+	}
+	current, err := poller.reposLister.Repos(namespace).Get(name)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			klog.Errorf("Failed to get repo '%s': %v", poller.RepoKey, err)
+		}
+		return false
+	}
+
+	// the CRD has no status subresource, so its generation also changes
+	// with the status: the spec is compared instead
+	if poller.Repo != nil && !equality.Semantic.DeepEqual(poller.Repo.Spec, current.Spec) {
+		klog.Infof("Spec of '%s' changed, checking %s", poller.RepoKey, current.Spec.Url)
+	}
+	// Objects from the lister must not be modified
+	poller.Repo = current.DeepCopy()
+	return true
+}
+
+// evaluateRevision fetches the new commit to decide whether it should run
+func (poller *RepoPoller) evaluateRevision(ctx context.Context, remoteConfig *config.RemoteConfig, gitSha string) {
+	masterRefSpec := config.RefSpec(fmt.Sprintf("+%s:refs/remotes/origin/master", plumbing.Master))
+	var storer storage.Storer
+	var commit *object.Commit
+	var err error
+	if poller.hasPathFilters() {
+		// diffing against the last applied revision needs the branch history
+		storer, commit, err = poller.fetchHistory(ctx, remoteConfig, masterRefSpec, gitSha)
+	} else {
+		storer, commit, err = poller.fetchCommit(ctx, remoteConfig, masterRefSpec, gitSha, 1)
+	}
+	if poller.isCancelled(ctx) {
+		return
+	}
+	if err != nil {
+		klog.Errorf("Failed to fetch revision %s of '%s': %v", gitSha, poller.RepoKey, err)
+		return
+	}
+
+	if poller.Repo.Spec.Verification != nil {
+		if err := poller.verifier.Verify(poller.Repo, commit); err != nil {
+			if !verification.IsRefused(err) {
+				// the revision is verified again on the next check
+				klog.Errorf("Failed to verify revision %s of '%s': %v", gitSha, poller.RepoKey, err)
 				return
-			case t := <-poller.Ticker.C:
-				klog.Infof("Checking for repo changes at %s", t)
-				poller.CheckForNewRevisions()
 			}
+			poller.refuseRevision(gitSha, err)
+			return
+		}
+	}
+
+	if marker, found := FindSkipMarker(commit.Message, poller.skipMarkers()); found {
+		klog.Infof("Revision %s of '%s' has skip marker %q... nothing to do.", gitSha, poller.RepoKey, marker)
+		poller.recorder.Eventf(poller.Repo, corev1.EventTypeNormal, RevisionSkipped,
+			"Revision %s was not run: commit message contains %q", gitSha, marker)
+		if err := poller.repoStatusManager.SetSkippedRevision(poller.Repo, gitSha); err != nil {
+			klog.Errorf("Failed to record skipped revision of '%s': %v", poller.RepoKey, err)
 		}
-	}()
+		return
+	}
+
+	if poller.hasPathFilters() {
+		relevant, err := poller.hasRelevantChanges(storer, commit)
+		if err != nil {
+			klog.Errorf("Failed to diff revision %s of '%s': %v", gitSha, poller.RepoKey, err)
+			return
+		}
+		if !relevant {
+			klog.Infof("Revision %s of '%s' has no changes under the watched paths... nothing to do.", gitSha, poller.RepoKey)
+			if err := poller.repoStatusManager.SetObservedRevision(poller.Repo, gitSha); err != nil {
+				klog.Errorf("Failed to record observed revision of '%s': %v", poller.RepoKey, err)
+			}
+			return
+		}
+	}
+
+	if err := poller.repoStatusManager.SetNewJobRun(poller.Repo, gitSha, NewCommitInfo(commit)); err != nil {
+		klog.Errorf("Failed to schedule revision %s of '%s': %v", gitSha, poller.RepoKey, err)
+	}
 }
 
-func (poller *RepoPoller) Stop() {
-	poller.Ticker.Stop()
-	poller.Done <- true
+// isCancelled tells if the Repo is no longer polled, or the controller is stopping
+func (poller *RepoPoller) isCancelled(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		klog.Infof("Check of '%s' was cancelled", poller.RepoKey)
+		return true
+	}
+	return false
 }
 
-func (poller *RepoPoller) CheckForNewRevisions() {
-	klog.Infof("Checking for new revisions at %s...", poller.Repo.Spec.Url)
-	remoteConfig := &config.RemoteConfig{
-		Name: "origin",
-		URLs: []string{poller.Repo.Spec.Url},
+func (poller *RepoPoller) skipMarkers() []string {
+	if poller.Repo.Spec.SkipMarkers == nil {
+		return DefaultSkipMarkers
+	}
+	return poller.Repo.Spec.SkipMarkers
+}
+
+// NewCommitInfo extracts the commit metadata shown in the Repo status
+func NewCommitInfo(commit *object.Commit) *repo.CommitInfo {
+	subject := strings.TrimSpace(commit.Message)
+	if i := strings.Index(subject, "\n"); i >= 0 {
+		subject = strings.TrimSpace(subject[:i])
+	}
+	return &repo.CommitInfo{
+		Author:    fmt.Sprintf("%s <%s>", commit.Author.Name, commit.Author.Email),
+		Committer: fmt.Sprintf("%s <%s>", commit.Committer.Name, commit.Committer.Email),
+		Subject:   subject,
+		Timestamp: metav1.NewTime(commit.Committer.When),
+	}
+}
+
+// FindSkipMarker returns the first marker found in a commit message
+func FindSkipMarker(message string, markers []string) (string, bool) {
+	for _, marker := range markers {
+		if marker != "" && strings.Contains(message, marker) {
+			return marker, true
+		}
+	}
+	return "", false
+}
+
+func (poller *RepoPoller) hasPathFilters() bool {
+	return len(poller.Repo.Spec.IncludePaths) != 0 || len(poller.Repo.Spec.IgnorePaths) != 0
+}
+
+// hasRelevantChanges diffs a commit against the last applied revision. When
+// no run completed yet or the revision is no longer part of the history,
+// every revision is relevant.
+func (poller *RepoPoller) hasRelevantChanges(storer storage.Storer, commit *object.Commit) (bool, error) {
+	lastApplied := status.AppliedRevision(poller.Repo)
+	if lastApplied == "" {
+		return true, nil
+	}
+	previous, err := object.GetCommit(storer, plumbing.NewHash(lastApplied))
+	if err == plumbing.ErrObjectNotFound {
+		klog.Infof("Last applied revision %s of '%s' not found in history", lastApplied, poller.RepoKey)
+		return true, nil
 	}
-	refs, err := poller.gitRemote.ListReferences(memory.NewStorage(), remoteConfig, &git.ListOptions{})
 	if err != nil {
-		log.Fatal(err)
+		return false, err
 	}
 
-	lastScheduledRef := poller.Repo.Status.GitSHA
-	if ok, masterHash := HasNewRevision(refs, lastScheduledRef); ok {
-		err := poller.repoStatusManager.SetNewJobRun(poller.Repo, masterHash)
+	paths, err := ChangedPaths(previous, commit)
+	if err != nil {
+		return false, err
+	}
+	for _, path := range paths {
+		if IsRelevantPath(path, poller.Repo.Spec.IncludePaths, poller.Repo.Spec.IgnorePaths) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (poller *RepoPoller) refuseRevision(gitSha string, err error) {
+	klog.Warningf("Refusing to run revision %s of '%s': %v", gitSha, poller.RepoKey, err)
+	poller.recorder.Eventf(poller.Repo, corev1.EventTypeWarning, VerificationFailed,
+		"Revision %s was not run: %v", gitSha, err)
+	if err := poller.repoStatusManager.SetVerificationFailed(poller.Repo, gitSha, err.Error()); err != nil {
+		klog.Errorf("Failed to record refused revision of '%s': %v", poller.RepoKey, err)
+	}
+}
+
+// fetchHistory retrieves the history of a remote reference down to the last
+// applied revision, fetching deeper until the revision is found. Past the
+// deepest fetch, the revision is taken as no longer part of the history.
+func (poller *RepoPoller) fetchHistory(ctx context.Context, remoteConfig *config.RemoteConfig, refSpec config.RefSpec, gitSha string) (storage.Storer, *object.Commit, error) {
+	lastApplied := status.AppliedRevision(poller.Repo)
+	if lastApplied == "" {
+		return poller.fetchCommit(ctx, remoteConfig, refSpec, gitSha, 1)
+	}
+	var storer storage.Storer
+	var commit *object.Commit
+	var err error
+	for _, depth := range historyDepths {
+		storer, commit, err = poller.fetchCommit(ctx, remoteConfig, refSpec, gitSha, depth)
 		if err != nil {
-			log.Fatal(err)
+			return nil, nil, err
 		}
-	} else {
-		klog.Infof("No pending commits to run... nothing to do.")
+		if _, err := object.GetCommit(storer, plumbing.NewHash(lastApplied)); err == nil {
+			break
+		}
+	}
+	return storer, commit, nil
+}
+
+// fetchCommit retrieves a remote reference, up to the given depth, and
+// returns the storage holding it along with the requested commit object.
+// A depth of 0 fetches the whole history.
+func (poller *RepoPoller) fetchCommit(ctx context.Context, remoteConfig *config.RemoteConfig, refSpec config.RefSpec, gitSha string, depth int) (storage.Storer, *object.Commit, error) {
+	storer := memory.NewStorage()
+	err := poller.gitRemote.Fetch(ctx, storer, remoteConfig, &git.FetchOptions{
+		RefSpecs: []config.RefSpec{refSpec},
+		Depth:    depth,
+	})
+	if err != nil {
+		return nil, nil, err
 	}
+	commit, err := object.GetCommit(storer, plumbing.NewHash(gitSha))
+	return storer, commit, err
 }
 
 func HasNewRevision(refs []*plumbing.Reference, previousHash string) (bool, string) {
@@ -1,46 +1,325 @@
 package poller
 
 import (
+	"context"
+	"errors"
 	"testing"
+	"time"
 
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/util"
 	"gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/config"
 	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
 	"gopkg.in/src-d/go-git.v4/storage"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	core "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/status"
 	repov1alpha1 "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
 	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/generated/clientset/versioned/fake"
+	listers "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/generated/listers/repo/v1alpha1"
+	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/verification"
 )
 
-type GitRemoteTest struct {
+// Serves the references and objects of an in-memory repository
+type GitRemoteFixture struct {
+	repo *git.Repository
 }
 
-func (d GitRemoteTest) ListReferences(
+func newGitRemoteFixture(t *testing.T, messages ...string) GitRemoteFixture {
+	repo, err := git.Init(memory.NewStorage(), memfs.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := GitRemoteFixture{repo: repo}
+	for _, message := range messages {
+		remote.Commit(t, "main.tf", message)
+	}
+	return remote
+}
+
+// Commit writes the message into a file and commits it to master
+func (d GitRemoteFixture) Commit(t *testing.T, filename string, message string) string {
+	worktree, err := d.repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := util.WriteFile(worktree.Filesystem, filename, []byte(message), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := worktree.Add(filename); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := worktree.Commit(message, &git.CommitOptions{
+		Author: &object.Signature{Name: "Jane", Email: "jane@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash.String()
+}
+
+func (d GitRemoteFixture) Head(t *testing.T) string {
+	head, err := d.repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return head.Hash().String()
+}
+
+func (d GitRemoteFixture) ListReferences(
+	ctx context.Context,
 	s storage.Storer,
 	c *config.RemoteConfig,
 	o *git.ListOptions,
 ) (rfs []*plumbing.Reference, err error) {
-	return []*plumbing.Reference{
-		plumbing.NewReferenceFromStrings("refs/heads/master", "f7b877701fbf855b44c0a9e86f3fdce2c298b07f"),
-	}, nil
+	head, err := d.repo.Head()
+	if err != nil {
+		return nil, err
+	}
+	return []*plumbing.Reference{plumbing.NewHashReference(plumbing.Master, head.Hash())}, nil
+}
+
+func (d GitRemoteFixture) Fetch(
+	ctx context.Context,
+	s storage.Storer,
+	c *config.RemoteConfig,
+	o *git.FetchOptions,
+) error {
+	objects, err := d.repo.Storer.IterEncodedObjects(plumbing.AnyObject)
+	if err != nil {
+		return err
+	}
+	return objects.ForEach(func(obj plumbing.EncodedObject) error {
+		_, err := s.SetEncodedObject(obj)
+		return err
+	})
+}
+
+type CommitVerifierTest struct {
+	err error
+}
+
+func (v CommitVerifierTest) Verify(repo *repov1alpha1.Repo, commit *object.Commit) error {
+	return v.err
 }
 
 func TestUpdateRepoStatusWithGitCommitSHA(t *testing.T) {
 	repo := newRepo("test-repo")
-	repoclient := fake.NewSimpleClientset(repo)
-	repoStatusManager := status.NewRepoStatusManager(repoclient)
 
-	poller := NewRepoPoller("default/example-repo", repo, repoStatusManager, GitRemoteTest{})
-	poller.CheckForNewRevisions()
+	remote := newGitRemoteFixture(t, "Add bucket")
 
-	expectedGitSHA := "f7b877701fbf855b44c0a9e86f3fdce2c298b07f"
+	poller := newTestPoller(repo, remote, CommitVerifierTest{}, record.NewFakeRecorder(10))
+	poller.CheckForNewRevisions(context.Background())
+
+	expectedGitSHA := remote.Head(t)
 	if poller.Repo.Status.GitSHA != expectedGitSHA {
 		t.Errorf("got = %s; want %s", poller.Repo.Status.GitSHA, expectedGitSHA)
 	}
 }
 
+func TestUpdateRepoStatusWithCommitInfo(t *testing.T) {
+	repo := newRepo("test-repo")
+	remote := newGitRemoteFixture(t, "Add bucket\n\nVersioning is enabled.")
+
+	poller := newTestPoller(repo, remote, CommitVerifierTest{}, record.NewFakeRecorder(10))
+	poller.CheckForNewRevisions(context.Background())
+
+	commit := poller.Repo.Status.Commit
+	if commit == nil {
+		t.Fatal("expected commit info to be recorded")
+	}
+	if commit.Subject != "Add bucket" {
+		t.Errorf("got = %s; want %s", commit.Subject, "Add bucket")
+	}
+	if commit.Author != "Jane <jane@example.com>" {
+		t.Errorf("got = %s; want %s", commit.Author, "Jane <jane@example.com>")
+	}
+	if commit.Timestamp.IsZero() {
+		t.Error("expected commit timestamp to be recorded")
+	}
+}
+
+func TestRefuseRevisionFailingVerification(t *testing.T) {
+	repo := newRepo("test-repo")
+	repo.Spec.Verification = &repov1alpha1.VerificationSpec{SSHKeys: []string{"ssh-ed25519 AAAA"}}
+	remote := newGitRemoteFixture(t, "Add bucket")
+	recorder := record.NewFakeRecorder(10)
+
+	poller := newTestPoller(repo, remote, CommitVerifierTest{err: verification.ErrUnsigned}, recorder)
+	poller.CheckForNewRevisions(context.Background())
+
+	if poller.Repo.Status.GitSHA != "" {
+		t.Errorf("expected no run to be scheduled, got revision %s", poller.Repo.Status.GitSHA)
+	}
+	if poller.Repo.Status.ObservedGitSHA != remote.Head(t) {
+		t.Errorf("got = %s; want %s", poller.Repo.Status.ObservedGitSHA, remote.Head(t))
+	}
+	condition := status.GetCondition(poller.Repo.Status, repov1alpha1.VerificationFailed)
+	if condition == nil || condition.Status != corev1.ConditionTrue {
+		t.Errorf("expected condition %s to be True, got %+v", repov1alpha1.VerificationFailed, condition)
+	}
+	if len(recorder.Events) != 1 {
+		t.Errorf("expected a %s event to be recorded", VerificationFailed)
+	}
+}
+
+func TestRetryRevisionFailingToVerify(t *testing.T) {
+	repo := newRepo("test-repo")
+	repo.Spec.Verification = &repov1alpha1.VerificationSpec{SecretRef: &corev1.LocalObjectReference{Name: "trusted-signing-keys"}}
+	remote := newGitRemoteFixture(t, "Add bucket")
+	recorder := record.NewFakeRecorder(10)
+
+	poller := newTestPoller(repo, remote, CommitVerifierTest{err: errors.New("secrets \"trusted-signing-keys\" not found")}, recorder)
+	poller.CheckForNewRevisions(context.Background())
+
+	if poller.Repo.Status.GitSHA != "" || poller.Repo.Status.ObservedGitSHA != "" {
+		t.Errorf("got revisions %q and %q recorded; want the revision verified again", poller.Repo.Status.GitSHA, poller.Repo.Status.ObservedGitSHA)
+	}
+	if condition := status.GetCondition(poller.Repo.Status, repov1alpha1.VerificationFailed); condition != nil {
+		t.Errorf("got condition %+v", condition)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("got %d events; want none", len(recorder.Events))
+	}
+}
+
+func TestScheduleVerifiedRevision(t *testing.T) {
+	repo := newRepo("test-repo")
+	repo.Spec.Verification = &repov1alpha1.VerificationSpec{SSHKeys: []string{"ssh-ed25519 AAAA"}}
+	remote := newGitRemoteFixture(t, "Add bucket", "Add database")
+
+	poller := newTestPoller(repo, remote, CommitVerifierTest{}, record.NewFakeRecorder(10))
+	poller.CheckForNewRevisions(context.Background())
+
+	if poller.Repo.Status.GitSHA != remote.Head(t) {
+		t.Errorf("got = %s; want %s", poller.Repo.Status.GitSHA, remote.Head(t))
+	}
+}
+
+func TestOnlyRunWhenWatchedPathsChange(t *testing.T) {
+	repo := newRepo("test-repo")
+	repo.Spec.IncludePaths = []string{"envs/prod/**", "modules"}
+	repo.Spec.IgnorePaths = []string{"**/*.md"}
+	remote := newGitRemoteFixture(t)
+	applied := remote.Commit(t, "envs/prod/main.tf", "Add bucket")
+	repo.Status.GitSHA = applied
+	repo.Status.AppliedGitSHA = applied
+
+	poller := newTestPoller(repo, remote, CommitVerifierTest{}, record.NewFakeRecorder(10))
+
+	observed := remote.Commit(t, "envs/staging/main.tf", "Add staging bucket")
+	poller.CheckForNewRevisions(context.Background())
+	observed = remote.Commit(t, "envs/prod/README.md", "Document buckets")
+	poller.CheckForNewRevisions(context.Background())
+	if poller.Repo.Status.GitSHA != applied {
+		t.Errorf("expected no run to be scheduled, got revision %s", poller.Repo.Status.GitSHA)
+	}
+	if poller.Repo.Status.ObservedGitSHA != observed {
+		t.Errorf("got = %s; want %s", poller.Repo.Status.ObservedGitSHA, observed)
+	}
+
+	scheduled := remote.Commit(t, "modules/storage/main.tf", "Encrypt buckets")
+	poller.CheckForNewRevisions(context.Background())
+	if poller.Repo.Status.GitSHA != scheduled {
+		t.Errorf("got = %s; want %s", poller.Repo.Status.GitSHA, scheduled)
+	}
+}
+
+func TestDiffAgainstLastAppliedRevision(t *testing.T) {
+	repo := newRepo("test-repo")
+	repo.Spec.IncludePaths = []string{"envs/prod"}
+	remote := newGitRemoteFixture(t)
+	applied := remote.Commit(t, "envs/prod/main.tf", "Add bucket")
+	failed := remote.Commit(t, "envs/prod/main.tf", "Add database")
+	repo.Status.GitSHA = failed
+	repo.Status.RunStatus = "Failed"
+	repo.Status.AppliedGitSHA = applied
+	fetches := &depthRecordingRemote{GitRemoteFixture: remote}
+
+	poller := newTestPoller(repo, fetches, CommitVerifierTest{}, record.NewFakeRecorder(10))
+	scheduled := remote.Commit(t, "envs/staging/main.tf", "Add staging bucket")
+	poller.CheckForNewRevisions(context.Background())
+
+	if poller.Repo.Status.GitSHA != scheduled {
+		t.Errorf("got = %s; want %s scheduled, as the failed changes were never applied", poller.Repo.Status.GitSHA, scheduled)
+	}
+	if len(fetches.depths) != 1 || fetches.depths[0] != historyDepths[0] {
+		t.Errorf("got fetch depths %v; want the history fetched down to the applied revision only", fetches.depths)
+	}
+}
+
+// Records the depth of every fetch
+type depthRecordingRemote struct {
+	GitRemoteFixture
+	depths []int
+}
+
+func (d *depthRecordingRemote) Fetch(ctx context.Context, s storage.Storer, c *config.RemoteConfig, o *git.FetchOptions) error {
+	d.depths = append(d.depths, o.Depth)
+	return d.GitRemoteFixture.Fetch(ctx, s, c, o)
+}
+
+func TestSkipRevisionWithSkipMarker(t *testing.T) {
+	repo := newRepo("test-repo")
+	remote := newGitRemoteFixture(t, "Fix typo [skip tf]")
+	recorder := record.NewFakeRecorder(10)
+
+	poller, repos := newTestPollerWithLister(repo, remote, CommitVerifierTest{}, recorder)
+	poller.CheckForNewRevisions(context.Background())
+
+	if poller.Repo.Status.GitSHA != "" {
+		t.Errorf("expected no run to be scheduled, got revision %s", poller.Repo.Status.GitSHA)
+	}
+	if poller.Repo.Status.SkippedGitSHA != remote.Head(t) {
+		t.Errorf("got = %s; want %s", poller.Repo.Status.SkippedGitSHA, remote.Head(t))
+	}
+	if len(recorder.Events) != 1 {
+		t.Errorf("expected a %s event to be recorded", RevisionSkipped)
+	}
+
+	changed := poller.Repo.DeepCopy()
+	changed.Spec.SkipMarkers = []string{"[ci skip]"}
+	repos.Update(changed)
+	scheduled := remote.Commit(t, "main.tf", "Add database [skip tf]")
+	poller.CheckForNewRevisions(context.Background())
+	if poller.Repo.Status.GitSHA != scheduled {
+		t.Errorf("got = %s; want %s", poller.Repo.Status.GitSHA, scheduled)
+	}
+}
+
+// newTestPoller polls a Repo whose status updates are seen by the poller's
+// lister, as they would be through an informer
+func newTestPoller(repo *repov1alpha1.Repo, remote GitRemote, verifier CommitVerifier, recorder record.EventRecorder) *RepoPoller {
+	poller, _ := newTestPollerWithLister(repo, remote, verifier, recorder)
+	return poller
+}
+
+func newTestPollerWithLister(repo *repov1alpha1.Repo, remote GitRemote, verifier CommitVerifier, recorder record.EventRecorder) (*RepoPoller, cache.Indexer) {
+	repos := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	repos.Add(repo.DeepCopy())
+
+	repoclient := fake.NewSimpleClientset(repo)
+	repoclient.PrependReactor("*", "repos", func(action core.Action) (bool, runtime.Object, error) {
+		// creates and updates both carry the written object
+		if write, ok := action.(core.CreateAction); ok {
+			repos.Update(write.GetObject().DeepCopyObject())
+		}
+		return false, nil, nil
+	})
+
+	key := repo.Namespace + "/" + repo.Name
+	poller := NewRepoPoller(key, listers.NewRepoLister(repos), status.NewRepoStatusManager(repoclient), remote, verifier, recorder)
+	return poller, repos
+}
+
 func newRepo(name string) *repov1alpha1.Repo {
 	return &repov1alpha1.Repo{
 		TypeMeta: metav1.TypeMeta{APIVersion: repov1alpha1.SchemeGroupVersion.String()},
@@ -53,3 +332,60 @@ func newRepo(name string) *repov1alpha1.Repo {
 		},
 	}
 }
+
+func TestCheckCurrentRepoSpec(t *testing.T) {
+	repo := newRepo("test-repo")
+	remote := &trackingRemote{calls: map[string]int{}}
+	poller, repos := newTestPollerWithLister(repo, remote, CommitVerifierTest{}, record.NewFakeRecorder(10))
+	poller.CheckForNewRevisions(context.Background())
+
+	moved := repo.DeepCopy()
+	moved.Spec.Url = "https://github.com/davidmontoyago/moved-repo.git"
+	repos.Update(moved)
+	poller.CheckForNewRevisions(context.Background())
+
+	if calls := remote.callsTo("https://github.com/davidmontoyago/moved-repo.git"); calls != 1 {
+		t.Errorf("expected new url to be checked once, got %d checks", calls)
+	}
+	if calls := remote.callsTo("https://github.com/davidmontoyago/some-repo.git"); calls != 1 {
+		t.Errorf("expected old url to no longer be checked, got %d checks", calls)
+	}
+
+	repos.Delete(moved)
+	poller.CheckForNewRevisions(context.Background())
+	if calls := remote.callsTo("https://github.com/davidmontoyago/moved-repo.git"); calls != 1 {
+		t.Errorf("expected deleted repo not to be checked, got %d checks", calls)
+	}
+}
+
+func TestCancelledCheckRecordsNothing(t *testing.T) {
+	repo := newRepo("test-repo")
+	remote := newGitRemoteFixture(t, "Add bucket")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	poller := newTestPoller(repo, remote, CommitVerifierTest{}, record.NewFakeRecorder(10))
+	poller.CheckForNewRevisions(ctx)
+
+	if poller.Repo.Status.GitSHA != "" || poller.Repo.Status.ObservedGitSHA != "" {
+		t.Errorf("expected nothing to be recorded, got status %+v", poller.Repo.Status)
+	}
+}
+
+func TestFindsPullRequestHeads(t *testing.T) {
+	sha := plumbing.NewHash("0a1b2c3d4e5f67890a1b2c3d4e5f67890a1b2c3d")
+	refs := []*plumbing.Reference{
+		plumbing.NewHashReference(plumbing.Master, sha),
+		plumbing.NewHashReference("refs/pull/12/head", sha),
+		plumbing.NewHashReference("refs/pull/12/merge", sha),
+		plumbing.NewHashReference("refs/merge-requests/3/head", sha),
+		plumbing.NewSymbolicReference("refs/pull/5/head", plumbing.Master),
+	}
+
+	heads := FindPullRequestHeads(refs)
+
+	if len(heads) != 2 || heads[0].Number != 3 || heads[0].Ref != "refs/merge-requests/3/head" ||
+		heads[1].Number != 12 || heads[1].GitSHA != sha.String() {
+		t.Errorf("got pull request heads %+v", heads)
+	}
+}
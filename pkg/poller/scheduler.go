@@ -0,0 +1,172 @@
+package poller
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/drain"
+	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/health"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog"
+)
+
+// A worker checking a single Repo for longer than this is reported as stuck.
+// Only checks in progress are watched: Repos waiting in the queue behind slow
+// checks are not stuck, just late.
+const maxCheckDuration = 5 * time.Minute
+
+// PollScheduler runs the checks of all RepoPollers from a bounded pool of
+// workers. Each Repo key is put on a delaying queue at the time its next check
+// is due, so the number of concurrent git connections does not grow with the
+// number of Repos, and a Repo is never checked by two workers at once.
+//
+// Pollers are registered and removed from informer event handlers and workers
+// alike, so all of them go through the scheduler lock. Each poller gets its
+// own context, cancelled when it is unscheduled or the scheduler stops, so a
+// check in progress never records anything for a Repo that is no longer polled.
+type PollScheduler struct {
+	queue   workqueue.DelayingInterface
+	monitor *health.Monitor
+	ctx     context.Context
+	stop    context.CancelFunc
+	// checks in progress, waited for on shutdown
+	checks *drain.Tracker
+
+	mu      sync.Mutex
+	pollers map[string]*scheduledPoller
+}
+
+type scheduledPoller struct {
+	*RepoPoller
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewPollScheduler(monitor *health.Monitor) *PollScheduler {
+	ctx, stop := context.WithCancel(context.Background())
+	return &PollScheduler{
+		queue:   workqueue.NewNamedDelayingQueue("RepoPolls"),
+		monitor: monitor,
+		ctx:     ctx,
+		stop:    stop,
+		checks:  drain.NewTracker(),
+		pollers: make(map[string]*scheduledPoller),
+	}
+}
+
+// Schedule registers a poller, which is first checked after its interval.
+// Pollers already registered for the Repo are kept.
+func (scheduler *PollScheduler) Schedule(poller *RepoPoller) bool {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	if _, found := scheduler.pollers[poller.RepoKey]; found {
+		return false
+	}
+	ctx, cancel := context.WithCancel(scheduler.ctx)
+	scheduler.pollers[poller.RepoKey] = &scheduledPoller{RepoPoller: poller, ctx: ctx, cancel: cancel}
+	scheduler.queue.AddAfter(poller.RepoKey, poller.Interval)
+	return true
+}
+
+// Unschedule removes the poller of a Repo and cancels its check in progress
+func (scheduler *PollScheduler) Unschedule(repoKey string) bool {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	poller, found := scheduler.pollers[repoKey]
+	if !found {
+		return false
+	}
+	poller.cancel()
+	delete(scheduler.pollers, repoKey)
+	return true
+}
+
+// Scheduled returns the keys of the Repos being polled
+func (scheduler *PollScheduler) Scheduled() []string {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	keys := make([]string, 0, len(scheduler.pollers))
+	for key := range scheduler.pollers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// PollNow checks a Repo as soon as a worker is available
+func (scheduler *PollScheduler) PollNow(repoKey string) {
+	scheduler.queue.Add(repoKey)
+}
+
+// Run starts the poll workers. It blocks until stopCh is closed, at which
+// point the checks in progress are cancelled and waited for, up to the
+// shutdown timeout.
+func (scheduler *PollScheduler) Run(workers int, shutdownTimeout time.Duration, stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+
+	klog.Infof("Starting %d poll workers", workers)
+	for i := 0; i < workers; i++ {
+		go wait.Until(scheduler.runWorker, time.Second, stopCh)
+	}
+	<-stopCh
+
+	klog.Info("Shutting down poll workers")
+	scheduler.stop()
+	scheduler.queue.ShutDown()
+	if abandoned := scheduler.checks.Wait(shutdownTimeout); len(abandoned) != 0 {
+		klog.Warningf("Abandoned checks of %v after waiting %s", abandoned, shutdownTimeout)
+	}
+}
+
+func (scheduler *PollScheduler) runWorker() {
+	for scheduler.processNextPoll() {
+	}
+}
+
+func (scheduler *PollScheduler) processNextPoll() bool {
+	obj, shutdown := scheduler.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer scheduler.queue.Done(obj)
+
+	repoKey := obj.(string)
+	scheduler.checks.Start(repoKey)
+	defer scheduler.checks.Done(repoKey)
+	// checks due while shutting down are left to the next controller
+	if scheduler.queue.ShuttingDown() {
+		return false
+	}
+	poller := scheduler.poller(repoKey)
+	if poller == nil {
+		klog.V(4).Infof("Repo '%s' is no longer polled", repoKey)
+		return true
+	}
+
+	klog.Infof("Checking for repo changes of '%s'", repoKey)
+	scheduler.monitor.Heartbeat(heartbeatName(repoKey), maxCheckDuration)
+	poller.CheckForNewRevisions(poller.ctx)
+	scheduler.monitor.Forget(heartbeatName(repoKey))
+
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	// the poller may have been unscheduled during the check
+	if scheduler.pollers[repoKey] == poller {
+		scheduler.queue.AddAfter(repoKey, poller.Interval)
+	}
+	return true
+}
+
+func (scheduler *PollScheduler) poller(repoKey string) *scheduledPoller {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	return scheduler.pollers[repoKey]
+}
+
+func heartbeatName(repoKey string) string {
+	return "poller/" + repoKey
+}
@@ -0,0 +1,184 @@
+package poller
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/storage"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	repo "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
+	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/health"
+)
+
+// trackingRemote records the sources listed and how many were listed at once
+type trackingRemote struct {
+	GitRemote
+	mu            sync.Mutex
+	calls         map[string]int
+	inFlight      int
+	maxInFlight   int
+	listingLength time.Duration
+}
+
+func (remote *trackingRemote) ListReferences(ctx context.Context, s storage.Storer, c *config.RemoteConfig, o *git.ListOptions) ([]*plumbing.Reference, error) {
+	remote.mu.Lock()
+	remote.calls[c.URLs[0]]++
+	remote.inFlight++
+	if remote.inFlight > remote.maxInFlight {
+		remote.maxInFlight = remote.inFlight
+	}
+	remote.mu.Unlock()
+
+	time.Sleep(remote.listingLength)
+
+	remote.mu.Lock()
+	remote.inFlight--
+	remote.mu.Unlock()
+	return nil, errors.New("not reachable in tests")
+}
+
+func (remote *trackingRemote) callsTo(url string) int {
+	remote.mu.Lock()
+	defer remote.mu.Unlock()
+	return remote.calls[url]
+}
+
+func newScheduledPoller(name string, remote GitRemote, interval time.Duration) *RepoPoller {
+	r := &repo.Repo{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: metav1.NamespaceDefault},
+		Spec:       repo.RepoSpec{Url: "https://github.com/acme/" + name + ".git"},
+	}
+	poller := newTestPoller(r, remote, CommitVerifierTest{}, nil)
+	poller.Interval = interval
+	return poller
+}
+
+func TestPollsReposEveryInterval(t *testing.T) {
+	remote := &trackingRemote{calls: map[string]int{}}
+	scheduler := NewPollScheduler(health.NewMonitor())
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go scheduler.Run(2, time.Second, stopCh)
+
+	scheduler.Schedule(newScheduledPoller("network", remote, 10*time.Millisecond))
+	scheduler.Schedule(newScheduledPoller("database", remote, 10*time.Millisecond))
+	time.Sleep(100 * time.Millisecond)
+
+	for _, url := range []string{"https://github.com/acme/network.git", "https://github.com/acme/database.git"} {
+		if calls := remote.callsTo(url); calls < 2 {
+			t.Errorf("got %d checks of %s; want at least 2", calls, url)
+		}
+	}
+
+	scheduler.Unschedule("default/network")
+	time.Sleep(20 * time.Millisecond)
+	calls := remote.callsTo("https://github.com/acme/network.git")
+	time.Sleep(50 * time.Millisecond)
+	if remote.callsTo("https://github.com/acme/network.git") != calls {
+		t.Error("expected unscheduled repo to no longer be checked")
+	}
+}
+
+func TestBoundsConcurrentChecks(t *testing.T) {
+	remote := &trackingRemote{calls: map[string]int{}, listingLength: 10 * time.Millisecond}
+	scheduler := NewPollScheduler(health.NewMonitor())
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go scheduler.Run(3, time.Second, stopCh)
+
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		scheduler.Schedule(newScheduledPoller(name, remote, time.Millisecond))
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	remote.mu.Lock()
+	defer remote.mu.Unlock()
+	if remote.maxInFlight > 3 {
+		t.Errorf("got %d checks at once; want at most 3", remote.maxInFlight)
+	}
+}
+
+func TestBackedUpQueueIsNotStuck(t *testing.T) {
+	remote := &trackingRemote{calls: map[string]int{}, listingLength: 20 * time.Millisecond}
+	monitor := health.NewMonitor()
+	scheduler := NewPollScheduler(monitor)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go scheduler.Run(1, time.Second, stopCh)
+
+	// Repos wait far longer than their interval for the single worker
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		scheduler.Schedule(newScheduledPoller(name, remote, time.Millisecond))
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if err := monitor.Healthy(); err != nil {
+		t.Errorf("got %v; want Repos waiting for a worker not reported stuck", err)
+	}
+}
+
+func TestPollNowChecksRightAway(t *testing.T) {
+	remote := &trackingRemote{calls: map[string]int{}}
+	scheduler := NewPollScheduler(health.NewMonitor())
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go scheduler.Run(1, time.Second, stopCh)
+
+	scheduler.Schedule(newScheduledPoller("network", remote, time.Hour))
+	scheduler.PollNow("default/network")
+	time.Sleep(20 * time.Millisecond)
+
+	if calls := remote.callsTo("https://github.com/acme/network.git"); calls != 1 {
+		t.Errorf("got %d checks; want 1", calls)
+	}
+}
+
+func TestUnscheduleCancelsCheck(t *testing.T) {
+	scheduler := NewPollScheduler(health.NewMonitor())
+	poller := newScheduledPoller("network", &trackingRemote{calls: map[string]int{}}, time.Hour)
+
+	if !scheduler.Schedule(poller) || scheduler.Schedule(poller) {
+		t.Error("expected repo to be scheduled once")
+	}
+	ctx := scheduler.poller("default/network").ctx
+	if !scheduler.Unschedule("default/network") || scheduler.Unschedule("default/network") {
+		t.Error("expected repo to be unscheduled once")
+	}
+
+	if ctx.Err() == nil {
+		t.Error("expected check of unscheduled repo to be cancelled")
+	}
+	if len(scheduler.Scheduled()) != 0 {
+		t.Errorf("expected no repo to be scheduled, got %v", scheduler.Scheduled())
+	}
+}
+
+func TestWaitsForChecksOnShutdown(t *testing.T) {
+	remote := &trackingRemote{calls: map[string]int{}, listingLength: 50 * time.Millisecond}
+	scheduler := NewPollScheduler(health.NewMonitor())
+	stopCh := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		scheduler.Run(1, time.Second, stopCh)
+		close(stopped)
+	}()
+
+	scheduler.Schedule(newScheduledPoller("network", remote, time.Hour))
+	scheduler.PollNow("default/network")
+	time.Sleep(10 * time.Millisecond)
+	close(stopCh)
+	<-stopped
+
+	remote.mu.Lock()
+	defer remote.mu.Unlock()
+	if remote.inFlight != 0 {
+		t.Error("expected check in progress to finish before shutting down")
+	}
+}
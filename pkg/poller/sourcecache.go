@@ -0,0 +1,116 @@
+package poller
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/storage"
+	"k8s.io/klog"
+)
+
+// Sources no Repo has checked for this many intervals are dropped
+const sourceExpiryIntervals = 10
+
+// A source is a remote repository, shared by URL. Repos carry no credentials
+// yet: listings made with credentials are never shared, as they may hold
+// references other credentials cannot see. Once Repos reference a Secret,
+// its namespace, name and resourceVersion belong in the key.
+type sourceKey struct {
+	url string
+}
+
+type source struct {
+	// held while listing so that concurrent pollers wait for a single call
+	mu         sync.Mutex
+	refs       []*plumbing.Reference
+	err        error
+	listedTime time.Time
+
+	// guarded by the cache lock
+	lastUsedTime time.Time
+}
+
+// SourceCache is a GitRemote sharing the references of a source between all
+// the Repos pointing at it. References are listed at most once per interval,
+// and every poller checking the source within the interval is given the same
+// result, so many Repos watching one monorepo cost a single call per interval.
+type SourceCache struct {
+	remote   GitRemote
+	interval time.Duration
+
+	mu      sync.Mutex
+	sources map[sourceKey]*source
+	now     func() time.Time
+}
+
+func NewSourceCache(remote GitRemote, interval time.Duration) *SourceCache {
+	return &SourceCache{
+		remote:   remote,
+		interval: interval,
+		sources:  make(map[sourceKey]*source),
+		now:      time.Now,
+	}
+}
+
+// ListReferences returns the references of the source listed within the
+// last interval, listing them again once they are older than that.
+// Failures are shared as well, so an unreachable host is not retried by
+// every Repo pointing at it.
+func (cache *SourceCache) ListReferences(
+	ctx context.Context,
+	s storage.Storer,
+	c *config.RemoteConfig,
+	o *git.ListOptions,
+) ([]*plumbing.Reference, error) {
+	if o != nil && o.Auth != nil {
+		return cache.remote.ListReferences(ctx, s, c, o)
+	}
+	src := cache.source(sourceKey{url: c.URLs[0]})
+	src.mu.Lock()
+	defer src.mu.Unlock()
+
+	if src.listedTime.IsZero() || cache.now().Sub(src.listedTime) >= cache.interval {
+		src.refs, src.err = cache.remote.ListReferences(ctx, s, c, o)
+		src.listedTime = cache.now()
+	} else {
+		klog.V(4).Infof("Using references of %s listed at %s", c.URLs[0], src.listedTime)
+	}
+	if src.err != nil {
+		return nil, src.err
+	}
+	return append([]*plumbing.Reference(nil), src.refs...), nil
+}
+
+// Fetch is not shared, as each Repo fetches the revisions it has to evaluate
+func (cache *SourceCache) Fetch(
+	ctx context.Context,
+	s storage.Storer,
+	c *config.RemoteConfig,
+	o *git.FetchOptions,
+) error {
+	return cache.remote.Fetch(ctx, s, c, o)
+}
+
+func (cache *SourceCache) source(key sourceKey) *source {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	now := cache.now()
+	for k, src := range cache.sources {
+		if now.Sub(src.lastUsedTime) > sourceExpiryIntervals*cache.interval {
+			delete(cache.sources, k)
+		}
+	}
+
+	src, found := cache.sources[key]
+	if !found {
+		src = &source{}
+		cache.sources[key] = src
+	}
+	src.lastUsedTime = now
+	return src
+}
@@ -0,0 +1,120 @@
+package poller
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/storage"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+type countingRemote struct {
+	GitRemote
+	calls map[string]int
+	err   error
+}
+
+func (remote *countingRemote) ListReferences(ctx context.Context, s storage.Storer, c *config.RemoteConfig, o *git.ListOptions) ([]*plumbing.Reference, error) {
+	remote.calls[c.URLs[0]]++
+	if remote.err != nil {
+		return nil, remote.err
+	}
+	return []*plumbing.Reference{
+		plumbing.NewHashReference(plumbing.Master, plumbing.NewHash("f7b877701fbf855b44c0a9e86f3fdce2c298b07f")),
+	}, nil
+}
+
+func newTestSourceCache(remote GitRemote) (*SourceCache, *time.Time) {
+	clock := time.Date(2019, 10, 19, 8, 30, 0, 0, time.UTC)
+	cache := NewSourceCache(remote, POLLING_FREQUENCY_SECONDS*time.Second)
+	cache.now = func() time.Time { return clock }
+	return cache, &clock
+}
+
+func listReferences(t *testing.T, cache *SourceCache, url string) []*plumbing.Reference {
+	refs, err := cache.ListReferences(context.Background(), memory.NewStorage(), &config.RemoteConfig{Name: "origin", URLs: []string{url}}, &git.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return refs
+}
+
+func TestSharesReferencesOfTheSameSource(t *testing.T) {
+	remote := &countingRemote{calls: map[string]int{}}
+	cache, _ := newTestSourceCache(remote)
+
+	for i := 0; i < 50; i++ {
+		refs := listReferences(t, cache, "https://github.com/acme/monorepo.git")
+		if len(refs) != 1 {
+			t.Fatalf("got %d references; want 1", len(refs))
+		}
+	}
+	listReferences(t, cache, "https://github.com/acme/other.git")
+
+	if calls := remote.calls["https://github.com/acme/monorepo.git"]; calls != 1 {
+		t.Errorf("got %d calls to the shared source; want 1", calls)
+	}
+	if calls := remote.calls["https://github.com/acme/other.git"]; calls != 1 {
+		t.Errorf("got %d calls to the other source; want 1", calls)
+	}
+}
+
+func TestListsReferencesAgainEveryInterval(t *testing.T) {
+	remote := &countingRemote{calls: map[string]int{}}
+	cache, clock := newTestSourceCache(remote)
+
+	listReferences(t, cache, "https://github.com/acme/monorepo.git")
+	*clock = clock.Add(POLLING_FREQUENCY_SECONDS * time.Second / 2)
+	listReferences(t, cache, "https://github.com/acme/monorepo.git")
+	*clock = clock.Add(POLLING_FREQUENCY_SECONDS * time.Second / 2)
+	listReferences(t, cache, "https://github.com/acme/monorepo.git")
+
+	if calls := remote.calls["https://github.com/acme/monorepo.git"]; calls != 2 {
+		t.Errorf("got %d calls; want 2", calls)
+	}
+}
+
+func TestSharesListingFailures(t *testing.T) {
+	remote := &countingRemote{calls: map[string]int{}, err: errors.New("connection refused")}
+	cache, _ := newTestSourceCache(remote)
+	remoteConfig := &config.RemoteConfig{Name: "origin", URLs: []string{"https://github.com/acme/monorepo.git"}}
+
+	for i := 0; i < 2; i++ {
+		if _, err := cache.ListReferences(context.Background(), memory.NewStorage(), remoteConfig, &git.ListOptions{}); err == nil {
+			t.Error("expected listing failure to be returned")
+		}
+	}
+	if calls := remote.calls["https://github.com/acme/monorepo.git"]; calls != 1 {
+		t.Errorf("got %d calls; want 1", calls)
+	}
+}
+
+// an AuthMethod that cannot be used as a map key
+type tokenAuth struct {
+	scopes []string
+}
+
+func (tokenAuth) Name() string   { return "token" }
+func (tokenAuth) String() string { return "token" }
+
+func TestDoesNotShareReferencesListedWithCredentials(t *testing.T) {
+	remote := &countingRemote{calls: map[string]int{}}
+	cache, _ := newTestSourceCache(remote)
+	remoteConfig := &config.RemoteConfig{Name: "origin", URLs: []string{"https://github.com/acme/private.git"}}
+
+	for i := 0; i < 2; i++ {
+		options := &git.ListOptions{Auth: tokenAuth{scopes: []string{"repo"}}}
+		if _, err := cache.ListReferences(context.Background(), memory.NewStorage(), remoteConfig, options); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if calls := remote.calls["https://github.com/acme/private.git"]; calls != 2 {
+		t.Errorf("got %d calls; want every listing with credentials made", calls)
+	}
+}
@@ -0,0 +1,225 @@
+package prcomment
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	repov1alpha1 "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
+	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/commitstatus"
+)
+
+// Comment is a comment of a pull request
+type Comment struct {
+	ID   string
+	Body string
+}
+
+// Commenter comments the pull requests of a repository of a git host
+type Commenter interface {
+	Comments(pullRequest int) ([]Comment, error)
+	CreateComment(pullRequest int, body string) error
+	UpdateComment(pullRequest int, id string, body string) error
+	// MaxLength is the size of the largest comment the git host accepts
+	MaxLength() int
+}
+
+// Upsert comments a plan on a pull request, updating the comment left for
+// an earlier revision of the same Repo if there is one
+func Upsert(commenter Commenter, pullRequest int, plan Plan) error {
+	body := Render(plan, commenter.MaxLength())
+	comments, err := commenter.Comments(pullRequest)
+	if err != nil {
+		return err
+	}
+	marker := Marker(plan.Repo)
+	for _, comment := range comments {
+		if strings.Contains(comment.Body, marker) {
+			return commenter.UpdateComment(pullRequest, comment.ID, body)
+		}
+	}
+	return commenter.CreateComment(pullRequest, body)
+}
+
+// NewCommenter returns the commenter of the git host of a Repo. The git host
+// is configured as for commit statuses.
+func NewCommenter(repo *repov1alpha1.Repo, token string, client *http.Client) (Commenter, error) {
+	spec := repo.Spec.CommitStatus
+	if spec == nil {
+		spec = &repov1alpha1.CommitStatusSpec{}
+	}
+	repository, err := commitstatus.ParseRepository(repo.Spec.Url)
+	if err != nil {
+		return nil, err
+	}
+	provider := spec.Provider
+	if provider == "" {
+		if provider, err = commitstatus.DetectProvider(repository.Host); err != nil {
+			return nil, err
+		}
+	}
+	apiURL := strings.TrimSuffix(spec.APIURL, "/")
+
+	api := api{client: client}
+	switch provider {
+	case repov1alpha1.GitHubProvider:
+		if apiURL == "" {
+			apiURL = "https://api.github.com"
+		}
+		api.authorization = "token " + token
+		return GitHub{api: api, repoURL: apiURL + "/repos/" + repository.Path}, nil
+	case repov1alpha1.GitLabProvider:
+		if apiURL == "" {
+			apiURL = "https://" + repository.Host + "/api/v4"
+		}
+		api.authorization = "Bearer " + token
+		return GitLab{api: api, projectURL: apiURL + "/projects/" + url.PathEscape(repository.Path)}, nil
+	case repov1alpha1.BitbucketProvider:
+		return nil, errors.New("Bitbucket does not advertise pull requests as git references, they can not be planned")
+	}
+	return nil, errors.Errorf("unknown git provider %q", provider)
+}
+
+// GitHub comments pull requests through the GitHub REST API
+type GitHub struct {
+	api     api
+	repoURL string
+}
+
+type gitHubComment struct {
+	ID   int64  `json:"id,omitempty"`
+	Body string `json:"body"`
+}
+
+// Comments lists every page of the comments, following the next link of
+// the Link header
+func (gitHub GitHub) Comments(pullRequest int) ([]Comment, error) {
+	var comments []Comment
+	endpoint := fmt.Sprintf("%s/issues/%d/comments?per_page=100", gitHub.repoURL, pullRequest)
+	for endpoint != "" {
+		var found []gitHubComment
+		header, err := gitHub.api.do(http.MethodGet, endpoint, nil, &found)
+		if err != nil {
+			return nil, err
+		}
+		for _, comment := range found {
+			comments = append(comments, Comment{ID: fmt.Sprint(comment.ID), Body: comment.Body})
+		}
+		endpoint = nextLink(header.Get("Link"))
+	}
+	return comments, nil
+}
+
+// nextLink is the URL of the next page in a Link header, "" on the last page
+func nextLink(link string) string {
+	for _, value := range strings.Split(link, ",") {
+		parts := strings.Split(value, ";")
+		for _, param := range parts[1:] {
+			if strings.TrimSpace(param) == `rel="next"` {
+				return strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			}
+		}
+	}
+	return ""
+}
+
+func (gitHub GitHub) CreateComment(pullRequest int, body string) error {
+	endpoint := fmt.Sprintf("%s/issues/%d/comments", gitHub.repoURL, pullRequest)
+	_, err := gitHub.api.do(http.MethodPost, endpoint, gitHubComment{Body: body}, nil)
+	return err
+}
+
+func (gitHub GitHub) UpdateComment(pullRequest int, id string, body string) error {
+	endpoint := fmt.Sprintf("%s/issues/comments/%s", gitHub.repoURL, id)
+	_, err := gitHub.api.do(http.MethodPatch, endpoint, gitHubComment{Body: body}, nil)
+	return err
+}
+
+func (GitHub) MaxLength() int {
+	return GitHubMaxLength
+}
+
+// GitLab comments merge requests through the GitLab REST API
+type GitLab struct {
+	api        api
+	projectURL string
+}
+
+type gitLabNote struct {
+	ID   int64  `json:"id,omitempty"`
+	Body string `json:"body"`
+}
+
+// Comments lists every page of the notes, as told by the X-Next-Page header
+func (gitLab GitLab) Comments(mergeRequest int) ([]Comment, error) {
+	var comments []Comment
+	for page := "1"; page != ""; {
+		var found []gitLabNote
+		endpoint := fmt.Sprintf("%s/merge_requests/%d/notes?per_page=100&page=%s", gitLab.projectURL, mergeRequest, url.QueryEscape(page))
+		header, err := gitLab.api.do(http.MethodGet, endpoint, nil, &found)
+		if err != nil {
+			return nil, err
+		}
+		for _, note := range found {
+			comments = append(comments, Comment{ID: fmt.Sprint(note.ID), Body: note.Body})
+		}
+		page = header.Get("X-Next-Page")
+	}
+	return comments, nil
+}
+
+func (gitLab GitLab) CreateComment(mergeRequest int, body string) error {
+	endpoint := fmt.Sprintf("%s/merge_requests/%d/notes", gitLab.projectURL, mergeRequest)
+	_, err := gitLab.api.do(http.MethodPost, endpoint, gitLabNote{Body: body}, nil)
+	return err
+}
+
+func (gitLab GitLab) UpdateComment(mergeRequest int, id string, body string) error {
+	endpoint := fmt.Sprintf("%s/merge_requests/%d/notes/%s", gitLab.projectURL, mergeRequest, id)
+	_, err := gitLab.api.do(http.MethodPut, endpoint, gitLabNote{Body: body}, nil)
+	return err
+}
+
+func (GitLab) MaxLength() int {
+	return GitLabMaxLength
+}
+
+type api struct {
+	authorization string
+	client        *http.Client
+}
+
+// do calls the API of a git host, decoding the answer into result if given.
+// The headers of the answer tell the pages of lists.
+func (api api) do(method string, endpoint string, payload interface{}, result interface{}) (http.Header, error) {
+	var body bytes.Buffer
+	if payload != nil {
+		if err := json.NewEncoder(&body).Encode(payload); err != nil {
+			return nil, err
+		}
+	}
+	request, err := http.NewRequest(method, endpoint, &body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", api.authorization)
+
+	response, err := api.client.Do(request)
+	if err != nil {
+		return nil, errors.Wrapf(err, "commenting pull request failed")
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, errors.Errorf("commenting pull request failed: git host answered %s", response.Status)
+	}
+	if result == nil {
+		return response.Header, nil
+	}
+	return response.Header, json.NewDecoder(response.Body).Decode(result)
+}
@@ -0,0 +1,57 @@
+package prcomment
+
+import (
+	"fmt"
+	"sync"
+)
+
+// FakeCommenter keeps the comments of pull requests in memory instead of
+// calling a git host
+type FakeCommenter struct {
+	sync.Mutex
+	// Limit is the size of the largest comment accepted. Defaults to the
+	// GitHub limit.
+	Limit  int
+	Posted map[int][]Comment
+	nextID int
+}
+
+func NewFakeCommenter() *FakeCommenter {
+	return &FakeCommenter{Limit: GitHubMaxLength, Posted: map[int][]Comment{}}
+}
+
+func (fake *FakeCommenter) Comments(pullRequest int) ([]Comment, error) {
+	fake.Lock()
+	defer fake.Unlock()
+	return append([]Comment(nil), fake.Posted[pullRequest]...), nil
+}
+
+func (fake *FakeCommenter) CreateComment(pullRequest int, body string) error {
+	fake.Lock()
+	defer fake.Unlock()
+	if len(body) > fake.Limit {
+		return fmt.Errorf("comment of %d bytes is too long", len(body))
+	}
+	fake.nextID++
+	fake.Posted[pullRequest] = append(fake.Posted[pullRequest], Comment{ID: fmt.Sprint(fake.nextID), Body: body})
+	return nil
+}
+
+func (fake *FakeCommenter) UpdateComment(pullRequest int, id string, body string) error {
+	fake.Lock()
+	defer fake.Unlock()
+	if len(body) > fake.Limit {
+		return fmt.Errorf("comment of %d bytes is too long", len(body))
+	}
+	for i, comment := range fake.Posted[pullRequest] {
+		if comment.ID == id {
+			fake.Posted[pullRequest][i].Body = body
+			return nil
+		}
+	}
+	return fmt.Errorf("comment %s of pull request %d not found", id, pullRequest)
+}
+
+func (fake *FakeCommenter) MaxLength() int {
+	return fake.Limit
+}
@@ -0,0 +1,224 @@
+package prcomment
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	repov1alpha1 "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
+	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/runresult"
+)
+
+const diff = `Terraform will perform the following actions:
+
+  # aws_s3_bucket.logs will be created
++ resource "aws_s3_bucket" "logs" {
++     bucket = "acme-logs"
+  }
+
+Plan: 1 to add, 0 to change, 0 to destroy.
+`
+
+func newPlan() Plan {
+	return Plan{
+		Repo:       "payments/infra",
+		GitSHA:     "f7b877701fbf855b44c0a9e86f3fdce2c298b07f",
+		RunJobName: "terraform-run-f7b8777",
+		Summary: &runresult.PlanSummary{
+			Add:     1,
+			Changes: []runresult.PlanChange{{Address: "aws_s3_bucket.logs", Action: runresult.ActionCreate}},
+		},
+		Diff: diff,
+	}
+}
+
+func TestRendersPlan(t *testing.T) {
+	comment := Render(newPlan(), GitHubMaxLength)
+
+	for _, expected := range []string{
+		"<!-- terraform-plan: payments/infra -->\n",
+		"#### Terraform plan of `payments/infra` at f7b8777",
+		"**Plan: 1 to add, 0 to change, 0 to destroy.**",
+		"<details><summary>Show plan</summary>\n\n```diff\n",
+		`+ resource "aws_s3_bucket" "logs" {`,
+		"```\n\n</details>\n",
+	} {
+		if !strings.Contains(comment, expected) {
+			t.Errorf("got comment\n%s\nwant it to contain %q", comment, expected)
+		}
+	}
+}
+
+func TestTruncatesLongPlans(t *testing.T) {
+	plan := newPlan()
+	plan.Diff = strings.Repeat("+ resource \"aws_iam_user\" \"user\" {}\n", 5000)
+
+	comment := Render(plan, GitHubMaxLength)
+
+	if len(comment) > GitHubMaxLength {
+		t.Errorf("got a comment of %d bytes; want at most %d", len(comment), GitHubMaxLength)
+	}
+	if !strings.Contains(comment, "plan truncated") || !strings.Contains(comment, "terraform-run-f7b8777") {
+		t.Error("got no notice of the truncation")
+	}
+	if !strings.HasSuffix(comment, "```\n\n</details>\n") {
+		t.Error("got the collapsed section left open")
+	}
+}
+
+func TestRendersFailedPlan(t *testing.T) {
+	plan := newPlan()
+	plan.Summary = nil
+	plan.Failure = &runresult.Failure{Step: "plan", Reason: "Error: Reference to undeclared resource"}
+	plan.Diff = "Error: Reference to undeclared resource\n\n  on main.tf line 3\n"
+
+	comment := Render(plan, GitHubMaxLength)
+
+	for _, expected := range []string{
+		"**Plan failed at plan:** Error: Reference to undeclared resource",
+		"<details><summary>Show output</summary>",
+		"on main.tf line 3",
+	} {
+		if !strings.Contains(comment, expected) {
+			t.Errorf("got comment\n%s\nwant it to contain %q", comment, expected)
+		}
+	}
+}
+
+func TestUpdatesCommentInPlace(t *testing.T) {
+	commenter := NewFakeCommenter()
+	commenter.CreateComment(42, "LGTM")
+	plan := newPlan()
+
+	if err := Upsert(commenter, 42, plan); err != nil {
+		t.Fatal(err)
+	}
+	plan.GitSHA = "0a1b2c3d4e5f67890a1b2c3d4e5f67890a1b2c3d"
+	if err := Upsert(commenter, 42, plan); err != nil {
+		t.Fatal(err)
+	}
+
+	comments, _ := commenter.Comments(42)
+	if len(comments) != 2 {
+		t.Fatalf("got %d comments; want the plan comment updated in place", len(comments))
+	}
+	if !strings.Contains(comments[1].Body, "at 0a1b2c3") {
+		t.Errorf("got comment %q; want the latest revision", comments[1].Body)
+	}
+}
+
+func TestCommentsGitHubPullRequests(t *testing.T) {
+	var methods []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method+" "+r.URL.Path)
+		if r.Header.Get("Authorization") != "token s3cr3t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method == http.MethodGet {
+			json.NewEncoder(w).Encode([]gitHubComment{{ID: 7, Body: "LGTM"}, {ID: 9, Body: Marker("payments/infra") + "\nold plan"}})
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		var comment gitHubComment
+		if err := json.Unmarshal(body, &comment); err != nil || !strings.Contains(comment.Body, "aws_s3_bucket") {
+			t.Errorf("got comment %s", body)
+		}
+	}))
+	defer server.Close()
+	repo := &repov1alpha1.Repo{Spec: repov1alpha1.RepoSpec{
+		Url:          "https://github.com/acme/infra.git",
+		CommitStatus: &repov1alpha1.CommitStatusSpec{APIURL: server.URL},
+	}}
+	commenter, err := NewCommenter(repo, "s3cr3t", http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Upsert(commenter, 42, newPlan()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"GET /repos/acme/infra/issues/42/comments", "PATCH /repos/acme/infra/issues/comments/9"}
+	if strings.Join(methods, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("got requests %v; want %v", methods, expected)
+	}
+}
+
+func TestFindsCommentOnLaterGitHubPages(t *testing.T) {
+	var requests []string
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.RequestURI())
+		if r.Method != http.MethodGet {
+			return
+		}
+		if r.URL.Query().Get("page") == "" {
+			w.Header().Set("Link", `<`+server.URL+r.URL.Path+`?per_page=100&page=2>; rel="next", <`+server.URL+r.URL.Path+`?per_page=100&page=2>; rel="last"`)
+			json.NewEncoder(w).Encode([]gitHubComment{{ID: 7, Body: "LGTM"}})
+			return
+		}
+		json.NewEncoder(w).Encode([]gitHubComment{{ID: 9, Body: Marker("payments/infra") + "\nold plan"}})
+	}))
+	defer server.Close()
+	repo := &repov1alpha1.Repo{Spec: repov1alpha1.RepoSpec{
+		Url:          "https://github.com/acme/infra.git",
+		CommitStatus: &repov1alpha1.CommitStatusSpec{APIURL: server.URL},
+	}}
+	commenter, _ := NewCommenter(repo, "s3cr3t", http.DefaultClient)
+
+	if err := Upsert(commenter, 42, newPlan()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"GET /repos/acme/infra/issues/42/comments?per_page=100",
+		"GET /repos/acme/infra/issues/42/comments?per_page=100&page=2",
+		"PATCH /repos/acme/infra/issues/comments/9",
+	}
+	if strings.Join(requests, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("got requests %v; want %v", requests, expected)
+	}
+}
+
+func TestFindsNoteOnLaterGitLabPages(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.RequestURI())
+		if r.Method != http.MethodGet {
+			return
+		}
+		if r.URL.Query().Get("page") == "1" {
+			w.Header().Set("X-Next-Page", "2")
+			json.NewEncoder(w).Encode([]gitLabNote{{ID: 7, Body: "LGTM"}})
+			return
+		}
+		w.Header().Set("X-Next-Page", "")
+		json.NewEncoder(w).Encode([]gitLabNote{{ID: 9, Body: Marker("payments/infra") + "\nold plan"}})
+	}))
+	defer server.Close()
+	repo := &repov1alpha1.Repo{Spec: repov1alpha1.RepoSpec{
+		Url: "https://gitlab.com/acme/infra.git",
+		CommitStatus: &repov1alpha1.CommitStatusSpec{
+			Provider: repov1alpha1.GitLabProvider,
+			APIURL:   server.URL,
+		},
+	}}
+	commenter, _ := NewCommenter(repo, "s3cr3t", http.DefaultClient)
+
+	if err := Upsert(commenter, 3, newPlan()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"GET /projects/acme%2Finfra/merge_requests/3/notes?per_page=100&page=1",
+		"GET /projects/acme%2Finfra/merge_requests/3/notes?per_page=100&page=2",
+		"PUT /projects/acme%2Finfra/merge_requests/3/notes/9",
+	}
+	if strings.Join(requests, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("got requests %v; want %v", requests, expected)
+	}
+}
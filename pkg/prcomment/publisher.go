@@ -0,0 +1,102 @@
+package prcomment
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	repov1alpha1 "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
+	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/runresult"
+)
+
+// Key of the output of terraform show in the staging Secret
+const stagingKey = "plan.txt"
+
+const requestTimeout = 10 * time.Second
+
+// StagingSecretName is the name of the Secret the runner of a Job stages its plan in
+func StagingSecretName(jobName string) string {
+	return jobName + "-plan"
+}
+
+// NewStagingSecret holds the output of terraform show for the controller to
+// comment. It is owned by the runner pod, so it is deleted along with the
+// Job even if it is never commented.
+func NewStagingSecret(name string, namespace string, owner metav1.OwnerReference, diff []byte) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       namespace,
+			OwnerReferences: []metav1.OwnerReference{owner},
+		},
+		Data: map[string][]byte{stagingKey: diff},
+	}
+}
+
+// Publisher comments the plans of the pull request runs of Repos
+type Publisher struct {
+	kubeclientset kubernetes.Interface
+	client        *http.Client
+}
+
+func NewPublisher(kubeclientset kubernetes.Interface) *Publisher {
+	return &Publisher{kubeclientset: kubeclientset, client: &http.Client{Timeout: requestTimeout}}
+}
+
+// Publish comments the plan of a finished pull request run, or why it
+// failed. The plan staged by the runner is kept until the Job is deleted,
+// so that a comment can be published again if recording it failed.
+func (publisher *Publisher) Publish(repo *repov1alpha1.Repo, run repov1alpha1.PullRequestRun,
+	result *repov1alpha1.RunResult, failure *repov1alpha1.RunFailure) error {
+
+	secrets := publisher.kubeclientset.CoreV1().Secrets(repo.Namespace)
+	plan := Plan{Repo: repo.Namespace + "/" + repo.Name, GitSHA: run.GitSHA, RunJobName: run.RunJobName}
+	if result != nil && result.Plan != nil {
+		plan.Summary = &runresult.PlanSummary{
+			Add:     int(result.Plan.Add),
+			Change:  int(result.Plan.Change),
+			Destroy: int(result.Plan.Destroy),
+			Replace: int(result.Plan.Replace),
+		}
+	}
+	if failure != nil {
+		plan.Failure = &runresult.Failure{Step: failure.Step, Reason: failure.Reason}
+		plan.Diff = failure.Output
+	} else {
+		staging, err := secrets.Get(StagingSecretName(run.RunJobName), metav1.GetOptions{})
+		if err != nil {
+			return errors.Wrapf(err, "reading plan staged by %s", run.RunJobName)
+		}
+		plan.Diff = string(staging.Data[stagingKey])
+	}
+
+	token, err := publisher.token(repo)
+	if err != nil {
+		return err
+	}
+	commenter, err := NewCommenter(repo, token, publisher.client)
+	if err != nil {
+		return err
+	}
+	return Upsert(commenter, int(run.Number), plan)
+}
+
+// token reads the API token of the git host. It is read for every comment,
+// so a Secret fixed in the meantime is used by the next attempt.
+func (publisher *Publisher) token(repo *repov1alpha1.Repo) (string, error) {
+	ref := repo.Spec.PullRequests.TokenSecretRef
+	secret, err := publisher.kubeclientset.CoreV1().Secrets(repo.Namespace).Get(ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "reading git host token from secret %v/%v failed", repo.Namespace, ref.Name)
+	}
+	token, found := secret.Data[ref.Key]
+	if !found {
+		return "", errors.Errorf("secret %v/%v has no key %q", repo.Namespace, ref.Name, ref.Key)
+	}
+	return strings.TrimSpace(string(token)), nil
+}
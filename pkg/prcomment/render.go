@@ -0,0 +1,90 @@
+// Package prcomment comments the plans of the heads of pull requests on the
+// pull requests, updating a single comment per Repo in place as new heads are
+// planned. The runner stages the plan, as rendered by terraform show, in a
+// Secret the controller reads to comment it.
+package prcomment
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/runresult"
+)
+
+// Largest comments git hosts accept, in bytes
+const (
+	GitHubMaxLength = 65536
+	GitLabMaxLength = 1000000
+)
+
+const truncatedNotice = "\n... plan truncated, %d bytes not shown. See the logs of run %s.\n"
+
+// Plan is the plan of a revision, as commented
+type Plan struct {
+	// Repo names the Repo the plan belongs to, as namespace/name
+	Repo       string
+	GitSHA     string
+	RunJobName string
+	Summary    *runresult.PlanSummary
+	// Failure describes why the revision could not be planned
+	Failure *runresult.Failure
+	// Diff is the plan as rendered by terraform show, or the output of the
+	// failed step
+	Diff string
+}
+
+// Marker identifies the comment of a Repo among the comments of a pull
+// request, so that it is updated rather than posted again. Repos of the
+// same name in other namespaces get comments of their own.
+func Marker(repo string) string {
+	return fmt.Sprintf("<!-- terraform-plan: %s -->", repo)
+}
+
+// Render writes a plan as a Markdown comment of at most maxLength bytes: the
+// summary first, then the diff in a collapsed section, truncated to fit
+func Render(plan Plan, maxLength int) string {
+	var head strings.Builder
+	head.WriteString(Marker(plan.Repo) + "\n")
+	fmt.Fprintf(&head, "#### Terraform plan of `%s` at %s\n\n", plan.Repo, shortSHA(plan.GitSHA))
+	if plan.Summary != nil {
+		fmt.Fprintf(&head, "**%s.**", plan.Summary)
+		if plan.Summary.Replace > 0 {
+			fmt.Fprintf(&head, " %d to replace.", plan.Summary.Replace)
+		}
+		head.WriteString("\n\n")
+		if plan.Summary.Add+plan.Summary.Change+plan.Summary.Destroy == 0 {
+			head.WriteString("No changes.\n\n")
+		}
+	}
+	details := "Show plan"
+	if failure := plan.Failure; failure != nil {
+		fmt.Fprintf(&head, "**Plan failed at %s:** %s\n\n", failure.Step, failure.Reason)
+		details = "Show output"
+	}
+	fmt.Fprintf(&head, "<details><summary>%s</summary>\n\n```diff\n", details)
+	const tail = "\n```\n\n</details>\n"
+
+	diff := strings.TrimRight(plan.Diff, "\n")
+	room := maxLength - head.Len() - len(tail)
+	if len(diff) > room {
+		notice := fmt.Sprintf(truncatedNotice, len(diff), plan.RunJobName)
+		keep := room - len(notice)
+		if keep < 0 {
+			keep = 0
+		}
+		// cut at a line, leaving the number of bytes omitted right
+		cut := diff[:keep]
+		if i := strings.LastIndex(cut, "\n"); i >= 0 {
+			cut = cut[:i]
+		}
+		diff = cut + fmt.Sprintf(truncatedNotice, len(diff)-len(cut), plan.RunJobName)
+	}
+	return head.String() + diff + tail
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
@@ -0,0 +1,76 @@
+// Package runnercache shares the provider plugins Terraform downloads between
+// the runs of Repos, so that terraform init only downloads the providers that
+// changed since the last run. Modules are not cached: the ones of branches and
+// version ranges have to be installed again for every run to pick up their
+// changes.
+package runnercache
+
+import (
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	repov1alpha1 "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
+)
+
+const (
+	volumeName = "terraform-cache"
+	// MountPath is where the cache is mounted in runner containers
+	MountPath = "/terraform-cache"
+)
+
+// Cache is the volume runner Jobs share. Plugins are shared by the Repos of
+// a namespace. Runners only mount the directory of their namespace, so that
+// a run can not plant a provider binary that the runs of other namespaces
+// would execute. Terraform does not support concurrent writers of a plugin
+// cache: runners lock the directory of their namespace while they install
+// providers, which needs a volume supporting file locks.
+type Cache struct {
+	// ClaimName is a PersistentVolumeClaim, expected in every namespace Repos
+	// run in. Claims need the ReadWriteMany access mode for runs to go on
+	// at once on different nodes, and file locks held across nodes.
+	ClaimName string
+	// HostPath is a directory of the nodes, created if missing
+	HostPath string
+}
+
+// Enabled tells if runners are given a cache
+func (cache Cache) Enabled() bool {
+	return cache.ClaimName != "" || cache.HostPath != ""
+}
+
+// Validate checks that a single kind of volume is configured
+func (cache Cache) Validate() error {
+	if cache.ClaimName != "" && cache.HostPath != "" {
+		return errors.New("the plugin cache is either a PersistentVolumeClaim or a host path, not both")
+	}
+	return nil
+}
+
+// Mount mounts the cache in the runner containers of a Job, pointing
+// Terraform to its plugin cache
+func (cache Cache) Mount(job *batchv1.Job, repo *repov1alpha1.Repo) {
+	if !cache.Enabled() {
+		return
+	}
+	volume := corev1.Volume{Name: volumeName}
+	if cache.ClaimName != "" {
+		volume.PersistentVolumeClaim = &corev1.PersistentVolumeClaimVolumeSource{ClaimName: cache.ClaimName}
+	} else {
+		hostPathType := corev1.HostPathDirectoryOrCreate
+		volume.HostPath = &corev1.HostPathVolumeSource{Path: cache.HostPath, Type: &hostPathType}
+	}
+
+	podSpec := &job.Spec.Template.Spec
+	podSpec.Volumes = append(podSpec.Volumes, volume)
+	pluginsDir := filepath.Join(MountPath, "plugins")
+	for i := range podSpec.Containers {
+		container := &podSpec.Containers[i]
+		container.VolumeMounts = append(container.VolumeMounts,
+			corev1.VolumeMount{Name: volumeName, MountPath: pluginsDir, SubPath: filepath.Join("plugins", repo.Namespace)})
+		container.Env = append(container.Env,
+			corev1.EnvVar{Name: "TF_PLUGIN_CACHE_DIR", Value: pluginsDir})
+	}
+}
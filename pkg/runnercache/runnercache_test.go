@@ -0,0 +1,76 @@
+package runnercache
+
+import (
+	"reflect"
+	"testing"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	repov1alpha1 "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
+)
+
+func newJob() *batchv1.Job {
+	return &batchv1.Job{Spec: batchv1.JobSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+		Containers: []corev1.Container{{Name: "terraform-run"}},
+	}}}}
+}
+
+var repo = &repov1alpha1.Repo{ObjectMeta: metav1.ObjectMeta{Name: "infra", Namespace: "payments"}}
+
+func env(container corev1.Container) map[string]string {
+	vars := map[string]string{}
+	for _, variable := range container.Env {
+		vars[variable.Name] = variable.Value
+	}
+	return vars
+}
+
+func TestMountsClaim(t *testing.T) {
+	job := newJob()
+	Cache{ClaimName: "terraform-cache"}.Mount(job, repo)
+
+	podSpec := job.Spec.Template.Spec
+	if len(podSpec.Volumes) != 1 || podSpec.Volumes[0].PersistentVolumeClaim == nil ||
+		podSpec.Volumes[0].PersistentVolumeClaim.ClaimName != "terraform-cache" {
+		t.Fatalf("got volumes %+v", podSpec.Volumes)
+	}
+	container := podSpec.Containers[0]
+	expected := []corev1.VolumeMount{
+		{Name: "terraform-cache", MountPath: "/terraform-cache/plugins", SubPath: "plugins/payments"},
+	}
+	if !reflect.DeepEqual(container.VolumeMounts, expected) {
+		t.Errorf("got volume mounts %+v; want only the directory of the namespace", container.VolumeMounts)
+	}
+	vars := env(container)
+	if len(vars) != 1 || vars["TF_PLUGIN_CACHE_DIR"] != "/terraform-cache/plugins" {
+		t.Errorf("got env %v; want the plugin cache only", vars)
+	}
+}
+
+func TestMountsHostPath(t *testing.T) {
+	job := newJob()
+	Cache{HostPath: "/var/cache/terraform"}.Mount(job, repo)
+
+	volumes := job.Spec.Template.Spec.Volumes
+	if len(volumes) != 1 || volumes[0].HostPath == nil || volumes[0].HostPath.Path != "/var/cache/terraform" ||
+		*volumes[0].HostPath.Type != corev1.HostPathDirectoryOrCreate {
+		t.Errorf("got volumes %+v", volumes)
+	}
+}
+
+func TestMountsNothingWithoutCache(t *testing.T) {
+	job := newJob()
+	Cache{}.Mount(job, repo)
+
+	if len(job.Spec.Template.Spec.Volumes) != 0 || len(job.Spec.Template.Spec.Containers[0].Env) != 0 {
+		t.Errorf("got pod spec %+v; want it untouched", job.Spec.Template.Spec)
+	}
+}
+
+func TestRejectsBothVolumes(t *testing.T) {
+	if err := (Cache{ClaimName: "terraform-cache", HostPath: "/var/cache/terraform"}).Validate(); err == nil {
+		t.Error("got no error for a claim and a host path")
+	}
+}
@@ -0,0 +1,54 @@
+package runresult
+
+import (
+	"strings"
+)
+
+// Failure describes why a run failed
+type Failure struct {
+	// Step is the runner step that failed, e.g. "apply"
+	Step string `json:"step,omitempty"`
+	// Reason is a concise description of the failure
+	Reason string `json:"reason"`
+	// Output is the tail of the output of the failing step
+	Output string `json:"output,omitempty"`
+}
+
+// UnstructuredFailure describes a run from a termination message that is not
+// a structured result, such as the logs Kubernetes falls back to when the
+// runner crashed. The message is kept as is, and its last line as the reason.
+func UnstructuredFailure(message string) Failure {
+	message = strings.TrimSpace(message)
+	return Failure{Reason: lastLine(message), Output: message}
+}
+
+// Reason picks the first Terraform error of an output as the reason of a
+// failure, falling back to the error itself
+func Reason(output string, err error) string {
+	for _, line := range strings.Split(output, "\n") {
+		if line = strings.TrimSpace(line); strings.HasPrefix(line, "Error: ") {
+			return line
+		}
+	}
+	return err.Error()
+}
+
+// Tail returns the end of an output, at most max bytes long, starting at a line
+func Tail(output string, max int) string {
+	if len(output) <= max {
+		return output
+	}
+	tail := output[len(output)-max:]
+	if i := strings.Index(tail, "\n"); i >= 0 && i < len(tail)-1 {
+		tail = tail[i+1:]
+	}
+	return tail
+}
+
+func lastLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.LastIndex(s, "\n"); i >= 0 {
+		return strings.TrimSpace(s[i+1:])
+	}
+	return s
+}
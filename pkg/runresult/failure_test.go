@@ -0,0 +1,32 @@
+package runresult
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestKeepsLogsOfCrashedRunner(t *testing.T) {
+	parsed := UnstructuredFailure("Starting terraform-runner...\napply failed: exit status 1\n---\npanic: runtime error: invalid memory address\n")
+
+	if parsed.Step != "" {
+		t.Errorf("expected no step, got %q", parsed.Step)
+	}
+	if parsed.Reason != "panic: runtime error: invalid memory address" {
+		t.Errorf("got reason %q", parsed.Reason)
+	}
+	if !strings.HasPrefix(parsed.Output, "Starting terraform-runner...\napply failed") {
+		t.Errorf("got output %q; want the message kept as is", parsed.Output)
+	}
+}
+
+func TestReasonIsFirstTerraformError(t *testing.T) {
+	output := "aws_s3_bucket.logs: Creating...\n\nError: BucketAlreadyExists: bucket exists\n\n  on main.tf line 1\n\nError: timeout\n"
+
+	if reason := Reason(output, errors.New("exit status 1")); reason != "Error: BucketAlreadyExists: bucket exists" {
+		t.Errorf("got reason %q", reason)
+	}
+	if reason := Reason("Segmentation fault", errors.New("exit status 139")); reason != "exit status 139" {
+		t.Errorf("got reason %q", reason)
+	}
+}
@@ -0,0 +1,91 @@
+package runresult
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Resource change actions of a plan summary
+const (
+	ActionCreate  = "create"
+	ActionUpdate  = "update"
+	ActionDelete  = "delete"
+	ActionReplace = "replace"
+)
+
+// PlanSummary counts the resource changes of a plan, the way terraform plan
+// does: a replaced resource is counted both as added and destroyed.
+type PlanSummary struct {
+	Add     int `json:"add"`
+	Change  int `json:"change"`
+	Destroy int `json:"destroy"`
+	Replace int `json:"replace"`
+	// Changes are the resources changed, in plan order. They are left out of
+	// termination messages that would not fit otherwise.
+	Changes []PlanChange `json:"changes,omitempty"`
+}
+
+// PlanChange is the action planned for a resource
+type PlanChange struct {
+	Address string `json:"address"`
+	Action  string `json:"action"`
+	// Type is the resource type, for plan policies to evaluate. It is not reported.
+	Type string `json:"-"`
+}
+
+// String formats the counts of a plan the way terraform plan does
+func (plan PlanSummary) String() string {
+	return fmt.Sprintf("Plan: %d to add, %d to change, %d to destroy", plan.Add, plan.Change, plan.Destroy)
+}
+
+// The subset of the terraform show -json output describing resource changes
+type planRepresentation struct {
+	ResourceChanges []struct {
+		Address string `json:"address"`
+		Type    string `json:"type"`
+		Change  struct {
+			Actions []string `json:"actions"`
+		} `json:"change"`
+	} `json:"resource_changes"`
+}
+
+// SummarizePlan reads the output of terraform show -json for a saved plan
+func SummarizePlan(planJSON []byte) (*PlanSummary, error) {
+	var plan planRepresentation
+	if err := json.Unmarshal(planJSON, &plan); err != nil {
+		return nil, fmt.Errorf("reading plan: %v", err)
+	}
+
+	summary := &PlanSummary{}
+	for _, resource := range plan.ResourceChanges {
+		var action string
+		switch actions := resource.Change.Actions; {
+		case len(actions) == 2:
+			// delete then create, or create before destroy
+			action = ActionReplace
+			summary.Replace++
+			summary.Add++
+			summary.Destroy++
+		case len(actions) != 1:
+			continue
+		case actions[0] == ActionCreate:
+			action = ActionCreate
+			summary.Add++
+		case actions[0] == ActionUpdate:
+			action = ActionUpdate
+			summary.Change++
+		case actions[0] == ActionDelete:
+			action = ActionDelete
+			summary.Destroy++
+		default:
+			// no-op and read
+			continue
+		}
+		summary.Changes = append(summary.Changes, PlanChange{
+			Address: resource.Address,
+			Action:  action,
+			Type:    resource.Type,
+		})
+	}
+	return summary, nil
+}
@@ -0,0 +1,85 @@
+package runresult
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const showJSON = `{
+  "format_version": "0.1",
+  "terraform_version": "0.12.20",
+  "resource_changes": [
+    {"address": "aws_s3_bucket.logs", "type": "aws_s3_bucket", "change": {"actions": ["create"]}},
+    {"address": "aws_iam_role.runner", "type": "aws_iam_role", "change": {"actions": ["no-op"]}},
+    {"address": "aws_instance.web", "type": "aws_instance", "change": {"actions": ["delete", "create"]}},
+    {"address": "aws_security_group.web", "type": "aws_security_group", "change": {"actions": ["update"]}},
+    {"address": "data.aws_ami.ubuntu", "type": "aws_ami", "change": {"actions": ["read"]}},
+    {"address": "aws_eip.legacy", "type": "aws_eip", "change": {"actions": ["delete"]}}
+  ]
+}`
+
+func TestSummarizesPlan(t *testing.T) {
+	summary, err := SummarizePlan([]byte(showJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &PlanSummary{
+		Add:     2,
+		Change:  1,
+		Destroy: 2,
+		Replace: 1,
+		Changes: []PlanChange{
+			{Address: "aws_s3_bucket.logs", Type: "aws_s3_bucket", Action: ActionCreate},
+			{Address: "aws_instance.web", Type: "aws_instance", Action: ActionReplace},
+			{Address: "aws_security_group.web", Type: "aws_security_group", Action: ActionUpdate},
+			{Address: "aws_eip.legacy", Type: "aws_eip", Action: ActionDelete},
+		},
+	}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Errorf("got %+v; want %+v", summary, expected)
+	}
+	if summary.String() != "Plan: 2 to add, 1 to change, 2 to destroy" {
+		t.Errorf("got %q", summary.String())
+	}
+}
+
+func TestSummarizesEmptyPlan(t *testing.T) {
+	summary, err := SummarizePlan([]byte(`{"format_version": "0.1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(summary, &PlanSummary{}) {
+		t.Errorf("got %+v", summary)
+	}
+
+	if _, err := SummarizePlan([]byte("Error: Failed to load plan")); err == nil {
+		t.Error("expected an error for output that is not a plan")
+	}
+}
+
+func TestLeavesOutPlanChangesToFitTerminationMessage(t *testing.T) {
+	plan := &PlanSummary{}
+	for i := 0; i < 200; i++ {
+		plan.Add++
+		plan.Changes = append(plan.Changes, PlanChange{Address: fmt.Sprintf("aws_instance.web[%d]", i), Action: ActionCreate})
+	}
+	result := Result{Stages: []Stage{{Name: "plan"}}, Plan: plan}
+
+	message, err := result.Message()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(message) > maxMessageLength {
+		t.Errorf("got message of %d bytes; want at most %d", len(message), maxMessageLength)
+	}
+	parsed := Parse(message)
+	if parsed.Plan.Add != 200 || len(parsed.Plan.Changes) != 0 {
+		t.Errorf("expected the counts to be kept without the changes, got %+v", parsed.Plan)
+	}
+	if !strings.Contains(message, `"add":200`) || len(result.Plan.Changes) != 200 {
+		t.Error("expected the result to be left untouched")
+	}
+}
@@ -0,0 +1,199 @@
+// Package runresult is the contract between the Terraform runner and the
+// controller: the runner describes the outcome of a run as JSON in its
+// container termination message, which the controller reads from the runner pod.
+package runresult
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// TerminationLogPath is where the runner writes its termination message
+const TerminationLogPath = "/dev/termination-log"
+
+// Kubernetes truncates termination messages to 4096 bytes
+const maxMessageLength = 4096
+
+// Shortest a violation or a failure reason is cut to, to fit a message
+const minTruncatedLength = 64
+
+const ellipsis = "..."
+
+var (
+	applySummary     = regexp.MustCompile(`Apply complete! Resources: (\d+) added, (\d+) changed, (\d+) destroyed`)
+	terraformVersion = regexp.MustCompile(`Terraform v(\S+)`)
+)
+
+// Result describes a run of the runner, whether it succeeded or failed
+type Result struct {
+	// GitSHA is the revision checked out
+	GitSHA string `json:"gitSHA,omitempty"`
+	// TerraformVersion is the version of the terraform binary, e.g. "0.12.20"
+	TerraformVersion string `json:"terraformVersion,omitempty"`
+	// Stages are the stages run, in order. The last one failed if the run failed.
+	Stages []Stage `json:"stages"`
+	// Plan summarizes the changes planned before the apply
+	Plan *PlanSummary `json:"plan,omitempty"`
+	// Policy is the decision of the plan policy of the Repo on the plan
+	Policy *PolicyOutcome `json:"policy,omitempty"`
+	// Resources counts the resources changed by the apply
+	Resources *Resources `json:"resources,omitempty"`
+	// Failure describes why the run failed
+	Failure *Failure `json:"failure,omitempty"`
+}
+
+// Stage is a step of the run, such as "clone", "init" or "apply"
+type Stage struct {
+	Name           string `json:"name"`
+	ExitCode       int    `json:"exitCode"`
+	DurationMillis int64  `json:"durationMillis"`
+}
+
+// PolicyOutcome is the decision of a plan policy, one of the
+// v1alpha1.PolicyDecision values, along with the rules the plan breaks
+type PolicyOutcome struct {
+	Decision   string   `json:"decision"`
+	Violations []string `json:"violations,omitempty"`
+}
+
+// Resources counts the resources added, changed and destroyed by an apply
+type Resources struct {
+	Add     int `json:"add"`
+	Change  int `json:"change"`
+	Destroy int `json:"destroy"`
+}
+
+// Message formats a result as a termination message. A message cut by
+// Kubernetes is no longer JSON, so to fit in a termination message the plan
+// changes are left out of the result first, then the failure output is
+// truncated from the start, and last the policy violations, listing every
+// resource of a large plan, are cut down along with the failure reason.
+func (result Result) Message() (string, error) {
+	message, err := json.Marshal(result)
+	if err != nil || len(message) <= maxMessageLength {
+		return string(message), err
+	}
+
+	if result.Plan != nil && len(result.Plan.Changes) != 0 {
+		plan := *result.Plan
+		plan.Changes = nil
+		result.Plan = &plan
+		if message, err = json.Marshal(result); err != nil || len(message) <= maxMessageLength {
+			return string(message), err
+		}
+	}
+
+	var failure Failure
+	if result.Failure != nil {
+		failure = *result.Failure
+		result.Failure = &failure
+		output := failure.Output
+		for max := len(output) - (len(message) - maxMessageLength); max > 0; max -= len(message) - maxMessageLength {
+			failure.Output = Tail(output, max)
+			if message, err = json.Marshal(result); err != nil || len(message) <= maxMessageLength {
+				return string(message), err
+			}
+		}
+		failure.Output = ""
+		if message, err = json.Marshal(result); err != nil || len(message) <= maxMessageLength {
+			return string(message), err
+		}
+	}
+
+	var policy PolicyOutcome
+	if result.Policy != nil {
+		policy = *result.Policy
+		result.Policy = &policy
+	}
+	violations, reason := policy.Violations, failure.Reason
+	// halves the room of each violation and of the reason until it fits
+	for max := maxMessageLength / 2; max >= minTruncatedLength; max /= 2 {
+		policy.Violations = boundViolations(violations, max)
+		failure.Reason = truncate(reason, max)
+		if message, err = json.Marshal(result); err != nil || len(message) <= maxMessageLength {
+			return string(message), err
+		}
+	}
+	return string(message), nil
+}
+
+// boundViolations keeps as many violations as fit in max bytes, each cut to
+// max bytes too, and counts the ones left out
+func boundViolations(violations []string, max int) []string {
+	var bounded []string
+	length := 0
+	for i, violation := range violations {
+		violation = truncate(violation, max)
+		if i != 0 && length+len(violation) > max {
+			return append(bounded, fmt.Sprintf("and %d more violations", len(violations)-i))
+		}
+		bounded = append(bounded, violation)
+		length += len(violation)
+	}
+	return bounded
+}
+
+// truncate cuts a string to at most max bytes, at a rune, marking the cut
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	cut := max - len(ellipsis)
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + ellipsis
+}
+
+// Write saves a result as the termination message of the runner container
+func (result Result) Write() error {
+	message, err := result.Message()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(TerminationLogPath, []byte(message), 0644)
+}
+
+// Parse reads the termination message of a runner. Messages that are not a
+// structured result are read as the failure of the run, see UnstructuredFailure.
+func Parse(message string) Result {
+	var result Result
+	if trimmed := strings.TrimSpace(message); strings.HasPrefix(trimmed, "{") {
+		if err := json.Unmarshal([]byte(trimmed), &result); err == nil {
+			return result
+		}
+	}
+	failure := UnstructuredFailure(message)
+	return Result{Failure: &failure}
+}
+
+// IsStructured tells if a result was reported by a runner, as opposed to
+// recovered from an unstructured termination message
+func (result Result) IsStructured() bool {
+	return len(result.Stages) != 0
+}
+
+// ParseResources reads the resource counts of the output of terraform apply
+func ParseResources(output string) *Resources {
+	match := applySummary.FindStringSubmatch(output)
+	if match == nil {
+		return nil
+	}
+	add, _ := strconv.Atoi(match[1])
+	change, _ := strconv.Atoi(match[2])
+	destroy, _ := strconv.Atoi(match[3])
+	return &Resources{Add: add, Change: change, Destroy: destroy}
+}
+
+// ParseTerraformVersion reads the output of terraform version
+func ParseTerraformVersion(output string) string {
+	if match := terraformVersion.FindStringSubmatch(output); match != nil {
+		return match[1]
+	}
+	return ""
+}
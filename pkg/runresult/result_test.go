@@ -0,0 +1,111 @@
+package runresult
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsesResult(t *testing.T) {
+	result := Result{
+		GitSHA:           "f7b8777",
+		TerraformVersion: "0.12.20",
+		Stages: []Stage{
+			{Name: "clone", DurationMillis: 1200},
+			{Name: "apply", ExitCode: 0, DurationMillis: 35000},
+		},
+		Resources: &Resources{Add: 3, Change: 1},
+	}
+	message, err := result.Message()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed := Parse(message); !reflect.DeepEqual(parsed, result) {
+		t.Errorf("got %+v; want %+v", parsed, result)
+	}
+}
+
+func TestParsesUnstructuredMessage(t *testing.T) {
+	parsed := Parse("Starting terraform-runner...\nError: BucketAlreadyExists\n")
+
+	if parsed.IsStructured() {
+		t.Error("expected an unstructured result")
+	}
+	if parsed.Failure == nil || parsed.Failure.Step != "" || parsed.Failure.Reason != "Error: BucketAlreadyExists" {
+		t.Errorf("got failure %+v", parsed.Failure)
+	}
+}
+
+func TestFitsTerminationMessage(t *testing.T) {
+	output := strings.Repeat("aws_instance.web: Still creating... [10s elapsed]\n", 200) + "Error: \"timeout\"\n"
+	result := Result{
+		Stages:  []Stage{{Name: "apply", ExitCode: 1, DurationMillis: 600000}},
+		Failure: &Failure{Step: "apply", Reason: "Error: \"timeout\"", Output: output},
+	}
+	message, err := result.Message()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(message) > maxMessageLength {
+		t.Errorf("got message of %d bytes; want at most %d", len(message), maxMessageLength)
+	}
+	parsed := Parse(message)
+	if !strings.HasSuffix(parsed.Failure.Output, "Error: \"timeout\"\n") {
+		t.Error("expected the end of the output to be kept")
+	}
+	if !strings.HasPrefix(parsed.Failure.Output, "aws_instance.web") {
+		t.Error("expected the output tail to start at a line")
+	}
+	if result.Failure.Output != output {
+		t.Error("expected the result to be left untouched")
+	}
+}
+
+func TestFitsDeniedPlanInTerminationMessage(t *testing.T) {
+	var addresses []string
+	for i := 0; i < 300; i++ {
+		addresses = append(addresses, fmt.Sprintf("module.databases.aws_db_instance.replica[%d]", i))
+	}
+	violation := fmt.Sprintf("destroys %v, whose types must not be destroyed", addresses)
+	result := Result{
+		Stages:  []Stage{{Name: "plan"}, {Name: "show"}, {Name: "policy"}},
+		Plan:    &PlanSummary{Destroy: 300},
+		Policy:  &PolicyOutcome{Decision: "Denied", Violations: []string{violation, "changes 300 resources, more than the 50 allowed"}},
+		Failure: &Failure{Step: "policy", Reason: "Plan denied by policy: " + violation},
+	}
+	message, err := result.Message()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(message) > maxMessageLength {
+		t.Errorf("got message of %d bytes; want at most %d", len(message), maxMessageLength)
+	}
+	parsed := Parse(message)
+	if !parsed.IsStructured() || parsed.Policy == nil || parsed.Policy.Decision != "Denied" {
+		t.Fatalf("got result %+v; want the decision kept", parsed)
+	}
+	if len(parsed.Policy.Violations) == 0 || !strings.HasPrefix(parsed.Policy.Violations[0], "destroys [module.databases") {
+		t.Errorf("got violations %q", parsed.Policy.Violations)
+	}
+	if parsed.Failure == nil || !strings.HasPrefix(parsed.Failure.Reason, "Plan denied by policy: destroys") {
+		t.Errorf("got failure %+v", parsed.Failure)
+	}
+}
+
+func TestParsesApplyOutput(t *testing.T) {
+	output := "aws_s3_bucket.logs: Creation complete after 2s\n\nApply complete! Resources: 2 added, 1 changed, 0 destroyed.\n"
+
+	if resources := ParseResources(output); !reflect.DeepEqual(resources, &Resources{Add: 2, Change: 1}) {
+		t.Errorf("got resources %+v", resources)
+	}
+	if resources := ParseResources("No changes. Infrastructure is up-to-date."); resources != nil {
+		t.Errorf("got resources %+v; want none", resources)
+	}
+	if version := ParseTerraformVersion("Terraform v0.12.20\n+ provider.aws v2.50.0\n"); version != "0.12.20" {
+		t.Errorf("got version %q", version)
+	}
+}
@@ -0,0 +1,200 @@
+package scheduler
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	batchlisters "k8s.io/client-go/listers/batch/v1"
+)
+
+// Queued runs that have not asked to be admitted for this long are assumed
+// to be gone. Queued Repos are retried well within this period.
+const waitingRunExpiry = 2 * time.Minute
+
+// Limits caps the number of Terraform Jobs running at once. Zero means no limit.
+type Limits struct {
+	MaxConcurrentRuns             int
+	MaxConcurrentRunsPerNamespace int
+}
+
+// Run is a new run of a Repo asking for its Job to be created
+type Run struct {
+	// RepoKey is the namespace/name key of the Repo, followed by #<number>
+	// for the plan runs of its pull requests
+	RepoKey   string
+	Namespace string
+	JobName   string
+	Priority  int32
+}
+
+type waitingRun struct {
+	Run
+	queuedTime   time.Time
+	lastSeenTime time.Time
+}
+
+// Throttler admits new runs while the number of running Jobs is below the limits.
+// Jobs are counted from the informer cache, along with the Jobs admitted but
+// not yet seen by the informer, so that concurrent workers cannot exceed them.
+// The informer sees the Jobs of every replica, so sharded replicas share the
+// limits. Replicas admitting runs at the same time may still exceed them until
+// the Jobs of the others show up in their cache.
+//
+// When runs have to wait, they are admitted in order of priority. Runs of the
+// same priority go to the namespace with the fewest runs in progress first,
+// then to the run queued the longest, so that no namespace starves the others.
+// Only the runs queued on this replica are ordered.
+type Throttler struct {
+	limits      Limits
+	jobsLister  batchlisters.JobLister
+	jobSelector labels.Selector
+
+	mu sync.Mutex
+	// admitted Jobs not yet in the informer cache, by namespace/name key
+	admitted map[string]string
+	// runs waiting for a slot, by Repo key
+	waiting map[string]*waitingRun
+	now     func() time.Time
+}
+
+// NewThrottler counts the Jobs matching the selector against the limits
+func NewThrottler(limits Limits, jobsLister batchlisters.JobLister, jobSelector labels.Selector) *Throttler {
+	return &Throttler{
+		limits:      limits,
+		jobsLister:  jobsLister,
+		jobSelector: jobSelector,
+		admitted:    make(map[string]string),
+		waiting:     make(map[string]*waitingRun),
+		now:         time.Now,
+	}
+}
+
+// Admit reserves a slot for the Job of a new run. When the limits are reached,
+// or runs ahead of it are waiting, the run is queued and Admit returns false
+// along with the reason the run has to wait.
+func (t *Throttler) Admit(run Run) (bool, string, error) {
+	if t.limits.MaxConcurrentRuns == 0 && t.limits.MaxConcurrentRunsPerNamespace == 0 {
+		return true, "", nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	running, runningByNamespace, err := t.countRunning()
+	if err != nil {
+		return false, "", err
+	}
+
+	now := t.now()
+	t.expireWaiting(now)
+	waiting, found := t.waiting[run.RepoKey]
+	if !found || waiting.JobName != run.JobName {
+		waiting = &waitingRun{Run: run, queuedTime: now}
+		t.waiting[run.RepoKey] = waiting
+	}
+	waiting.Run = run
+	waiting.lastSeenTime = now
+
+	if limit := t.limits.MaxConcurrentRuns; limit != 0 && running >= limit {
+		return false, fmt.Sprintf("%d runs in progress, limit is %d", running, limit), nil
+	}
+	if limit := t.limits.MaxConcurrentRunsPerNamespace; limit != 0 && runningByNamespace[run.Namespace] >= limit {
+		return false, fmt.Sprintf("%d runs in progress in namespace %s, limit is %d",
+			runningByNamespace[run.Namespace], run.Namespace, limit), nil
+	}
+	if next := t.next(runningByNamespace); next.RepoKey != run.RepoKey {
+		return false, fmt.Sprintf("run of %s is next in line", next.RepoKey), nil
+	}
+
+	delete(t.waiting, run.RepoKey)
+	t.admitted[run.Namespace+"/"+run.JobName] = run.Namespace
+	return true, "", nil
+}
+
+// Release frees the slot of an admitted run whose Job could not be created
+func (t *Throttler) Release(run Run) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.admitted, run.Namespace+"/"+run.JobName)
+}
+
+// Forget drops the queued run of a Repo that no longer needs to run
+func (t *Throttler) Forget(repoKey string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.waiting, repoKey)
+}
+
+// next returns the waiting run to admit first, among the runs whose namespace
+// is below its limit
+func (t *Throttler) next(runningByNamespace map[string]int) *waitingRun {
+	var candidates []*waitingRun
+	for _, run := range t.waiting {
+		if limit := t.limits.MaxConcurrentRunsPerNamespace; limit != 0 && runningByNamespace[run.Namespace] >= limit {
+			continue
+		}
+		candidates = append(candidates, run)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		if runningByNamespace[a.Namespace] != runningByNamespace[b.Namespace] {
+			return runningByNamespace[a.Namespace] < runningByNamespace[b.Namespace]
+		}
+		if !a.queuedTime.Equal(b.queuedTime) {
+			return a.queuedTime.Before(b.queuedTime)
+		}
+		return a.RepoKey < b.RepoKey
+	})
+	return candidates[0]
+}
+
+func (t *Throttler) expireWaiting(now time.Time) {
+	for key, run := range t.waiting {
+		if now.Sub(run.lastSeenTime) > waitingRunExpiry {
+			delete(t.waiting, key)
+		}
+	}
+}
+
+func (t *Throttler) countRunning() (int, map[string]int, error) {
+	jobs, err := t.jobsLister.List(t.jobSelector)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	running := 0
+	runningByNamespace := make(map[string]int)
+	for _, job := range jobs {
+		// admitted Jobs are counted once they show up in the cache
+		delete(t.admitted, job.Namespace+"/"+job.Name)
+		if IsFinished(job) {
+			continue
+		}
+		running++
+		runningByNamespace[job.Namespace]++
+	}
+	for _, namespace := range t.admitted {
+		running++
+		runningByNamespace[namespace]++
+	}
+	return running, runningByNamespace, nil
+}
+
+// IsFinished tells if a Job has completed or failed
+func IsFinished(job *batchv1.Job) bool {
+	for _, condition := range job.Status.Conditions {
+		if (condition.Type == batchv1.JobComplete || condition.Type == batchv1.JobFailed) &&
+			condition.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,187 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	batchlisters "k8s.io/client-go/listers/batch/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+var runSelector = labels.SelectorFromSet(labels.Set{"controller": "repos.terraform.gitops.k8s.io"})
+
+func newJob(namespace string, name string, finished bool) *batchv1.Job {
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels:    map[string]string{"controller": "repos.terraform.gitops.k8s.io"},
+		},
+	}
+	if finished {
+		job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue}}
+	}
+	return job
+}
+
+func newRun(namespace string, name string, priority int32) Run {
+	return Run{
+		RepoKey:   namespace + "/" + name,
+		Namespace: namespace,
+		JobName:   "terraform-run-" + name,
+		Priority:  priority,
+	}
+}
+
+type testThrottler struct {
+	*Throttler
+	indexer cache.Indexer
+	clock   time.Time
+}
+
+func newThrottler(limits Limits, jobs ...*batchv1.Job) *testThrottler {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, job := range jobs {
+		indexer.Add(job)
+	}
+	throttler := &testThrottler{
+		Throttler: NewThrottler(limits, batchlisters.NewJobLister(indexer), runSelector),
+		indexer:   indexer,
+		clock:     time.Date(2019, 10, 19, 8, 30, 0, 0, time.UTC),
+	}
+	throttler.now = func() time.Time { return throttler.clock }
+	return throttler
+}
+
+// admit asks for a slot a second later than the previous call
+func (t *testThrottler) admit(run Run) bool {
+	t.clock = t.clock.Add(time.Second)
+	admitted, _, err := t.Admit(run)
+	if err != nil {
+		panic(err)
+	}
+	return admitted
+}
+
+func (t *testThrottler) finish(namespace string, name string) {
+	t.indexer.Update(newJob(namespace, name, true))
+}
+
+func TestAdmitsRunsWithoutLimits(t *testing.T) {
+	throttler := newThrottler(Limits{}, newJob("payments", "terraform-run-1", false))
+
+	if !throttler.admit(newRun("payments", "billing", 0)) {
+		t.Error("expected run to be admitted when there are no limits")
+	}
+}
+
+func TestOnlyCountsRunningJobs(t *testing.T) {
+	throttler := newThrottler(Limits{MaxConcurrentRuns: 1},
+		newJob("payments", "terraform-run-1", true))
+
+	if admitted, reason, _ := throttler.Admit(newRun("payments", "billing", 0)); !admitted {
+		t.Errorf("expected run to be admitted once other runs finished, got %q", reason)
+	}
+}
+
+func TestCountsAdmittedJobsNotYetCached(t *testing.T) {
+	throttler := newThrottler(Limits{MaxConcurrentRuns: 1})
+
+	if !throttler.admit(newRun("payments", "billing", 0)) {
+		t.Fatal("expected first run to be admitted")
+	}
+	if throttler.admit(newRun("search", "elasticsearch", 0)) {
+		t.Error("expected second run to wait for the first one")
+	}
+
+	throttler.Release(newRun("payments", "billing", 0))
+	if !throttler.admit(newRun("search", "elasticsearch", 0)) {
+		t.Error("expected run to be admitted once the first one was released")
+	}
+}
+
+func TestLimitsRunsPerNamespace(t *testing.T) {
+	throttler := newThrottler(Limits{MaxConcurrentRuns: 3, MaxConcurrentRunsPerNamespace: 1},
+		newJob("payments", "terraform-run-1", false))
+
+	if throttler.admit(newRun("payments", "billing", 0)) {
+		t.Error("expected run to wait for the namespace's running Job")
+	}
+	if admitted, reason, _ := throttler.Admit(newRun("search", "elasticsearch", 0)); !admitted {
+		t.Errorf("expected run of another namespace to be admitted, got %q", reason)
+	}
+}
+
+func TestAdmitsHigherPriorityRunsFirst(t *testing.T) {
+	throttler := newThrottler(Limits{MaxConcurrentRuns: 1}, newJob("sandbox", "terraform-run-1", false))
+	sandbox := newRun("sandbox", "playground", 0)
+	hotfix := newRun("payments", "billing", 100)
+
+	throttler.admit(sandbox)
+	throttler.admit(hotfix)
+	throttler.finish("sandbox", "terraform-run-1")
+
+	if throttler.admit(sandbox) {
+		t.Error("expected run queued first to wait for the higher priority run")
+	}
+	if !throttler.admit(hotfix) {
+		t.Error("expected higher priority run to be admitted")
+	}
+}
+
+func TestSharesSlotsBetweenNamespaces(t *testing.T) {
+	throttler := newThrottler(Limits{MaxConcurrentRuns: 2},
+		newJob("sandbox", "terraform-run-1", false), newJob("sandbox", "terraform-run-2", false))
+	noisy := newRun("sandbox", "playground", 0)
+	quiet := newRun("search", "elasticsearch", 0)
+
+	throttler.admit(noisy)
+	throttler.admit(quiet)
+	throttler.finish("sandbox", "terraform-run-1")
+
+	if throttler.admit(noisy) {
+		t.Error("expected run of the namespace with the most runs in progress to wait")
+	}
+	if !throttler.admit(quiet) {
+		t.Error("expected run of the namespace with the fewest runs in progress to be admitted")
+	}
+}
+
+func TestAdmitsRunsQueuedFirst(t *testing.T) {
+	throttler := newThrottler(Limits{MaxConcurrentRuns: 1}, newJob("payments", "terraform-run-1", false))
+	first := newRun("payments", "billing", 0)
+	second := newRun("payments", "ledger", 0)
+
+	throttler.admit(first)
+	throttler.admit(second)
+	throttler.finish("payments", "terraform-run-1")
+
+	if throttler.admit(second) {
+		t.Error("expected run queued last to wait")
+	}
+	if !throttler.admit(first) {
+		t.Error("expected run queued first to be admitted")
+	}
+}
+
+func TestForgetsRunsNoLongerQueued(t *testing.T) {
+	throttler := newThrottler(Limits{MaxConcurrentRuns: 1}, newJob("payments", "terraform-run-1", false))
+	deleted := newRun("payments", "billing", 100)
+	abandoned := newRun("payments", "ledger", 50)
+	waiting := newRun("search", "elasticsearch", 0)
+
+	throttler.admit(deleted)
+	throttler.admit(abandoned)
+	throttler.admit(waiting)
+	throttler.finish("payments", "terraform-run-1")
+	throttler.Forget(deleted.RepoKey)
+	throttler.clock = throttler.clock.Add(waitingRunExpiry)
+
+	if !throttler.admit(waiting) {
+		t.Error("expected run to be admitted once the runs ahead of it are gone")
+	}
+}
@@ -0,0 +1,233 @@
+package sharding
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coordinationclientset "k8s.io/client-go/kubernetes/typed/coordination/v1"
+	"k8s.io/klog"
+)
+
+// Label set on the membership Leases of every replica of a shard group
+const ShardGroupLabel = "terraform.gitops.k8s.io/shard-group"
+
+// Filter decides which Repos, by namespace/name key, a replica is responsible for
+type Filter interface {
+	Owns(key string) bool
+}
+
+// Unsharded owns every Repo. Used when a single replica is active.
+type Unsharded struct{}
+
+func (Unsharded) Owns(key string) bool {
+	return true
+}
+
+// Sharder splits Repos between the active replicas of a shard group.
+// Each replica keeps its own Lease renewed; the replicas with a live Lease
+// are the members of the group. Repos are assigned with rendezvous hashing
+// so that only the Repos of a replica that joins or leaves move around.
+type Sharder struct {
+	leases        coordinationclientset.LeasesGetter
+	namespace     string
+	group         string
+	identity      string
+	leaseDuration time.Duration
+	renewPeriod   time.Duration
+	now           func() time.Time
+
+	mu       sync.RWMutex
+	members  []string
+	onChange []func()
+}
+
+func NewSharder(leases coordinationclientset.LeasesGetter,
+	namespace string,
+	group string,
+	identity string,
+	leaseDuration time.Duration,
+	renewPeriod time.Duration) *Sharder {
+
+	return &Sharder{
+		leases:        leases,
+		namespace:     namespace,
+		group:         group,
+		identity:      identity,
+		leaseDuration: leaseDuration,
+		renewPeriod:   renewPeriod,
+		now:           time.Now,
+	}
+}
+
+// OnChange registers a callback to run after the members of the group change.
+// Must be called before Start.
+func (s *Sharder) OnChange(callback func()) {
+	s.onChange = append(s.onChange, callback)
+}
+
+// Start joins the group and keeps the membership up to date until stopCh is
+// closed, at which point the replica leaves the group.
+func (s *Sharder) Start(stopCh <-chan struct{}) error {
+	if err := s.sync(); err != nil {
+		return err
+	}
+	go func() {
+		wait.Until(func() {
+			if err := s.sync(); err != nil {
+				klog.Errorf("Failed to sync shard group %s: %v", s.group, err)
+			}
+		}, s.renewPeriod, stopCh)
+		s.leave()
+	}()
+	return nil
+}
+
+// Owns tells if this replica is responsible for the Repo with the given key
+func (s *Sharder) Owns(key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return Owner(s.members, key) == s.identity
+}
+
+// Members lists the identities of the live replicas of the group
+func (s *Sharder) Members() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]string(nil), s.members...)
+}
+
+// Owner returns the member with the highest score for a key
+func Owner(members []string, key string) string {
+	var owner string
+	var highest uint64
+	for _, member := range members {
+		h := fnv.New64a()
+		h.Write([]byte(member))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		if score := mix(h.Sum64()); owner == "" || score > highest {
+			owner, highest = member, score
+		}
+	}
+	return owner
+}
+
+// mix spreads the bits of an FNV hash, which are too correlated between
+// inputs sharing a suffix to compare scores directly (murmur3 finalizer)
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+func (s *Sharder) sync() error {
+	if err := s.renew(); err != nil {
+		return err
+	}
+	members, err := s.liveMembers()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	changed := !equal(s.members, members)
+	s.members = members
+	s.mu.Unlock()
+
+	if changed {
+		klog.Infof("Shard group %s members are now %v", s.group, members)
+		for _, callback := range s.onChange {
+			callback()
+		}
+	}
+	return nil
+}
+
+func (s *Sharder) renew() error {
+	leaseDurationSeconds := int32(s.leaseDuration.Seconds())
+	renewTime := metav1.NewMicroTime(s.now())
+	lease, err := s.leases.Leases(s.namespace).Get(s.leaseName(), metav1.GetOptions{})
+	if kubeerrors.IsNotFound(err) {
+		_, err = s.leases.Leases(s.namespace).Create(&coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      s.leaseName(),
+				Namespace: s.namespace,
+				Labels:    map[string]string{ShardGroupLabel: s.group},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &s.identity,
+				LeaseDurationSeconds: &leaseDurationSeconds,
+				AcquireTime:          &renewTime,
+				RenewTime:            &renewTime,
+			},
+		})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	lease.Spec.HolderIdentity = &s.identity
+	lease.Spec.LeaseDurationSeconds = &leaseDurationSeconds
+	lease.Spec.RenewTime = &renewTime
+	_, err = s.leases.Leases(s.namespace).Update(lease)
+	return err
+}
+
+func (s *Sharder) liveMembers() ([]string, error) {
+	selector := labels.SelectorFromSet(labels.Set{ShardGroupLabel: s.group})
+	leases, err := s.leases.Leases(s.namespace).List(metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.now()
+	var members []string
+	for _, lease := range leases.Items {
+		spec := lease.Spec
+		if spec.HolderIdentity == nil || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+			continue
+		}
+		expiry := spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second)
+		if now.Before(expiry) {
+			members = append(members, *spec.HolderIdentity)
+		}
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+// leave deletes the Lease of this replica so the others take over its Repos
+// without waiting for it to expire
+func (s *Sharder) leave() {
+	err := s.leases.Leases(s.namespace).Delete(s.leaseName(), &metav1.DeleteOptions{})
+	if err != nil && !kubeerrors.IsNotFound(err) {
+		klog.Errorf("Failed to leave shard group %s: %v", s.group, err)
+	}
+}
+
+func (s *Sharder) leaseName() string {
+	return s.group + "-" + s.identity
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
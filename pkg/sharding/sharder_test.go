@@ -0,0 +1,102 @@
+package sharding
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestOwnerIsStableWhenMembersJoin(t *testing.T) {
+	before := []string{"controller-a", "controller-b"}
+	after := []string{"controller-a", "controller-b", "controller-c"}
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("default/repo-%d", i)
+		if owner := Owner(after, key); owner != "controller-c" && owner != Owner(before, key) {
+			t.Errorf("repo %s moved from %s to %s", key, Owner(before, key), owner)
+		}
+	}
+}
+
+func TestReplicasSplitRepos(t *testing.T) {
+	kubeclient := k8sfake.NewSimpleClientset()
+	stopA := make(chan struct{})
+	stopB := make(chan struct{})
+	defer close(stopB)
+	a := NewSharder(kubeclient.CoordinationV1(), "default", "repo-pull-controller", "controller-a", time.Minute, time.Hour)
+	b := NewSharder(kubeclient.CoordinationV1(), "default", "repo-pull-controller", "controller-b", time.Minute, time.Hour)
+
+	if err := a.Start(stopA); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Start(stopB); err != nil {
+		t.Fatal(err)
+	}
+	rebalanced := false
+	a.OnChange(func() { rebalanced = true })
+	if err := a.sync(); err != nil {
+		t.Fatal(err)
+	}
+	if !rebalanced {
+		t.Error("expected rebalance after a replica joined")
+	}
+
+	owned := map[string]int{}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("default/repo-%d", i)
+		if a.Owns(key) == b.Owns(key) {
+			t.Errorf("expected repo %s to be owned by exactly one replica", key)
+		}
+		if a.Owns(key) {
+			owned["controller-a"]++
+		}
+	}
+	if owned["controller-a"] == 0 || owned["controller-a"] == 100 {
+		t.Errorf("expected repos to be split, controller-a owns %d of 100", owned["controller-a"])
+	}
+
+	close(stopA)
+	if err := waitFor(func() bool { return b.sync() == nil && len(b.Members()) == 1 }); err != nil {
+		t.Fatalf("expected controller-a to leave the group, members are %v", b.Members())
+	}
+	if !b.Owns("default/repo-0") {
+		t.Error("expected the remaining replica to own every repo")
+	}
+}
+
+func TestExpiredReplicasAreNotMembers(t *testing.T) {
+	kubeclient := k8sfake.NewSimpleClientset()
+	now := time.Now()
+	a := NewSharder(kubeclient.CoordinationV1(), "default", "repo-pull-controller", "controller-a", time.Minute, time.Hour)
+	b := NewSharder(kubeclient.CoordinationV1(), "default", "repo-pull-controller", "controller-b", time.Minute, time.Hour)
+	a.now = func() time.Time { return now }
+	b.now = func() time.Time { return now }
+
+	if err := a.sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// controller-a stopped renewing its lease without leaving
+	now = now.Add(2 * time.Minute)
+	if err := b.sync(); err != nil {
+		t.Fatal(err)
+	}
+	if members := b.Members(); len(members) != 1 || members[0] != "controller-b" {
+		t.Errorf("got members %v; want [controller-b]", members)
+	}
+}
+
+func waitFor(condition func() bool) error {
+	for i := 0; i < 50; i++ {
+		if condition() {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("timed out")
+}
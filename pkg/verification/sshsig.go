@@ -0,0 +1,145 @@
+package verification
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"hash"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// SSH signatures follow the format used by ssh-keygen -Y sign, see
+// https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.sshsig
+const (
+	sshSignatureHeader = "-----BEGIN SSH SIGNATURE-----"
+	sshSignatureFooter = "-----END SSH SIGNATURE-----"
+	sshSignatureMagic  = "SSHSIG"
+	// git signs commits under this namespace
+	sshSignatureNamespace = "git"
+)
+
+type sshSignatureBlob struct {
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Signature     []byte
+}
+
+type sshSignedData struct {
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Hash          []byte
+}
+
+func verifySSHSignature(commit *object.Commit, trustedKeys []ssh.PublicKey) error {
+	blob, err := parseSSHSignature(commit.PGPSignature)
+	if err != nil {
+		return err
+	}
+	if blob.Namespace != sshSignatureNamespace {
+		return errors.Errorf("unexpected SSH signature namespace %q", blob.Namespace)
+	}
+
+	signingKey, err := ssh.ParsePublicKey(blob.PublicKey)
+	if err != nil {
+		return errors.Wrap(err, "parsing SSH signing key failed")
+	}
+	if !isTrustedSSHKey(signingKey, trustedKeys) {
+		return errors.Errorf("SSH key %s that signed commit %s is not trusted", ssh.FingerprintSHA256(signingKey), commit.Hash)
+	}
+
+	signature := &ssh.Signature{}
+	if err := ssh.Unmarshal(blob.Signature, signature); err != nil {
+		return errors.Wrap(err, "parsing SSH signature failed")
+	}
+
+	message, err := encodeWithoutSignature(commit)
+	if err != nil {
+		return err
+	}
+	signedData, err := sshSignedMessage(blob.HashAlgorithm, message)
+	if err != nil {
+		return err
+	}
+	if err := signingKey.Verify(signedData, signature); err != nil {
+		return errors.Wrapf(err, "SSH signature of commit %s is invalid", commit.Hash)
+	}
+	return nil
+}
+
+func parseSSHSignature(armored string) (*sshSignatureBlob, error) {
+	armored = strings.TrimSpace(armored)
+	if !strings.HasPrefix(armored, sshSignatureHeader) || !strings.HasSuffix(armored, sshSignatureFooter) {
+		return nil, errors.New("malformed SSH signature armor")
+	}
+	encoded := strings.TrimSuffix(strings.TrimPrefix(armored, sshSignatureHeader), sshSignatureFooter)
+	raw, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(encoded), ""))
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding SSH signature failed")
+	}
+	if !bytes.HasPrefix(raw, []byte(sshSignatureMagic)) {
+		return nil, errors.New("missing SSH signature preamble")
+	}
+
+	blob := &sshSignatureBlob{}
+	if err := ssh.Unmarshal(raw[len(sshSignatureMagic):], blob); err != nil {
+		return nil, errors.Wrap(err, "parsing SSH signature failed")
+	}
+	if blob.Version != 1 {
+		return nil, errors.Errorf("unsupported SSH signature version %d", blob.Version)
+	}
+	return blob, nil
+}
+
+// sshSignedMessage builds the blob that is actually signed for a message.
+func sshSignedMessage(hashAlgorithm string, message []byte) ([]byte, error) {
+	var h hash.Hash
+	switch hashAlgorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return nil, errors.Errorf("unsupported SSH signature hash algorithm %q", hashAlgorithm)
+	}
+	h.Write(message)
+
+	signedData := ssh.Marshal(sshSignedData{
+		Namespace:     sshSignatureNamespace,
+		HashAlgorithm: hashAlgorithm,
+		Hash:          h.Sum(nil),
+	})
+	return append([]byte(sshSignatureMagic), signedData...), nil
+}
+
+func isTrustedSSHKey(key ssh.PublicKey, trustedKeys []ssh.PublicKey) bool {
+	for _, trusted := range trustedKeys {
+		if bytes.Equal(key.Marshal(), trusted.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+func encodeWithoutSignature(commit *object.Commit) ([]byte, error) {
+	encoded := &plumbing.MemoryObject{}
+	if err := commit.EncodeWithoutSignature(encoded); err != nil {
+		return nil, err
+	}
+	reader, err := encoded.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
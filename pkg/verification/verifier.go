@@ -0,0 +1,159 @@
+package verification
+
+import (
+	"bufio"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	repov1alpha1 "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
+)
+
+const pgpPublicKeyHeader = "-----BEGIN PGP PUBLIC KEY BLOCK-----"
+
+// ErrUnsigned is returned when a commit carries no signature at all.
+var ErrUnsigned error = RefusedError{errors.New("commit is not signed")}
+
+// RefusedError tells that a commit is unsigned, or that its signature is
+// invalid or made by an untrusted key. Other errors, such as failing to read
+// the trusted keys, say nothing about the commit.
+type RefusedError struct {
+	err error
+}
+
+func (refused RefusedError) Error() string {
+	return refused.err.Error()
+}
+
+// IsRefused tells if a commit was refused, rather than not verified at all.
+func IsRefused(err error) bool {
+	_, refused := errors.Cause(err).(RefusedError)
+	return refused
+}
+
+// TrustedKeys are the public keys allowed to sign commits of a Repo.
+type TrustedKeys struct {
+	// ASCII armored GPG public keys
+	GPG []string
+	SSH []ssh.PublicKey
+}
+
+// Empty tells if no key at all is trusted.
+func (keys TrustedKeys) Empty() bool {
+	return len(keys.GPG) == 0 && len(keys.SSH) == 0
+}
+
+// Verifies commits against the keys listed in a Repo verification spec.
+// Keys referenced through a Secret are read on every verification so that
+// key rotations are picked up without restarting the controller.
+type SignatureVerifier struct {
+	kubeclientset kubernetes.Interface
+}
+
+func NewSignatureVerifier(kubeclientset kubernetes.Interface) SignatureVerifier {
+	return SignatureVerifier{
+		kubeclientset: kubeclientset,
+	}
+}
+
+// Verify returns an error unless the commit is signed by a key trusted by the Repo.
+// The error is a RefusedError only if the commit itself is at fault.
+func (verifier SignatureVerifier) Verify(repo *repov1alpha1.Repo, commit *object.Commit) error {
+	keys, err := verifier.TrustedKeys(repo)
+	if err != nil {
+		return err
+	}
+	return VerifyCommit(commit, keys)
+}
+
+// TrustedKeys collects the keys listed inline in the Repo spec and the ones
+// in the referenced Secret.
+func (verifier SignatureVerifier) TrustedKeys(repo *repov1alpha1.Repo) (TrustedKeys, error) {
+	keys := TrustedKeys{}
+	spec := repo.Spec.Verification
+	if spec == nil {
+		return keys, nil
+	}
+
+	keys.GPG = append(keys.GPG, spec.GPGKeys...)
+	for _, authorizedKeys := range spec.SSHKeys {
+		sshKeys, err := parseAuthorizedKeys(authorizedKeys)
+		if err != nil {
+			return keys, err
+		}
+		keys.SSH = append(keys.SSH, sshKeys...)
+	}
+
+	if spec.SecretRef != nil {
+		secret, err := verifier.kubeclientset.CoreV1().Secrets(repo.Namespace).Get(spec.SecretRef.Name, metav1.GetOptions{})
+		if err != nil {
+			return keys, errors.Wrapf(err, "reading trusted keys from secret %v/%v failed", repo.Namespace, spec.SecretRef.Name)
+		}
+		for name, data := range secret.Data {
+			if strings.Contains(string(data), pgpPublicKeyHeader) {
+				keys.GPG = append(keys.GPG, string(data))
+				continue
+			}
+			sshKeys, err := parseAuthorizedKeys(string(data))
+			if err != nil {
+				return keys, errors.Wrapf(err, "reading key %q of secret %v/%v failed", name, repo.Namespace, spec.SecretRef.Name)
+			}
+			keys.SSH = append(keys.SSH, sshKeys...)
+		}
+	}
+
+	return keys, nil
+}
+
+// VerifyCommit checks the GPG or SSH signature of a commit against the trusted keys.
+func VerifyCommit(commit *object.Commit, keys TrustedKeys) error {
+	if keys.Empty() {
+		return errors.New("no trusted keys configured")
+	}
+	if commit.PGPSignature == "" {
+		return ErrUnsigned
+	}
+
+	var err error
+	if strings.Contains(commit.PGPSignature, sshSignatureHeader) {
+		err = verifySSHSignature(commit, keys.SSH)
+	} else {
+		err = verifyGPGSignature(commit, keys.GPG)
+	}
+	if err != nil {
+		return RefusedError{err}
+	}
+	return nil
+}
+
+func verifyGPGSignature(commit *object.Commit, armoredKeys []string) error {
+	// Each armored block is read as a separate key ring, so try them one by one
+	for _, armoredKey := range armoredKeys {
+		if _, err := commit.Verify(armoredKey); err == nil {
+			return nil
+		}
+	}
+	return errors.Errorf("GPG signature of commit %s does not match any trusted key", commit.Hash)
+}
+
+// parseAuthorizedKeys reads SSH public keys, one per line, skipping blank lines and comments.
+func parseAuthorizedKeys(authorizedKeys string) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	scanner := bufio.NewScanner(strings.NewReader(authorizedKeys))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing SSH public key failed")
+		}
+		keys = append(keys, key)
+	}
+	return keys, scanner.Err()
+}
@@ -0,0 +1,197 @@
+package verification
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+
+	repov1alpha1 "github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/apis/repo/v1alpha1"
+)
+
+func TestVerifyGPGSignedCommit(t *testing.T) {
+	entity := newGPGEntity(t)
+	commit := newCommit()
+	signGPG(t, commit, entity)
+
+	err := VerifyCommit(commit, TrustedKeys{GPG: []string{armoredPublicKey(t, newGPGEntity(t)), armoredPublicKey(t, entity)}})
+	if err != nil {
+		t.Errorf("expected commit to be trusted, got %v", err)
+	}
+}
+
+func TestRefuseGPGSignatureFromUntrustedKey(t *testing.T) {
+	commit := newCommit()
+	signGPG(t, commit, newGPGEntity(t))
+
+	err := VerifyCommit(commit, TrustedKeys{GPG: []string{armoredPublicKey(t, newGPGEntity(t))}})
+	if !IsRefused(err) {
+		t.Errorf("expected commit signed by an untrusted key to be refused, got %v", err)
+	}
+}
+
+func TestRefuseUnsignedCommit(t *testing.T) {
+	err := VerifyCommit(newCommit(), TrustedKeys{GPG: []string{armoredPublicKey(t, newGPGEntity(t))}})
+	if err != ErrUnsigned {
+		t.Errorf("got = %v; want %v", err, ErrUnsigned)
+	}
+}
+
+func TestVerifySSHSignedCommit(t *testing.T) {
+	signer := newSSHSigner(t)
+	commit := newCommit()
+	signSSH(t, commit, signer)
+
+	if err := VerifyCommit(commit, TrustedKeys{SSH: []ssh.PublicKey{signer.PublicKey()}}); err != nil {
+		t.Errorf("expected commit to be trusted, got %v", err)
+	}
+
+	if err := VerifyCommit(commit, TrustedKeys{SSH: []ssh.PublicKey{newSSHSigner(t).PublicKey()}}); err == nil {
+		t.Error("expected commit signed by an untrusted key to be refused")
+	}
+
+	commit.Message = "tampered message"
+	if err := VerifyCommit(commit, TrustedKeys{SSH: []ssh.PublicKey{signer.PublicKey()}}); err == nil {
+		t.Error("expected tampered commit to be refused")
+	}
+}
+
+func TestReadTrustedKeysFromSecret(t *testing.T) {
+	signer := newSSHSigner(t)
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "trusted-keys", Namespace: metav1.NamespaceDefault},
+		Data: map[string][]byte{
+			"maintainer.asc": []byte(armoredPublicKey(t, newGPGEntity(t))),
+			"authorized_keys": append([]byte("# release signers\n"),
+				ssh.MarshalAuthorizedKey(signer.PublicKey())...),
+		},
+	}
+	repo := &repov1alpha1.Repo{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-repo", Namespace: metav1.NamespaceDefault},
+		Spec: repov1alpha1.RepoSpec{
+			Verification: &repov1alpha1.VerificationSpec{
+				SecretRef: &corev1.LocalObjectReference{Name: "trusted-keys"},
+			},
+		},
+	}
+
+	verifier := NewSignatureVerifier(k8sfake.NewSimpleClientset(secret))
+	keys, err := verifier.TrustedKeys(repo)
+	if err != nil {
+		t.Fatalf("unexpected error reading keys: %v", err)
+	}
+	if len(keys.GPG) != 1 || len(keys.SSH) != 1 {
+		t.Errorf("got %d GPG and %d SSH keys; want 1 and 1", len(keys.GPG), len(keys.SSH))
+	}
+}
+
+func TestDoNotRefuseCommitWithoutTrustedKeys(t *testing.T) {
+	repo := &repov1alpha1.Repo{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-repo", Namespace: metav1.NamespaceDefault},
+		Spec: repov1alpha1.RepoSpec{
+			Verification: &repov1alpha1.VerificationSpec{
+				SecretRef: &corev1.LocalObjectReference{Name: "trusted-keys"},
+			},
+		},
+	}
+
+	err := NewSignatureVerifier(k8sfake.NewSimpleClientset()).Verify(repo, newCommit())
+	if err == nil || IsRefused(err) {
+		t.Errorf("got = %v; want an error not refusing the commit", err)
+	}
+}
+
+func newCommit() *object.Commit {
+	signature := object.Signature{Name: "Jane", Email: "jane@example.com", When: time.Unix(1571443200, 0).UTC()}
+	return &object.Commit{
+		Author:    signature,
+		Committer: signature,
+		Message:   "Add bucket\n",
+		TreeHash:  plumbing.NewHash("4b825dc642cb6eb9a060e54bf8d69288fbee4904"),
+	}
+}
+
+func newGPGEntity(t *testing.T) *openpgp.Entity {
+	entity, err := openpgp.NewEntity("Jane", "", "jane@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entity
+}
+
+func armoredPublicKey(t *testing.T, entity *openpgp.Entity) string {
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	return buf.String()
+}
+
+func signGPG(t *testing.T, commit *object.Commit, entity *openpgp.Entity) {
+	message := encodedCommit(t, commit)
+	var signature bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&signature, entity, bytes.NewReader(message), nil); err != nil {
+		t.Fatal(err)
+	}
+	commit.PGPSignature = signature.String()
+}
+
+func newSSHSigner(t *testing.T) ssh.Signer {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// signSSH signs the commit the way ssh-keygen -Y sign -n git does
+func signSSH(t *testing.T, commit *object.Commit, signer ssh.Signer) {
+	digest := sha512.Sum512(encodedCommit(t, commit))
+	signedData := append([]byte(sshSignatureMagic), ssh.Marshal(sshSignedData{
+		Namespace:     sshSignatureNamespace,
+		HashAlgorithm: "sha512",
+		Hash:          digest[:],
+	})...)
+	signature, err := signer.Sign(rand.Reader, signedData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob := append([]byte(sshSignatureMagic), ssh.Marshal(sshSignatureBlob{
+		Version:       1,
+		PublicKey:     signer.PublicKey().Marshal(),
+		Namespace:     sshSignatureNamespace,
+		HashAlgorithm: "sha512",
+		Signature:     ssh.Marshal(signature),
+	})...)
+	commit.PGPSignature = sshSignatureHeader + "\n" + base64.StdEncoding.EncodeToString(blob) + "\n" + sshSignatureFooter + "\n"
+}
+
+func encodedCommit(t *testing.T, commit *object.Commit) []byte {
+	message, err := encodeWithoutSignature(commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	"github.com/davidmontoyago/di-terraform-repo-pull-controller/pkg/sharding"
+)
+
+// shardingConfig holds the settings of the group of active replicas that
+// split Repos between them
+type shardingConfig struct {
+	enabled       bool
+	namespace     string
+	group         string
+	leaseDuration time.Duration
+	renewPeriod   time.Duration
+}
+
+// newSharder joins the shard group as the current pod
+func newSharder(config shardingConfig, kubeClient kubernetes.Interface) *sharding.Sharder {
+	identity, err := os.Hostname()
+	if err != nil {
+		klog.Fatalf("Error getting hostname: %s", err.Error())
+	}
+	return sharding.NewSharder(kubeClient.CoordinationV1(),
+		config.namespace,
+		config.group,
+		identity,
+		config.leaseDuration,
+		config.renewPeriod)
+}